@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// 旧アカウント名から新しいアカウント名へリダイレクトする期間
+var accountRedirectTTL = 30 * 24 * time.Hour
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_ACCOUNT_REDIRECT_TTL")); err == nil && d > 0 {
+		accountRedirectTTL = d
+	}
+}
+
+// getSettingsAccountName はアカウント名の変更フォームを表示する
+func getSettingsAccountName(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("settings_account_name.html"),
+	)).Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postSettingsAccountName はアカウント名を変更する。
+// パスワードのソルトはアカウント名と独立しているので、変更してもパスワードはそのまま使える。
+// 旧アカウント名のページは一定期間、新しいアカウント名へ301でリダイレクトする。
+func postSettingsAccountName(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	notice := func(msg string) {
+		session := getSession(r)
+		session.Values["notice"] = msg
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/account-name", http.StatusFound)
+	}
+
+	newName := normalizeText(r.FormValue("account_name"))
+	if !validAccountName(newName) {
+		notice("アカウント名は3文字以上の英数字とアンダースコアで指定してください")
+		return
+	}
+	if newName == me.AccountName {
+		http.Redirect(w, r, "/@"+me.AccountName, http.StatusFound)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 重複はユニーク制約で判定する（事前にSELECTすると同時に変更されたときに重複しうる）
+	// ソルトが未移行なら旧アカウント名から作ったソルトを保存し、変更後もパスワードが通るようにする
+	_, err = tx.Exec("UPDATE `users` SET `account_name` = ?, `salt` = ? WHERE `id` = ?", newName, userSalt(me), me.ID)
+	if err != nil {
+		var merr *mysql.MySQLError
+		if errors.As(err, &merr) && merr.Number == 1062 { // ER_DUP_ENTRY
+			notice("アカウント名がすでに使われています")
+			return
+		}
+		log.Print(err)
+		return
+	}
+
+	// 新しい名前が誰かの旧アカウント名だった場合、実在するアカウントを優先してリダイレクトをやめる
+	if _, err := tx.Exec("DELETE FROM `account_name_redirects` WHERE `old_name` = ?", newName); err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `account_name_redirects` (`old_name`, `user_id`, `expires_at`) VALUES (?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `user_id` = VALUES(`user_id`), `expires_at` = VALUES(`expires_at`)",
+		me.AccountName, me.ID, time.Now().Add(accountRedirectTTL),
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// ユーザーのミュートはアカウント名で持っているので付け替える
+	muters := []int{}
+	if err := tx.Select(&muters, "SELECT `user_id` FROM `mutes` WHERE `target_type` = ? AND `target_value` = ?", muteTargetUser, me.AccountName); err != nil {
+		log.Print(err)
+		return
+	}
+	if _, err := tx.Exec("UPDATE IGNORE `mutes` SET `target_value` = ? WHERE `target_type` = ? AND `target_value` = ?", newName, muteTargetUser, me.AccountName); err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return
+	}
+	for _, uid := range muters {
+		memcacheClient.Delete(muteListKey(uid))
+	}
+
+	// ユーザー情報と、投稿者名を含む一覧のキャッシュを作り直させる
+	memcacheClient.Delete(fmt.Sprintf("user:%d", me.ID))
+	memcacheClient.Delete(fmt.Sprintf("account:%s", me.AccountName))
+	memcacheClient.Delete(fmt.Sprintf("account:%s", newName))
+	invalidateIndexPosts()
+
+	http.Redirect(w, r, "/@"+newName, http.StatusSeeOther)
+}
+
+// redirectRenamedAccount は旧アカウント名へのアクセスを新しいアカウント名へリダイレクトする。
+// リダイレクトしたら true を返す。
+func redirectRenamedAccount(w http.ResponseWriter, r *http.Request, oldName string) bool {
+	newName := ""
+	err := db.Get(&newName,
+		"SELECT u.`account_name` FROM `account_name_redirects` a JOIN `users` u ON u.`id` = a.`user_id` "+
+			"WHERE a.`old_name` = ? AND a.`expires_at` > ? AND u.`del_flg` = 0",
+		oldName, time.Now())
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		return false
+	}
+
+	// /@old/likes のような配下のパスやクエリも引き継ぐ
+	u := *r.URL
+	u.Path = "/@" + newName + strings.TrimPrefix(r.URL.Path, "/@"+oldName)
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	return true
+}
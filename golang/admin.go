@@ -0,0 +1,27 @@
+package main
+
+import "net/http"
+
+// requireAdmin はログイン中の管理者を返す。管理者でなければレスポンスを書いて false を返す
+func requireAdmin(w http.ResponseWriter, r *http.Request) (User, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return me, false
+	}
+	if me.Authority == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return me, false
+	}
+	return me, true
+}
+
+// adminOnly は管理者以外からのリクエストを断るミドルウェア
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r); !ok {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminOnlyDebugEndpoints(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+
+	admin := loginCookies(t, User{ID: 1, AccountName: "admin", Authority: 1}, "token")
+	user := loginCookies(t, User{ID: 2, AccountName: "alice"}, "token")
+
+	handlers := map[string]http.Handler{
+		"/debug/vars":        expvar.Handler(),
+		"/debug/cache-stats": http.HandlerFunc(getDebugCacheStats),
+	}
+	tests := []struct {
+		name    string
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"未ログイン", nil, http.StatusUnauthorized},
+		{"一般ユーザー", user, http.StatusForbidden},
+		{"管理者", admin, http.StatusOK},
+	}
+
+	for path, h := range handlers {
+		for _, tt := range tests {
+			t.Run(path+"/"+tt.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				adminOnly(h).ServeHTTP(w, withCookies(httptest.NewRequest(http.MethodGet, path, nil), tt.cookies))
+				if w.Code != tt.want {
+					t.Errorf("status = %d, want %d", w.Code, tt.want)
+				}
+				if tt.want != http.StatusOK && w.Body.Len() > 0 {
+					t.Errorf("stats leaked to a non-admin: %q", w.Body.String())
+				}
+			})
+		}
+	}
+}
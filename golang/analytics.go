@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// 集計結果をキャッシュする秒数
+	analyticsCacheTTL = 10 * 60
+	// 期間を指定しなかったときに集計する日数
+	analyticsDefaultDays = 30
+)
+
+// analyticsStats は投稿またはコメントの集計。グラフにそのまま渡せるよう、
+// 時間帯は0〜23時、曜日は日曜始まりの0〜6を添字にした配列で返す。
+type analyticsStats struct {
+	Total     int             `json:"total"`
+	ByHour    [24]int         `json:"by_hour"`
+	ByWeekday [7]int          `json:"by_weekday"`
+	ByLang    []analyticsLang `json:"by_lang"`
+}
+
+type analyticsLang struct {
+	Lang  string `json:"lang"`
+	Count int    `json:"count"`
+}
+
+type analyticsResult struct {
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	Posts       analyticsStats `json:"posts"`
+	Comments    analyticsStats `json:"comments"`
+	GeneratedAt time.Time      `json:"generated_at"`
+}
+
+// parseAnalyticsRange は ?from=&to= を読む。日付（2006-01-02）か ISO8601 で指定でき、to は含まない。
+// 省略時は直近30日で、to はキャッシュが効くようキャッシュの有効期間の区切りに切り上げる。
+func parseAnalyticsRange(r *http.Request) (time.Time, time.Time, error) {
+	parse := func(v string) (time.Time, error) {
+		if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+			return t, nil
+		}
+		return time.Parse(ISO8601Format, v)
+	}
+
+	step := time.Duration(analyticsCacheTTL) * time.Second
+	to := time.Now().Truncate(step).Add(step)
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := parse(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -analyticsDefaultDays)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := parse(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
+
+// collectAnalytics は期間内の行を時間帯・曜日・言語ごとに数える。
+// where は created_at の範囲の条件で、(created_at, lang) を含むインデックスだけで集計できる。
+func collectAnalytics(table, where string, from, to time.Time) (analyticsStats, error) {
+	stats := analyticsStats{ByLang: []analyticsLang{}}
+
+	type bucket struct {
+		Key   int `db:"k"`
+		Count int `db:"count"`
+	}
+
+	byHour := []bucket{}
+	q := "SELECT HOUR(`created_at`) AS `k`, COUNT(*) AS `count` FROM `" + table + "` WHERE " + where + " GROUP BY `k`"
+	if err := db.Select(&byHour, q, from, to); err != nil {
+		return stats, err
+	}
+	for _, b := range byHour {
+		stats.ByHour[b.Key] = b.Count
+		stats.Total += b.Count
+	}
+
+	// DAYOFWEEK は日曜が1
+	byWeekday := []bucket{}
+	q = "SELECT DAYOFWEEK(`created_at`) AS `k`, COUNT(*) AS `count` FROM `" + table + "` WHERE " + where + " GROUP BY `k`"
+	if err := db.Select(&byWeekday, q, from, to); err != nil {
+		return stats, err
+	}
+	for _, b := range byWeekday {
+		stats.ByWeekday[b.Key-1] = b.Count
+	}
+
+	q = "SELECT `lang`, COUNT(*) AS `count` FROM `" + table + "` WHERE " + where + " GROUP BY `lang` ORDER BY `count` DESC"
+	if err := db.Select(&stats.ByLang, q, from, to); err != nil {
+		return stats, err
+	}
+	// 言語を判定できなかった投稿は und（未確定）として返す
+	for i := range stats.ByLang {
+		if stats.ByLang[i].Lang == "" {
+			stats.ByLang[i].Lang = "und"
+		}
+	}
+
+	return stats, nil
+}
+
+// getAdminAnalytics は投稿・コメントの時間帯別・曜日別・言語別の件数を返す
+func getAdminAnalytics(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	from, to, err := parseAnalyticsRange(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from・to は 2006-01-02 か ISO8601 形式で、from を to より前にしてください"})
+		return
+	}
+
+	cacheKey := fmt.Sprintf("analytics:%d:%d", from.Unix(), to.Unix())
+	if item, err := memcacheClient.Get(cacheKey); err == nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(item.Value)
+		return
+	}
+
+	res := analyticsResult{From: from, To: to, GeneratedAt: time.Now()}
+	res.Posts, err = collectAnalytics("posts", "`status` = 'published' AND `created_at` >= ? AND `created_at` < ?", from, to)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res.Comments, err = collectAnalytics("comments", "`created_at` >= ? AND `created_at` < ?", from, to)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	memcacheClient.Set(&memcache.Item{Key: cacheKey, Value: data, Expiration: analyticsCacheTTL})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIクライアント向けのJSON表現
+type apiPost struct {
+	ID        int            `json:"id"`
+	UserID    int            `json:"user_id"`
+	Body      string         `json:"body"`
+	Mime      string         `json:"mime"`
+	ImageURL  string         `json:"image_url"`
+	ImageAlt  string         `json:"image_alt"`
+	Lang      string         `json:"lang"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+type apiComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	UserID    int       `json:"user_id"`
+	Comment   string    `json:"comment"`
+	Lang      string    `json:"lang"`
+	ParentID  *int64    `json:"parent_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAPIPost(p Post) apiPost {
+	return apiPost{
+		ID:        p.ID,
+		UserID:    p.UserID,
+		Body:      p.Body,
+		Mime:      p.Mime,
+		ImageURL:  imageURL(p),
+		ImageAlt:  p.ImageAlt,
+		Lang:      langAttr(p.Lang),
+		Reactions: p.Reactions,
+		CreatedAt: p.CreatedAt,
+	}
+}
+
+func newAPIComment(c Comment) apiComment {
+	var parentID *int64
+	if c.ParentID.Valid {
+		parentID = &c.ParentID.Int64
+	}
+	return apiComment{
+		ID:        c.ID,
+		PostID:    c.PostID,
+		UserID:    c.UserID,
+		Comment:   c.Comment,
+		Lang:      langAttr(c.Lang),
+		ParentID:  parentID,
+		CreatedAt: c.CreatedAt,
+	}
+}
+
+// parseFields は ?fields=id,body のように指定された返すフィールドを返す。未指定ならnil
+func parseFields(r *http.Request) map[string]bool {
+	v := r.URL.Query().Get("fields")
+	if v == "" {
+		return nil
+	}
+	fields := map[string]bool{}
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields[f] = true
+		}
+	}
+	return fields
+}
+
+// selectFields は apiPost などのJSON表現から指定されたフィールドだけを残す。
+// 元の構造体に無いフィールド名は無視するので、構造体に含めていない
+// Passhash などが fields の指定で出力されることはない。
+// 有効なフィールドが1つも無ければすべてのフィールドを返す。
+func selectFields(v interface{}, fields map[string]bool) interface{} {
+	if fields == nil {
+		return v
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		return v
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		log.Print(err)
+		return v
+	}
+
+	selected := map[string]json.RawMessage{}
+	for k, raw := range all {
+		if fields[k] {
+			selected[k] = raw
+		}
+	}
+	if len(selected) == 0 {
+		return v
+	}
+	return selected
+}
+
+// wantsJSON はクライアントがJSONのレスポンスを求めているかを判定する
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+// respondCreated は作成したリソースの場所を返す。
+// ブラウザのフォーム送信には再POSTを避けるため303で、APIクライアントには201とリソースのJSONを返す。
+// resource はJSONのときだけ呼ばれ、nilを返した場合はLocationだけを返す。
+func respondCreated(w http.ResponseWriter, r *http.Request, location string, resource func() interface{}) {
+	if !wantsJSON(r) {
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Location", location)
+	v := resource()
+	if v == nil {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	writeJSON(w, http.StatusCreated, v)
+}
@@ -1,41 +1,103 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	crand "crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
 	"github.com/go-chi/chi/v5"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 )
 
+var (
+	errLoginFailed   = errors.New("invalid account name or password")
+	errAccountBanned = errors.New("account is banned")
+)
+
 var (
 	db             *sqlx.DB
 	store          *gsm.MemcacheStore
 	memcacheClient *memcache.Client
+
+	// フォーム表示時刻トークンの署名鍵（プロセスごとに生成する）
+	formTokenKey []byte
 )
 
+// ISUCONP_ALLOW_TEXT_POST=1 なら画像の無いテキストのみの投稿を許可する
+var allowTextPost = os.Getenv("ISUCONP_ALLOW_TEXT_POST") == "1"
+
+// テンプレートで使う関数
+var fmap = template.FuncMap{
+	"imageURL":       imageURL,
+	"renderBody":     renderBody,
+	"formToken":      newFormToken,
+	"langAttr":       langAttr,
+	"blurhashURI":    blurhashURI,
+	"altText":        altText,
+	"asset":          asset,
+	"highlight":      highlight,
+	"reactionEmojis": listReactionEmojis,
+}
+
 const (
 	postsPerPage  = 20
-	ISO8601Format = "2006-01-02T15:04:05-07:00"
-	UploadLimit   = 10 * 1024 * 1024 // 10mb
+	maxPostsLimit = 100 // ?limit= で指定できる件数の上限
+	relatedPosts  = 6   // 投稿詳細ページに出す同じ投稿者の他の投稿数
+	maxSinceCount = 99  // 新着件数はこれを上限として「99+」扱いにする
+	indexPostsTTL = 60  // トップページの投稿一覧キャッシュの秒数
+
+	latestPostIDTTL = 3 // 最新投稿IDのキャッシュの秒数
+	ISO8601Format   = "2006-01-02T15:04:05-07:00"
+	UploadLimit     = 10 * 1024 * 1024 // 10mb
+
+	// /initialize全体のデフォルトのタイムアウト
+	defaultInitializeTimeout = 10 * time.Second
+
+	// フォーム表示から送信までにこれより短い場合はボットとみなす
+	formMinInterval = 2 * time.Second
+
+	// カーソルの時刻がこれ以上未来なら現在時刻にする（クライアントとの時計のずれは許容する）
+	cursorFutureTolerance = 5 * time.Minute
+
+	sessionName = "isuconp-go.session"
+
+	// 投稿の公開状態
+	postStatusDraft     = "draft"
+	postStatusPublished = "published"
+	postStatusPreparing = "preparing" // IDだけ予約してまだ確定していない
+	postStatusScheduled = "scheduled" // 公開予約中（publish_at になったら公開する）
+
+	// コメントの表示順
+	commentOrderAsc  = "asc"
+	commentOrderDesc = "desc"
 )
 
 type User struct {
@@ -45,28 +107,69 @@ type User struct {
 	Authority   int       `db:"authority"`
 	DelFlg      int       `db:"del_flg"`
 	CreatedAt   time.Time `db:"created_at"`
+	LikesPublic int       `db:"likes_public"` // 1ならいいねした投稿を他人にも公開する
+	// 1なら投稿・コメントを本人以外に見せない（本人には通知せずにそのまま見せる）
+	ShadowBanned int `db:"shadow_banned"`
+	// パスワードハッシュのソルト。空なら以前のアカウント名から作るソルトを使う
+	Salt string `db:"salt"`
 }
 
 type Post struct {
-	ID           int       `db:"id"`
-	UserID       int       `db:"user_id"`
-	Imgdata      []byte    `db:"imgdata"`
-	Body         string    `db:"body"`
-	Mime         string    `db:"mime"`
-	CreatedAt    time.Time `db:"created_at"`
-	CommentCount int
-	Comments     []Comment
-	User         User
-	CSRFToken    string
+	ID             int             `db:"id"`
+	UserID         int             `db:"user_id"`
+	Imgdata        []byte          `db:"imgdata"`
+	Body           string          `db:"body"`
+	Mime           string          `db:"mime"`
+	CreatedAt      time.Time       `db:"created_at"`
+	ImageAlt       string          `db:"image_alt"`
+	ImageAltManual int             `db:"image_alt_manual"` // 1なら手動設定（自動生成で上書きしない）
+	Lang           string          `db:"lang"`
+	Blurhash       string          `db:"blurhash"` // 読み込み中に表示する縮小画像（base64のPNG）
+	Status         string          `db:"status"`   // 下書き・公開予約中なら本人にしか見せない
+	Width          int             `db:"width"`    // 向きを補正した後の寸法（未計測なら0）
+	Height         int             `db:"height"`
+	UpdatedAt      time.Time       `db:"updated_at"` // 本文を編集した時刻（楽観ロックに使う）
+	Lat            sql.NullFloat64 `db:"lat"`        // 撮影場所（無ければNULL）
+	Lng            sql.NullFloat64 `db:"lng"`
+	GeoPublic      int             `db:"geo_public"`     // 1なら位置情報を本人以外にも公開する
+	QuotedPostID   sql.NullInt64   `db:"quoted_post_id"` // 引用した投稿
+	QuoteCount     int             `db:"quote_count"`    // この投稿が引用された回数
+	ViewCount      int             `db:"view_count"`     // 書き戻し済みの閲覧数（未反映の分はmemcacheにある）
+	PublishAt      sql.NullTime    `db:"publish_at"`     // 公開予約の時刻（公開予約中でなければNULL）
+	CommentCount   int
+	LikeCount      int
+	Comments       []Comment
+	User           User
+	CSRFToken      string
+	Reactions      map[string]int  // 絵文字ごとのリアクション数
+	MyReactions    map[string]bool // 閲覧者自身が付けたリアクション（キャッシュには含めない）
+	Truncated      bool            // 一覧用に本文を切り詰めたか（全文は詳細ページで表示する）
+	Excerpt        string          // 一覧に表示する切り詰めた本文（Truncated のときだけ）
+	// 引用元の投稿（引用元の引用まで埋め込む）。表示できない引用元なら QuotedUnavailable
+	Quoted            *Post
+	QuotedUnavailable bool
 }
 
-type Comment struct {
+type BanLog struct {
 	ID        int       `db:"id"`
-	PostID    int       `db:"post_id"`
 	UserID    int       `db:"user_id"`
-	Comment   string    `db:"comment"`
+	AdminID   int       `db:"admin_id"`
+	Reason    string    `db:"reason"`
 	CreatedAt time.Time `db:"created_at"`
-	User      User
+}
+
+type Comment struct {
+	ID          int           `db:"id"`
+	PostID      int           `db:"post_id"`
+	UserID      int           `db:"user_id"`
+	Comment     string        `db:"comment"`
+	CreatedAt   time.Time     `db:"created_at"`
+	Lang        string        `db:"lang"`
+	ParentID    sql.NullInt64 `db:"parent_id"` // 返信先のコメント（返信でなければNULL）
+	User        User
+	Replies     []Comment       // 投稿詳細ページでスレッド表示するときの返信
+	Reactions   map[string]int  // 絵文字ごとのリアクション数
+	MyReactions map[string]bool // 閲覧者自身が付けたリアクション
 }
 
 func init() {
@@ -79,39 +182,328 @@ func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-func dbInitialize() {
+func dbInitialize(ctx context.Context) error {
 	sqls := []string{
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
+		"DELETE FROM ban_logs",
+		"DELETE FROM likes",
+		"DELETE FROM post_tags WHERE post_id > 10000",
+		"DELETE FROM reports",
+		"DELETE FROM mutes",
+		"DELETE FROM reactions",
+		"DELETE FROM audit_logs",
+		"DELETE FROM account_name_redirects",
+		"DELETE FROM post_revisions",
+		"DELETE FROM webhooks",
+		"DELETE FROM webhook_deliveries",
+		"UPDATE users SET shadow_banned = 0",
+		"UPDATE users SET likes_public = 1",
+		"UPDATE posts SET view_count = 0 WHERE view_count > 0",
+	}
+
+	// 追加したテーブルをデータの初期化で参照するのでスキーマ変更を先に行う
+	if err := runMigrations(ctx); err != nil {
+		return err
+	}
+
+	for _, q := range sqls {
+		start := time.Now()
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("%s: %w", q, err)
+		}
+		log.Printf("initialize: %s (%s)", q, time.Since(start))
+	}
+
+	return nil
+}
+
+// スキーマ変更（カラム・インデックス追加など）はここに追加する。
+// 適用したものは schema_migrations に文の SHA-256 を記録して2回目からは実行しないので、適用済みの文は書き換えないこと
+var migrations = []string{
+	// 画像の説明文は自動生成したものも投稿者が入力したものも image_alt に入れる（alt_text などの別カラムは作らない）。
+	// 表示側は常に image_alt だけを見ればよく、どちら由来かは image_alt_manual で区別する。
+	// image_alt_manual が1の説明文は投稿者の入力なので、自動生成の結果で上書きしない
+	"ALTER TABLE posts ADD COLUMN image_alt VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE posts ADD COLUMN image_alt_manual TINYINT NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS ban_logs (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"user_id INT NOT NULL, " +
+		"admin_id INT NOT NULL, " +
+		"reason TEXT NOT NULL, " +
+		"created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+		"KEY idx_user_id (user_id))",
+	"CREATE TABLE IF NOT EXISTS likes (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"user_id INT NOT NULL, " +
+		"post_id INT NOT NULL, " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+		"UNIQUE KEY uniq_user_post (user_id, post_id), " +
+		"KEY idx_user_created_at (user_id, created_at), " +
+		"KEY idx_post_id (post_id))",
+	"ALTER TABLE users ADD COLUMN likes_public TINYINT NOT NULL DEFAULT 1",
+	"ALTER TABLE posts ADD COLUMN lang VARCHAR(16) NOT NULL DEFAULT ''",
+	"ALTER TABLE comments ADD COLUMN lang VARCHAR(16) NOT NULL DEFAULT ''",
+	"ALTER TABLE ban_logs ADD COLUMN purged_posts INT NOT NULL DEFAULT 0",
+	"ALTER TABLE ban_logs ADD COLUMN purged_comments INT NOT NULL DEFAULT 0",
+	"ALTER TABLE posts ADD COLUMN blurhash VARCHAR(4096) NOT NULL DEFAULT ''",
+	"ALTER TABLE posts ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'published'",
+	"ALTER TABLE posts ADD COLUMN width INT NOT NULL DEFAULT 0",
+	"ALTER TABLE posts ADD COLUMN height INT NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS post_tags (" +
+		"post_id INT NOT NULL, " +
+		"tag VARCHAR(64) NOT NULL, " +
+		"PRIMARY KEY (post_id, tag), " +
+		"KEY idx_tag (tag))",
+	"CREATE TABLE IF NOT EXISTS reports (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"target_type VARCHAR(16) NOT NULL, " +
+		"target_id INT NOT NULL, " +
+		"reporter_id INT NOT NULL, " +
+		"reason TEXT NOT NULL, " +
+		"status VARCHAR(16) NOT NULL DEFAULT 'open', " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+		"UNIQUE KEY uniq_target_reporter (target_type, target_id, reporter_id), " +
+		"KEY idx_status_created_at (status, created_at))",
+	"ALTER TABLE posts ADD COLUMN updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)",
+	"ALTER TABLE posts ADD COLUMN lat DOUBLE NULL",
+	"ALTER TABLE posts ADD COLUMN lng DOUBLE NULL",
+	"ALTER TABLE posts ADD COLUMN geo_public TINYINT NOT NULL DEFAULT 0",
+	"ALTER TABLE posts ADD INDEX idx_lat_lng (lat, lng)",
+	"ALTER TABLE comments ADD COLUMN parent_id INT NULL",
+	"ALTER TABLE users ADD COLUMN shadow_banned TINYINT NOT NULL DEFAULT 0",
+	"ALTER TABLE posts ADD COLUMN quoted_post_id INT NULL",
+	"ALTER TABLE posts ADD COLUMN quote_count INT NOT NULL DEFAULT 0",
+	// 既存ユーザーはアカウント名から作っていたソルト（SHA-512の16進）をそのまま保存する
+	"ALTER TABLE users ADD COLUMN salt VARCHAR(128) NOT NULL DEFAULT ''",
+	"UPDATE users SET salt = SHA2(account_name, 512) WHERE salt = ''",
+	"CREATE TABLE IF NOT EXISTS account_name_redirects (" +
+		"old_name VARCHAR(64) NOT NULL PRIMARY KEY, " +
+		"user_id INT NOT NULL, " +
+		"expires_at DATETIME(6) NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS audit_logs (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"admin_id INT NOT NULL, " +
+		"action VARCHAR(32) NOT NULL, " +
+		"target_user_id INT NOT NULL, " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+		"KEY idx_target_user_id (target_user_id))",
+	"CREATE TABLE IF NOT EXISTS mutes (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"user_id INT NOT NULL, " +
+		"target_type VARCHAR(16) NOT NULL, " +
+		"target_value VARCHAR(64) NOT NULL, " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+		"UNIQUE KEY uniq_user_target (user_id, target_type, target_value))",
+	// 古い投稿の退避先。posts に列を足すときはこちらにも同じ列を足すこと
+	"CREATE TABLE IF NOT EXISTS posts_archive LIKE posts",
+	// 絵文字は別の絵文字と同一視されないようバイナリで比較する。comment_id が0なら投稿へのリアクション
+	"CREATE TABLE IF NOT EXISTS reactions (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"post_id INT NOT NULL, " +
+		"comment_id INT NOT NULL DEFAULT 0, " +
+		"user_id INT NOT NULL, " +
+		"emoji VARCHAR(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+		"UNIQUE KEY uniq_target_user_emoji (post_id, comment_id, user_id, emoji), " +
+		"KEY idx_user_post (user_id, post_id))",
+	// 管理者向けの集計を期間の範囲とインデックスだけで行えるようにする
+	"ALTER TABLE posts ADD INDEX idx_status_created_at_lang (status, created_at, lang)",
+	"ALTER TABLE comments ADD INDEX idx_created_at_lang (created_at, lang)",
+	"ALTER TABLE posts ADD COLUMN view_count INT NOT NULL DEFAULT 0",
+	"ALTER TABLE posts_archive ADD COLUMN view_count INT NOT NULL DEFAULT 0",
+	"ALTER TABLE posts ADD COLUMN publish_at DATETIME(6) NULL",
+	"ALTER TABLE posts_archive ADD COLUMN publish_at DATETIME(6) NULL",
+	"ALTER TABLE posts ADD INDEX idx_status_publish_at (status, publish_at)",
+	"CREATE TABLE IF NOT EXISTS post_revisions (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"post_id INT NOT NULL, " +
+		"body TEXT NOT NULL, " +
+		"editor_id INT NOT NULL, " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+		"KEY idx_post_id (post_id, id))",
+	"CREATE TABLE IF NOT EXISTS webhooks (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"url VARCHAR(2048) NOT NULL, " +
+		"secret VARCHAR(255) NOT NULL, " +
+		"event_types VARCHAR(255) NOT NULL, " +
+		"active TINYINT NOT NULL DEFAULT 1, " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6))",
+	"CREATE TABLE IF NOT EXISTS webhook_deliveries (" +
+		"id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"webhook_id INT NOT NULL, " +
+		"event_type VARCHAR(32) NOT NULL, " +
+		"attempt INT NOT NULL, " +
+		"status_code INT NOT NULL DEFAULT 0, " +
+		"error TEXT NOT NULL, " +
+		"succeeded TINYINT NOT NULL DEFAULT 0, " +
+		"duration_ms INT NOT NULL DEFAULT 0, " +
+		"created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+		"KEY idx_webhook_id (webhook_id))",
+}
+
+// created_at の精度の変更を schema_migrations に記録するときのID
+const createdAtPrecisionMigration = "created_at_precision"
+
+// migrationID は schema_migrations に記録するマイグレーションのID
+func migrationID(q string) string {
+	sum := sha256.Sum256([]byte(q))
+	return hex.EncodeToString(sum[:])
+}
+
+// runMigrations は未適用のスキーマ変更を適用する。起動時と /initialize で実行し、
+// 実行中は /readyz を503にする。適用済みなら schema_migrations を1回読むだけで終わる。
+func runMigrations(ctx context.Context) error {
+	setReadiness(&migrationsReady, "migrations", false)
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range migrations {
+		id := migrationID(q)
+		if applied[id] {
+			continue
+		}
+		start := time.Now()
+		// 記録を始める前に適用したスキーマ変更は既に存在するエラーになるので無視する
+		if _, err := db.ExecContext(ctx, q); err != nil && !isSchemaExistsError(err) {
+			return fmt.Errorf("%s: %w", q, err)
+		}
+		if err := recordMigration(ctx, id); err != nil {
+			return err
+		}
+		log.Printf("initialize: %s (%s)", q, time.Since(start))
+	}
+
+	if !applied[createdAtPrecisionMigration] {
+		if err := migrateCreatedAtPrecision(ctx); err != nil {
+			return err
+		}
+		if err := recordMigration(ctx, createdAtPrecisionMigration); err != nil {
+			return err
+		}
+	}
+
+	setReadiness(&migrationsReady, "migrations", true)
+	return nil
+}
+
+// appliedMigrations は適用済みのマイグレーションのIDを返す。schema_migrations が無ければ作る
+func appliedMigrations(ctx context.Context) (map[string]bool, error) {
+	ids := []string{}
+	err := db.SelectContext(ctx, &ids, "SELECT `id` FROM `schema_migrations`")
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) && merr.Number == 1146 { // ER_NO_SUCH_TABLE
+		q := "CREATE TABLE IF NOT EXISTS `schema_migrations` (" +
+			"`id` VARCHAR(64) NOT NULL PRIMARY KEY, " +
+			"`applied_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6))"
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return nil, fmt.Errorf("%s: %w", q, err)
+		}
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("schema_migrations: %w", err)
+	}
+
+	applied := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		applied[id] = true
+	}
+	return applied, nil
+}
+
+func recordMigration(ctx context.Context, id string) error {
+	_, err := db.ExecContext(ctx, "INSERT IGNORE INTO `schema_migrations` (`id`) VALUES (?)", id)
+	if err != nil {
+		return fmt.Errorf("schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// migrateCreatedAtPrecision は同一秒内の投稿・コメントの並びが安定するよう
+// created_at をマイクロ秒精度にする。変更済みのテーブルは再構築を避けるため何もしない。
+func migrateCreatedAtPrecision(ctx context.Context) error {
+	for _, table := range []string{"posts", "comments", "posts_archive"} {
+		var precision sql.NullInt64
+		err := db.GetContext(ctx, &precision, "SELECT `DATETIME_PRECISION` FROM `information_schema`.`COLUMNS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ? AND `COLUMN_NAME` = 'created_at'", table)
+		if err != nil {
+			return fmt.Errorf("created_at precision of %s: %w", table, err)
+		}
+		if precision.Valid && precision.Int64 == 6 {
+			continue
+		}
+
+		start := time.Now()
+		q := "ALTER TABLE `" + table + "` MODIFY `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)"
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("%s: %w", q, err)
+		}
+		log.Printf("initialize: %s (%s)", q, time.Since(start))
 	}
+	return nil
+}
 
-	for _, sql := range sqls {
-		db.Exec(sql)
+// isSchemaExistsError はカラム・インデックス・テーブルが既に存在するエラーかを判定する
+func isSchemaExistsError(err error) bool {
+	var merr *mysql.MySQLError
+	if !errors.As(err, &merr) {
+		return false
 	}
+	switch merr.Number {
+	case 1050, // ER_TABLE_EXISTS_ERROR
+		1060, // ER_DUP_FIELDNAME
+		1061: // ER_DUP_KEYNAME
+		return true
+	}
+	return false
 }
 
-func tryLogin(accountName, password string) *User {
+// tryLogin はログインに成功したユーザーを返す。
+// パスワードが正しくてもバンされている場合は errAccountBanned を返す。
+func tryLogin(accountName, password string) (*User, error) {
 	u := User{}
-	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
+	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ?", accountName)
 	if err != nil {
-		return nil
+		return nil, errLoginFailed
 	}
 
-	if calculatePasshash(u.AccountName, password) == u.Passhash {
-		return &u
-	} else {
-		return nil
+	if calculatePasshash(userSalt(u), password) != u.Passhash {
+		return nil, errLoginFailed
 	}
+
+	// パスワードが正しい場合だけバン状態を明かす
+	if u.DelFlg != 0 {
+		return &u, errAccountBanned
+	}
+
+	return &u, nil
+}
+
+// latestBanReason はユーザーの最新のバン理由を返す（記録が無ければ空）
+func latestBanReason(userID int) string {
+	reason := ""
+	err := db.Get(&reason, "SELECT `reason` FROM `ban_logs` WHERE `user_id` = ? ORDER BY `id` DESC LIMIT 1", userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print(err)
+	}
+	return reason
 }
 
 func validateUser(accountName, password string) bool {
-	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName) &&
+	return validAccountName(accountName) &&
 		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
 }
 
+func validAccountName(accountName string) bool {
+	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName)
+}
+
 // 今回のGo実装では言語側のエスケープの仕組みが使えないのでOSコマンドインジェクション対策できない
 // 取り急ぎPHPのescapeshellarg関数を参考に自前で実装
 // cf: http://jp2.php.net/manual/ja/function.escapeshellarg.php
@@ -130,16 +522,29 @@ func digest(src string) string {
 	return strings.TrimSuffix(string(out), "\n")
 }
 
+// calculateSalt は以前のアカウント名から作るソルト。salt カラムが空のユーザーだけに使う
 func calculateSalt(accountName string) string {
 	return digest(accountName)
 }
 
-func calculatePasshash(accountName, password string) string {
-	return digest(password + ":" + calculateSalt(accountName))
+// newSalt はアカウント名に依存しないランダムなソルトを作る（アカウント名を変えてもハッシュが変わらない）
+func newSalt() string {
+	return secureRandomStr(32)
+}
+
+func userSalt(u User) string {
+	if u.Salt != "" {
+		return u.Salt
+	}
+	return calculateSalt(u.AccountName)
+}
+
+func calculatePasshash(salt, password string) string {
+	return digest(password + ":" + salt)
 }
 
 func getSession(r *http.Request) *sessions.Session {
-	session, _ := store.Get(r, "isuconp-go.session")
+	session, _ := store.Get(r, sessionName)
 
 	return session
 }
@@ -147,13 +552,13 @@ func getSession(r *http.Request) *sessions.Session {
 func getSessionUser(r *http.Request) User {
 	session := getSession(r)
 	uid, ok := session.Values["user_id"]
-	if !ok || uid == nil {
+	if !ok || uid == nil || sessionExpired(session, time.Now()) {
 		return User{}
 	}
 
 	// キャッシュキーを作成
 	cacheKey := fmt.Sprintf("user:%d", uid)
-	
+
 	// キャッシュから取得を試みる
 	item, err := memcacheClient.Get(cacheKey)
 	if err == nil {
@@ -185,6 +590,97 @@ func getSessionUser(r *http.Request) User {
 	return u
 }
 
+// ISUCONP_FORM_TOKEN_REQUIRED=1 なら form_token の無いフォーム送信をボットとして扱う。
+// 既定ではトークンを送らない既存のクライアントやベンチマーカーのために、トークンが無ければ表示時刻を検査しない
+var formTokenRequired = os.Getenv("ISUCONP_FORM_TOKEN_REQUIRED") == "1"
+
+// loadFormTokenKey は form_token の署名鍵を読み込む。
+// ISUCONP_FORM_TOKEN_KEY が無ければDBに保存した鍵を使う（無ければ作る）ので、
+// 再起動の前に表示したフォームや、他のインスタンスが表示したフォームのトークンも検証できる
+func loadFormTokenKey() error {
+	if v := os.Getenv("ISUCONP_FORM_TOKEN_KEY"); v != "" {
+		formTokenKey = []byte(v)
+		return nil
+	}
+	key, err := loadAppSecret("form_token_key")
+	if err != nil {
+		return err
+	}
+	formTokenKey = []byte(key)
+	return nil
+}
+
+// loadAppSecret は app_secrets に保存した name の値を返す。無ければランダムな値を保存する。
+// 複数のインスタンスが同時に起動しても INSERT IGNORE で最初に保存された値に揃う
+func loadAppSecret(name string) (string, error) {
+	q := "INSERT IGNORE INTO `app_secrets` (`name`, `value`) VALUES (?, ?)"
+	_, err := db.Exec(q, name, secureRandomStr(32))
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) && merr.Number == 1146 { // ER_NO_SUCH_TABLE
+		create := "CREATE TABLE IF NOT EXISTS `app_secrets` (" +
+			"`name` VARCHAR(64) NOT NULL PRIMARY KEY, " +
+			"`value` VARCHAR(255) NOT NULL)"
+		if _, err := db.Exec(create); err != nil {
+			return "", fmt.Errorf("%s: %w", create, err)
+		}
+		_, err = db.Exec(q, name, secureRandomStr(32))
+	}
+	if err != nil {
+		return "", fmt.Errorf("app_secrets: %w", err)
+	}
+
+	var value string
+	if err := db.Get(&value, "SELECT `value` FROM `app_secrets` WHERE `name` = ?", name); err != nil {
+		return "", fmt.Errorf("app_secrets: %w", err)
+	}
+	return value, nil
+}
+
+// newFormToken はフォームの表示時刻を署名付きで埋め込んだトークンを返す
+func newFormToken() string {
+	return formTokenAt(time.Now())
+}
+
+// formTokenAt は t にフォームを表示したことを示すトークンを返す
+func formTokenAt(t time.Time) string {
+	ts := strconv.FormatInt(t.UnixNano(), 10)
+	mac := hmac.New(sha256.New, formTokenKey)
+	mac.Write([]byte(ts))
+	return ts + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isBotSubmission はhoneypotフィールドとフォーム表示時刻からボットの送信かを判定する。
+// トークンを省けば表示時刻の検査を逃れられるので、ISUCONP_FORM_TOKEN_REQUIRED=1 のときは
+// トークンの無い送信をボットとして扱う（Accept ヘッダは誰でも付けられるので見ない）。
+func isBotSubmission(r *http.Request) bool {
+	if r.FormValue("website") != "" {
+		return true
+	}
+
+	token := r.FormValue("form_token")
+	if token == "" {
+		return formTokenRequired
+	}
+
+	ts, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return true
+	}
+	mac := hmac.New(sha256.New, formTokenKey)
+	mac.Write([]byte(ts))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return true
+	}
+
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return true
+	}
+
+	return time.Since(time.Unix(0, n)) < formMinInterval
+}
+
 func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 	session := getSession(r)
 	value, ok := session.Values[key]
@@ -199,6 +695,12 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 }
 
 func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, error) {
+	return makePostsWith(results, csrfToken, allComments, commentOrderAsc, postsPerPage)
+}
+
+// makePostsWith はコメントの表示順と最大件数を指定して投稿を整形する。
+// 一覧表示（allComments=false）では order に関係なく最新3件を古い順に並べる。
+func makePostsWith(results []Post, csrfToken string, allComments bool, order string, limit int) ([]Post, error) {
 	var posts []Post
 	if len(results) == 0 {
 		return posts, nil
@@ -212,28 +714,33 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		userIDSet[p.UserID] = struct{}{}
 	}
 
-	// 1. 各投稿のコメント数を一括取得
-	type countRow struct {
-		PostID int `db:"post_id"`
-		Count  int `db:"count"`
-	}
-	var counts []countRow
-	countQuery, args, _ := sqlx.In(
-		"SELECT post_id, COUNT(*) AS count FROM comments WHERE post_id IN (?) GROUP BY post_id", postIDs,
-	)
-	countQuery = db.Rebind(countQuery)
-	if err := db.Select(&counts, countQuery, args...); err != nil {
+	// 1. 各投稿のコメント数・いいね数をカウンタから一括取得（無いものはDBで数える）
+	// コメント数は閲覧者によらず共通なので、誰にでも見えるコメント（canView を参照）だけを数える
+	gen := getCacheGeneration()
+	commentCountMap, err := countByPost(postIDs, func(pid int) string { return commentCountKey(gen, pid) },
+		"SELECT c.post_id, COUNT(*) AS count FROM comments c JOIN users u ON c.user_id = u.id WHERE c.post_id IN (?) AND u.shadow_banned = 0 AND u.del_flg = 0 GROUP BY c.post_id")
+	if err != nil {
 		return nil, err
 	}
-	commentCountMap := make(map[int]int)
-	for _, row := range counts {
-		commentCountMap[row.PostID] = row.Count
+	likeCountMap, err := countByPost(postIDs, func(pid int) string { return likeCountKey(gen, pid) },
+		"SELECT post_id, COUNT(*) AS count FROM likes WHERE post_id IN (?) GROUP BY post_id")
+	if err != nil {
+		return nil, err
 	}
+	viewCountMap := fetchViewCounts(results)
 
 	// 2. コメント本体を一括取得
+	// 一覧表示は最新3件を取るためにDESCで取得してから逆順にする
+	// 全件表示は表示順どおりにクエリで並べるので逆順は不要
+	queryOrder := "DESC"
+	reverse := !allComments
+	if allComments && order != commentOrderDesc {
+		queryOrder = "ASC"
+	}
+
 	var allCommentsList []Comment
-	commentQuery := "SELECT * FROM comments WHERE post_id IN (?) ORDER BY created_at DESC"
-	commentQuery, args, _ = sqlx.In(commentQuery, postIDs)
+	commentQuery := "SELECT * FROM comments WHERE post_id IN (?) ORDER BY created_at " + queryOrder
+	commentQuery, args, _ := sqlx.In(commentQuery, postIDs)
 	commentQuery = db.Rebind(commentQuery)
 	if err := db.Select(&allCommentsList, commentQuery, args...); err != nil {
 		return nil, err
@@ -244,13 +751,39 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		userIDSet[c.UserID] = struct{}{}
 	}
 
+	// 表示する投稿・コメントへのリアクション数を一括取得
+	targets := make([]reactionTarget, 0, len(postIDs))
+	for _, pid := range postIDs {
+		targets = append(targets, reactionTarget{PostID: pid})
+		comments := commentsMap[pid]
+		if !allComments && len(comments) > 3 {
+			comments = comments[:3]
+		}
+		for _, c := range comments {
+			targets = append(targets, reactionTarget{PostID: pid, CommentID: c.ID})
+		}
+	}
+	reactions, err := fetchReactionCounts(gen, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	// 引用元の投稿も一括で取得し、投稿者をユーザー情報の取得対象に含める
+	quotedMap, err := fetchQuotedPosts(results)
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range quotedMap {
+		userIDSet[q.UserID] = struct{}{}
+	}
+
 	// 3. 関連するユーザー情報を取得（キャッシュ活用）
 	userIDs := make([]int, 0, len(userIDSet))
 	for uid := range userIDSet {
 		userIDs = append(userIDs, uid)
 	}
 	userMap := make(map[int]User)
-	
+
 	// まずキャッシュから取得を試みる
 	uncachedUserIDs := []int{}
 	for _, uid := range userIDs {
@@ -268,7 +801,7 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		// キャッシュミスの場合はリストに追加
 		uncachedUserIDs = append(uncachedUserIDs, uid)
 	}
-	
+
 	// キャッシュにないユーザー情報をDBから一括取得
 	if len(uncachedUserIDs) > 0 {
 		var users []User
@@ -277,11 +810,11 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		if err := db.Select(&users, userQuery, args...); err != nil {
 			return nil, err
 		}
-		
+
 		// 取得したユーザー情報をキャッシュに保存
 		for _, u := range users {
 			userMap[u.ID] = u
-			
+
 			// キャッシュに保存
 			cacheKey := fmt.Sprintf("user:%d", u.ID)
 			data, err := json.Marshal(u)
@@ -298,6 +831,8 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 	// 4. 投稿データを構築
 	for _, p := range results {
 		p.CommentCount = commentCountMap[p.ID]
+		p.LikeCount = likeCountMap[p.ID]
+		p.ViewCount = viewCountMap[p.ID]
 
 		comments := commentsMap[p.ID]
 		if !allComments && len(comments) > 3 {
@@ -305,20 +840,32 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		}
 		for i := range comments {
 			comments[i].User = userMap[comments[i].UserID]
+			comments[i].Reactions = reactions[reactionTarget{PostID: p.ID, CommentID: comments[i].ID}]
+		}
+		if reverse {
+			for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+				comments[i], comments[j] = comments[j], comments[i]
+			}
 		}
-		// reverse
-		for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
-			comments[i], comments[j] = comments[j], comments[i]
+		// 一覧では最新の数件だけなので平坦に並べ、全件表示のときだけスレッドにする
+		if allComments {
+			comments = buildCommentThreads(comments)
 		}
 		p.Comments = comments
 
 		p.User = userMap[p.UserID]
 		p.CSRFToken = csrfToken
+		p.Reactions = reactions[reactionTarget{PostID: p.ID}]
+		embedQuoted(&p, quotedMap, userMap, quoteEmbedDepth)
+		// 一覧では長い本文を折りたたむ（詳細ページは全コメントと同じく全文を出す）
+		if !allComments {
+			p.Excerpt, p.Truncated = truncateBody(p.Body, bodyPreviewLength)
+		}
 
 		if p.User.DelFlg == 0 {
 			posts = append(posts, p)
 		}
-		if len(posts) >= postsPerPage {
+		if len(posts) >= limit {
 			break
 		}
 	}
@@ -326,15 +873,49 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 	return posts, nil
 }
 
+// personalizePosts はキャッシュ済みの投稿に閲覧者ごとのCSRFトークンを設定したコピーを返す
+func personalizePosts(posts []Post, csrfToken string) []Post {
+	res := make([]Post, len(posts))
+	for i, p := range posts {
+		p.CSRFToken = csrfToken
+		res[i] = p
+	}
+	return res
+}
+
+// parsePostsLimit は ?limit= から一覧の表示件数を決める。
+// 不正な値はデフォルトにフォールバックし、上限を超える値はクランプする。
+func parsePostsLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return postsPerPage
+	}
+	if limit > maxPostsLimit {
+		return maxPostsLimit
+	}
+	return limit
+}
+
+// normalizeCursorTime はページングのカーソルに指定された時刻が
+// サーバーの現在時刻より大幅に未来なら現在時刻にする。
+// created_at はマイクロ秒までなので、MySQLが丸めて次の投稿まで含めないよう端数を切り捨てる
+func normalizeCursorTime(t time.Time) time.Time {
+	now := time.Now()
+	if t.After(now.Add(cursorFutureTolerance)) {
+		t = now
+	}
+	return t.Truncate(time.Microsecond)
+}
 
 func imageURL(p Post) string {
-	ext := ""
-	if p.Mime == "image/jpeg" {
-		ext = ".jpg"
-	} else if p.Mime == "image/png" {
-		ext = ".png"
-	} else if p.Mime == "image/gif" {
-		ext = ".gif"
+	// テキストのみの投稿には画像が無い
+	if p.Mime == "" {
+		return ""
+	}
+
+	ext := imageExtByMime(p.Mime)
+	if ext != "" {
+		ext = "." + ext
 	}
 
 	return "/image/" + strconv.Itoa(p.ID) + ext
@@ -366,8 +947,54 @@ func getTemplPath(filename string) string {
 }
 
 func getInitialize(w http.ResponseWriter, r *http.Request) {
-	dbInitialize()
+	timeout := defaultInitializeTimeout
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_INITIALIZE_TIMEOUT")); err == nil && d > 0 {
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := dbInitialize(ctx); err != nil {
+		log.Print(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("initialize: done (%s)", time.Since(start))
+
+	// 消した投稿・コメントを数えたカウンタや一覧のキャッシュを使わせない
+	bumpCacheGeneration()
+
+	// 検証しやすいよう投入データの件数を返す
+	res := struct {
+		Users    int `json:"users"`
+		Posts    int `json:"posts"`
+		Comments int `json:"comments"`
+	}{}
+	counts := []struct {
+		dest  *int
+		query string
+	}{
+		{&res.Users, "SELECT COUNT(*) FROM `users`"},
+		{&res.Posts, "SELECT COUNT(*) FROM `posts` WHERE `status` = 'published'"},
+		{&res.Comments, "SELECT COUNT(*) FROM `comments`"},
+	}
+	for _, c := range counts {
+		if err := db.GetContext(ctx, c.dest, c.query); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
 }
 
 func getLogin(w http.ResponseWriter, r *http.Request) {
@@ -393,16 +1020,31 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
+	u, err := tryLogin(normalizeText(r.FormValue("account_name")), r.FormValue("password"))
 
-	if u != nil {
+	switch {
+	case err == nil:
 		session := getSession(r)
 		session.Values["user_id"] = u.ID
-		session.Values["csrf_token"] = secureRandomStr(16)
+		startSessionLifetime(session)
+		csrfToken := secureRandomStr(16)
+		session.Values["csrf_token"] = csrfToken
 		session.Save(r, w)
+		setXSRFCookie(w, r, csrfToken)
 
 		http.Redirect(w, r, "/", http.StatusFound)
-	} else {
+	case errors.Is(err, errAccountBanned):
+		notice := "このアカウントは停止されています"
+		if reason := latestBanReason(u.ID); reason != "" {
+			notice += "（理由: " + reason + "）"
+		}
+
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+	default:
 		session := getSession(r)
 		session.Values["notice"] = "アカウント名かパスワードが間違っています"
 		session.Save(r, w)
@@ -417,7 +1059,7 @@ func getRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	template.Must(template.ParseFiles(
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("register.html")),
 	).Execute(w, struct {
@@ -432,7 +1074,14 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accountName, password := r.FormValue("account_name"), r.FormValue("password")
+	// ボットには成功を装ってDBには書かない
+	if isBotSubmission(r) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	// 正規表現での検証や重複判定より前に正規化しておく
+	accountName, password := normalizeText(r.FormValue("account_name")), r.FormValue("password")
 
 	validated := validateUser(accountName, password)
 	if !validated {
@@ -457,8 +1106,9 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	salt := newSalt()
+	query := "INSERT INTO `users` (`account_name`, `passhash`, `salt`) VALUES (?,?,?)"
+	result, err := db.Exec(query, accountName, calculatePasshash(salt, password), salt)
 	if err != nil {
 		log.Print(err)
 		return
@@ -471,8 +1121,11 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	session.Values["user_id"] = uid
-	session.Values["csrf_token"] = secureRandomStr(16)
+	startSessionLifetime(session)
+	csrfToken := secureRandomStr(16)
+	session.Values["csrf_token"] = csrfToken
 	session.Save(r, w)
+	setXSRFCookie(w, r, csrfToken)
 
 	// 新規登録時はユーザーキャッシュは作成しない（次回取得時に作成される）
 
@@ -484,69 +1137,77 @@ func getLogout(w http.ResponseWriter, r *http.Request) {
 	delete(session.Values, "user_id")
 	session.Options = &sessions.Options{MaxAge: -1}
 	session.Save(r, w)
+	deleteXSRFCookie(w)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func getIndex(w http.ResponseWriter, r *http.Request) {
+	sendEarlyHints(w, r)
 	me := getSessionUser(r)
 
-	// キャッシュキーを作成
-	cacheKey := "index_posts"
+	limit := parsePostsLimit(r)
+
+	// キャッシュキーを作成（デフォルト件数以外はキーにlimitと世代を含める）
+	cacheKey := indexPostsCacheKey(limit)
+
+	// botのアクセス数はキャッシュの有無に関わらず数える
+	isBot := isBotRequest(r, "index")
 
 	// キャッシュから取得を試みる
+	// 生成時点の最新投稿IDが現在と一致するときだけ使うので、新しい投稿は即座に反映される
 	item, err := memcacheClient.Get(cacheKey)
 	var posts []Post
 
 	if err == nil {
 		// キャッシュヒット
-		err = json.Unmarshal(item.Value, &posts)
+		var cached indexPostsCache
+		err = json.Unmarshal(item.Value, &cached)
 		if err != nil {
 			log.Print("Failed to unmarshal cache:", err)
 			// キャッシュのデシリアライズに失敗した場合はDBから取得
-			posts = nil
+		} else if latestID, lerr := getLatestPostID(); lerr == nil && latestID != cached.LatestID {
+			// 新しい投稿による無効化として数える
+			recordCacheInvalidation(cacheKey)
+			err = errIndexCacheOutdated
+		} else if cached.Generation != getCacheGeneration() {
+			err = errIndexCacheOutdated
+		} else {
+			// 最新IDが取れないときはキャッシュをそのまま使う
+			posts = cached.Posts
 		}
 	}
-	
-	if err != nil || posts == nil {
-		// キャッシュミスまたはデシリアライズ失敗の場合はDBから取得
-		results := []Post{}
-
-		err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` ORDER BY `created_at` DESC LIMIT 40")
-		if err != nil {
-			log.Print(err)
-			return
-		}
+	if posts != nil {
+		recordCacheHit(cacheKey)
+	} else {
+		recordCacheMiss(cacheKey)
+	}
 
-		posts, err = makePosts(results, getCSRFToken(r), false)
+	if (err != nil || posts == nil) && isBot {
+		// botにはキャッシュ再生成（DBアクセス）をさせず、前回のキャッシュか空の一覧を返す
+		botRequests.Add("index_cache_miss", 1)
+		var stale indexPostsCache
+		getStaleCache(cacheKey, &stale)
+		posts = stale.Posts
+	} else if err != nil || posts == nil {
+		// キャッシュミスまたはデシリアライズ失敗の場合はDBから取得
+		posts, err = loadIndexPosts(limit, cacheKey, cacheTTL(cacheKey, indexPostsTTL))
 		if err != nil {
 			log.Print(err)
 			return
 		}
-
-		// キャッシュに保存（有効期限: 60秒）
-		if len(posts) > 0 {
-			data, err := json.Marshal(posts)
-			if err == nil {
-				memcacheClient.Set(&memcache.Item{
-					Key:        cacheKey,
-					Value:      data,
-					Expiration: 60, // 60秒
-				})
-			}
-		}
 	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
-	}
+	// キャッシュは全ユーザー共通なので、閲覧者のCSRFトークン・シャドウバン・ミュートは表示時に適用する
+	posts = markMyReactions(filterMutedPosts(filterVisiblePosts(personalizePosts(posts, getCSRFToken(r)), me), me), me)
+	addImagePreloads(w, posts)
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	renderTemplate(w, template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("index.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
-	)).Execute(w, struct {
+	)), struct {
 		Posts     []Post
 		Me        User
 		CSRFToken string
@@ -554,6 +1215,70 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
+// トップページの投稿一覧のキャッシュ。生成時点の最新投稿IDとキャッシュの世代を持つ
+type indexPostsCache struct {
+	LatestID   int    `json:"latest_id"`
+	Generation uint64 `json:"generation"`
+	Posts      []Post `json:"posts"`
+}
+
+var errIndexCacheOutdated = errors.New("index cache is outdated")
+
+// getLatestPostID は公開済みの最新の投稿IDを返す。クエリを減らすため数秒キャッシュする
+func getLatestPostID() (int, error) {
+	if item, err := memcacheClient.Get("latest_post_id"); err == nil {
+		if id, err := strconv.Atoi(string(item.Value)); err == nil {
+			return id, nil
+		}
+	}
+
+	id := 0
+	err := db.Get(&id, "SELECT COALESCE(MAX(`id`), 0) FROM `posts` WHERE `status` = 'published'")
+	if err != nil {
+		return 0, err
+	}
+	memcacheClient.Set(&memcache.Item{
+		Key:        "latest_post_id",
+		Value:      []byte(strconv.Itoa(id)),
+		Expiration: latestPostIDTTL,
+	})
+	return id, nil
+}
+
+// loadIndexPosts はトップページの投稿一覧をDBから取得してキャッシュに保存する。
+// キャッシュは全ユーザーで共有するのでCSRFトークンは含めない。
+func loadIndexPosts(limit int, cacheKey string, cacheTTL int32) ([]Post, error) {
+	// 一覧より先に取得し、取得中に増えた投稿があれば次のリクエストで作り直させる
+	latestID, err := getLatestPostID()
+	if err != nil {
+		return nil, err
+	}
+	generation := getCacheGeneration()
+
+	results := []Post{}
+
+	// バンされたユーザーの投稿を除外しても足りるよう表示件数の2倍取得する
+	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count` FROM `posts` WHERE `status` = 'published' ORDER BY `created_at` DESC LIMIT ?", limit*2)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := makePostsWith(results, "", false, commentOrderAsc, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// キャッシュに保存
+	if len(posts) > 0 {
+		data, err := json.Marshal(indexPostsCache{LatestID: latestID, Generation: generation, Posts: posts})
+		if err == nil {
+			setCacheWithStale(cacheKey, data, cacheTTL)
+		}
+	}
+
+	return posts, nil
+}
+
 func getAccountName(w http.ResponseWriter, r *http.Request) {
 	accountName := r.PathValue("accountName")
 
@@ -561,16 +1286,22 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 	cacheKey := fmt.Sprintf("account:%s", accountName)
 
 	// キャッシュから取得を試みる
+	// 閲覧者ごとに異なる情報（Me、CSRFトークンなど）はキャッシュに含めず、レンダリング直前に付与する
 	type accountPageData struct {
 		User           User   `json:"user"`
 		Posts          []Post `json:"posts"`
 		CommentCount   int    `json:"comment_count"`
 		PostCount      int    `json:"post_count"`
 		CommentedCount int    `json:"commented_count"`
+		Generation     uint64 `json:"generation"`
 	}
 
+	// botのアクセス数はキャッシュの有無に関わらず数える
+	isBot := isBotRequest(r, "account")
+
 	item, err := memcacheClient.Get(cacheKey)
 	var data accountPageData
+	generation := getCacheGeneration()
 
 	if err == nil {
 		// キャッシュヒット
@@ -578,13 +1309,34 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Print("Failed to unmarshal cache:", err)
 			data = accountPageData{}
+		} else if data.Generation != generation {
+			// 世代が古いキャッシュは作り直す
+			data = accountPageData{}
 		}
 	}
+	if data.User.ID != 0 {
+		recordCacheHit(cacheKey)
+	} else {
+		recordCacheMiss(cacheKey)
+	}
 
-	if err != nil || data.User.ID == 0 {
+	if (err != nil || data.User.ID == 0) && isBot {
+		// botにはキャッシュ再生成（DBアクセス）をさせず、前回のキャッシュか投稿の無いページを返す
+		botRequests.Add("account_cache_miss", 1)
+		if !getStaleCache(cacheKey, &data) || data.User.ID == 0 {
+			data = accountPageData{User: User{AccountName: accountName}}
+		}
+	} else if err != nil || data.User.ID == 0 {
 		// キャッシュミスまたはデシリアライズ失敗の場合はDBから取得
 		user := User{}
 		err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+		if errors.Is(err, sql.ErrNoRows) {
+			// アカウント名を変更したユーザーなら新しいアカウント名へ案内する
+			if !redirectRenamedAccount(w, r, accountName) {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			return
+		}
 		if err != nil {
 			log.Print(err)
 			return
@@ -596,13 +1348,13 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		}
 
 		results := []Post{}
-		err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT 40", user.ID)
+		err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count` FROM `posts` WHERE `user_id` = ? AND `status` = 'published' ORDER BY `created_at` DESC, `id` DESC LIMIT 40", user.ID)
 		if err != nil {
 			log.Print(err)
 			return
 		}
 
-		posts, err := makePosts(results, getCSRFToken(r), false)
+		posts, err := makePosts(results, "", false)
 		if err != nil {
 			log.Print(err)
 			return
@@ -616,7 +1368,7 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		}
 
 		postIDs := []int{}
-		err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
+		err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ? AND `status` = 'published'", user.ID)
 		if err != nil {
 			log.Print(err)
 			return
@@ -650,42 +1402,154 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 			CommentCount:   commentCount,
 			PostCount:      postCount,
 			CommentedCount: commentedCount,
+			Generation:     generation,
 		}
 
-		// キャッシュに保存（有効期限: 60秒）
+		// キャッシュに保存（有効期限: 既定60秒、自動調整が有効なら調整後の秒数）
 		cacheData, err := json.Marshal(data)
 		if err == nil {
-			memcacheClient.Set(&memcache.Item{
-				Key:        cacheKey,
-				Value:      cacheData,
-				Expiration: 60, // 60秒
-			})
+			setCacheWithStale(cacheKey, cacheData, cacheTTL(cacheKey, 60))
 		}
 	}
 
-	me := getSessionUser(r)
+	// 2ページ目以降は ?before_id= の投稿より後に並ぶ投稿を表示する（ユーザー情報と件数は1ページ目と共通）
+	// 投稿の無いページを返すbotには続きも返さない
+	posts := data.Posts
+	if beforeID, err := strconv.Atoi(r.URL.Query().Get("before_id")); err == nil && beforeID > 0 && data.User.ID != 0 {
+		posts, err = accountPostsPage(data.User.ID, beforeID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	nextBeforeID := 0
+	if len(posts) >= postsPerPage {
+		nextBeforeID = posts[len(posts)-1].ID
 	}
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	me := getSessionUser(r)
+	posts = markMyReactions(filterVisiblePosts(personalizePosts(posts, getCSRFToken(r)), me), me)
+
+	renderTemplate(w, template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("user.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
-	)).Execute(w, struct {
+	)), struct {
 		Posts          []Post
 		User           User
 		PostCount      int
 		CommentCount   int
 		CommentedCount int
+		NextBeforeID   int
 		Me             User
-	}{data.Posts, data.User, data.PostCount, data.CommentCount, data.CommentedCount, me})
+	}{posts, data.User, data.PostCount, data.CommentCount, data.CommentedCount, nextBeforeID, me})
 }
 
-func getPosts(w http.ResponseWriter, r *http.Request) {
-	m, err := url.ParseQuery(r.URL.RawQuery)
+// accountPostsPage はユーザーの投稿のうち beforeID の投稿より後に並ぶものを1ページ分返す。
+// beforeID が0なら最新から返す。カーソルごとに短いTTLでキャッシュする。
+//
+// 下書きの公開や公開予約で created_at とIDの順は一致しないので、どのページも (created_at, id) の降順に並べ、
+// beforeID の投稿の created_at とIDの組をカーソルにする。カーソルの投稿が削除されていれば続きは無い。
+func accountPostsPage(userID, beforeID int) ([]Post, error) {
+	cacheKey := fmt.Sprintf("account_posts:%d:%d", userID, beforeID)
+
+	var posts []Post
+	if item, err := memcacheClient.Get(cacheKey); err == nil {
+		if err := json.Unmarshal(item.Value, &posts); err == nil {
+			return posts, nil
+		}
+	}
+
+	results := []Post{}
+	query := "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count` FROM `posts` WHERE `user_id` = ? AND `status` = 'published' ORDER BY `created_at` DESC, `id` DESC LIMIT 40"
+	args := []interface{}{userID}
+	if beforeID > 0 {
+		var cursor time.Time
+		err := db.Get(&cursor, "SELECT `created_at` FROM `posts` WHERE `id` = ? AND `user_id` = ?", beforeID, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return []Post{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		query = "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count` FROM `posts` WHERE `user_id` = ? AND `status` = 'published' AND (`created_at` < ? OR (`created_at` = ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT 40"
+		args = append(args, cursor, cursor, beforeID)
+	}
+	if err := db.Select(&results, query, args...); err != nil {
+		return nil, err
+	}
+
+	posts, err := makePosts(results, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := json.Marshal(posts); err == nil {
+		memcacheClient.Set(&memcache.Item{
+			Key:        cacheKey,
+			Value:      data,
+			Expiration: 10, // 10秒
+		})
+	}
+
+	return posts, nil
+}
+
+// getAccountPostsJSON はユーザーページの追加ロード用にJSONで投稿を返す
+func getAccountPostsJSON(w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", r.PathValue("accountName"))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	beforeID := 0
+	if v := r.URL.Query().Get("before_id"); v != "" {
+		beforeID, err = strconv.Atoi(v)
+		if err != nil || beforeID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	posts, err := accountPostsPage(user.ID, beforeID)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	postCount := 0
+	if err := db.Get(&postCount, "SELECT COUNT(*) FROM `posts` WHERE `user_id` = ? AND `status` = 'published'", user.ID); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	fields := parseFields(r)
+	res := struct {
+		Posts        []interface{} `json:"posts"`
+		PostCount    int           `json:"post_count"`
+		NextBeforeID int           `json:"next_before_id,omitempty"`
+	}{Posts: make([]interface{}, 0, len(posts)), PostCount: postCount}
+	for _, p := range posts {
+		res.Posts = append(res.Posts, selectFields(newAPIPost(p), fields))
+	}
+	if len(posts) >= postsPerPage {
+		res.NextBeforeID = posts[len(posts)-1].ID
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func getPosts(w http.ResponseWriter, r *http.Request) {
+	m, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Print(err)
@@ -701,15 +1565,29 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 		return
 	}
+	t = normalizeCursorTime(t)
+
+	// getPostsはキャッシュしていないので、botにはDBアクセスさせず空の一覧を返す
+	if isBotRequest(r, "posts") {
+		botRequests.Add("posts_cache_miss", 1)
+		renderTemplate(w, template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
+			getTemplPath("posts.html"),
+			getTemplPath("post.html"),
+		)), []Post{})
+		return
+	}
+
+	limit := parsePostsLimit(r)
 
 	results := []Post{}
-	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `created_at` <= ? ORDER BY `created_at` DESC LIMIT 40", t.Format(ISO8601Format))
+	// 文字列化すると小数秒が落ちるのでtime.Timeのまま渡す
+	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count` FROM `posts` WHERE `created_at` <= ? AND `status` = 'published' ORDER BY `created_at` DESC LIMIT ?", t, limit*2)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePostsWith(results, getCSRFToken(r), false, commentOrderAsc, limit)
 	if err != nil {
 		log.Print(err)
 		return
@@ -720,14 +1598,160 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
-	}
+	// すべて除外されても続きはあるので、404ではなく空の一覧を返す
+	me := getSessionUser(r)
+	posts = markMyReactions(filterMutedPosts(filterVisiblePosts(posts, me), me), me)
 
-	template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
+	renderTemplate(w, template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
-	)).Execute(w, posts)
+	)), posts)
+}
+
+// getAPIPosts は新着の投稿をJSONで返す。?fields= で返すフィールドを絞り込める
+func getAPIPosts(w http.ResponseWriter, r *http.Request) {
+	t := time.Now()
+	if v := r.URL.Query().Get("max_created_at"); v != "" {
+		var err error
+		t, err = time.Parse(ISO8601Format, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		t = normalizeCursorTime(t)
+	}
+
+	limit := parsePostsLimit(r)
+
+	results := []Post{}
+	err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count` FROM `posts` WHERE `created_at` <= ? AND `status` = 'published' ORDER BY `created_at` DESC LIMIT ?", t, limit*2)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	posts, err := makePostsWith(results, "", false, commentOrderAsc, limit)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// シャドウバンされたユーザーにも自分の投稿は見せる
+	posts = filterVisiblePosts(posts, getSessionUser(r))
+
+	fields := parseFields(r)
+	res := struct {
+		Posts []interface{} `json:"posts"`
+	}{Posts: make([]interface{}, 0, len(posts))}
+	for _, p := range posts {
+		res.Posts = append(res.Posts, selectFields(newAPIPost(p), fields))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// getPostsHasNew はプルリフレッシュ用に since より新しい投稿の有無と件数だけを返す。
+// 投稿本体は返さないので、新着があればクライアントは一覧を取り直す。
+func getPostsHasNew(w http.ResponseWriter, r *http.Request) {
+	t, err := time.Parse(ISO8601Format, r.URL.Query().Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	count, err := countNewPosts(fmt.Sprintf("has_new:%d", t.UnixMicro()), "p.`created_at` > ?", t, 0, getSessionUser(r))
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := struct {
+		HasNew     bool   `json:"has_new"`
+		Count      int    `json:"count"`
+		RefreshURL string `json:"refresh_url,omitempty"`
+	}{HasNew: count > 0, Count: count}
+	if res.HasNew {
+		res.RefreshURL = "/"
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// getPostsSince は last_id より新しい投稿の件数と最新の投稿IDを返す。
+// 新着バナー用なので件数は maxSinceCount で打ち切り、超えた場合は has_more を返す。
+func getPostsSince(w http.ResponseWriter, r *http.Request) {
+	lastID, err := strconv.Atoi(r.URL.Query().Get("last_id"))
+	if err != nil || lastID < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// 件数は上限+1件までしか数えないようにしてスキャン量を抑える
+	me := getSessionUser(r)
+	count, err := countNewPosts(fmt.Sprintf("posts_since:%d", lastID), "p.`id` > ?", lastID, maxSinceCount+1, me)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := struct {
+		Count    int  `json:"count"`
+		LatestID int  `json:"latest_id"`
+		HasMore  bool `json:"has_more"`
+	}{Count: count, LatestID: lastID}
+	if count > maxSinceCount {
+		res.Count = maxSinceCount
+		res.HasMore = true
+	}
+	if count > 0 {
+		visible, args := visibleAuthorSQL(me)
+		err = db.Get(&res.LatestID, "SELECT p.`id` FROM `posts` p JOIN `users` u ON p.`user_id` = u.`id` WHERE p.`status` = 'published' AND "+visible+" ORDER BY p.`id` DESC LIMIT 1", args...)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// countNewPosts は where に当てはまる公開済みの投稿のうち viewer に見せられるものを数える。
+// limit が0より大きければその件数で数えるのをやめる。頻繁にポーリングされるので結果を短時間キャッシュする。
+// 見える投稿が他の人と異なるのはシャドウバンされた閲覧者だけなので、キャッシュはその場合だけ閲覧者ごとに分ける
+func countNewPosts(cacheKey, where string, arg interface{}, limit int, viewer User) (int, error) {
+	if viewer.ShadowBanned != 0 {
+		cacheKey = fmt.Sprintf("%s:%d", cacheKey, viewer.ID)
+	}
+	if item, err := memcacheClient.Get(cacheKey); err == nil {
+		if c, err := strconv.Atoi(string(item.Value)); err == nil {
+			return c, nil
+		}
+	}
+
+	visible, visibleArgs := visibleAuthorSQL(viewer)
+	from := "FROM `posts` p JOIN `users` u ON p.`user_id` = u.`id` WHERE " + where + " AND p.`status` = 'published' AND " + visible
+	q, args := "SELECT COUNT(*) "+from, append([]interface{}{arg}, visibleArgs...)
+	if limit > 0 {
+		q = "SELECT COUNT(*) FROM (SELECT 1 " + from + " LIMIT ?) t"
+		args = append(args, limit)
+	}
+
+	count := 0
+	if err := db.Get(&count, q, args...); err != nil {
+		return 0, err
+	}
+	memcacheClient.Set(&memcache.Item{
+		Key:        cacheKey,
+		Value:      []byte(strconv.Itoa(count)),
+		Expiration: 3, // 3秒
+	})
+	return count, nil
 }
 
 func getPostsID(w http.ResponseWriter, r *http.Request) {
@@ -738,6 +1762,13 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	order := r.URL.Query().Get("order")
+	if order != commentOrderDesc {
+		order = commentOrderAsc
+	}
+
+	sendEarlyHints(w, r)
+
 	results := []Post{}
 	err = db.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
 	if err != nil {
@@ -745,11 +1776,38 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), true)
+	// 一覧からは外したアーカイブ済みの投稿も個別ページでは見せる
+	if len(results) == 0 {
+		if archived, ok := getArchivedPost(pid); ok {
+			results = append(results, archived)
+		}
+	}
+
+	me := getSessionUser(r)
+
+	// 下書き・公開予約中の投稿は本人にしか見せない。予約中の投稿はまだ中身が無いので誰にも見せない
+	if len(results) > 0 && (results[0].Status == postStatusPreparing ||
+		isOwnerOnlyStatus(results[0].Status) && results[0].UserID != me.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 関連投稿はコメントの整形と並行して取得する
+	relatedCh := make(chan []Post, 1)
+	if len(results) > 0 {
+		go func(userID int) {
+			relatedCh <- fetchRelatedPosts(userID, pid)
+		}(results[0].UserID)
+	} else {
+		relatedCh <- nil
+	}
+
+	posts, err := makePostsWith(results, getCSRFToken(r), true, order, postsPerPage)
 	if err != nil {
 		log.Print(err)
 		return
 	}
+	posts = markMyReactions(filterVisiblePosts(posts, me), me)
 
 	if len(posts) == 0 {
 		w.WriteHeader(http.StatusNotFound)
@@ -757,91 +1815,141 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p := posts[0]
+	recordView(r, p, me)
 
-	me := getSessionUser(r)
-
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	// 投稿者は同じなのでユーザー情報はメインの投稿のものを使う
+	related := <-relatedCh
+	for i := range related {
+		related[i].User = p.User
 	}
+	addImagePreloads(w, append([]Post{p}, related...))
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	renderTemplate(w, template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("post_id.html"),
 		getTemplPath("post.html"),
-	)).Execute(w, struct {
-		Post Post
-		Me   User
-	}{p, me})
+	)), struct {
+		Post           Post
+		Related        []Post
+		Me             User
+		Order          string
+		HistoryVisible bool
+	}{p, related, me, order, canViewPostHistory(p, me)})
+}
+
+// fetchRelatedPosts は同じ投稿者の他の最近の投稿を取得する。
+// 一覧に並べるだけなのでコメントは取得しない。
+func fetchRelatedPosts(userID, excludeID int) []Post {
+	results := []Post{}
+	err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count` FROM `posts` WHERE `user_id` = ? AND `id` != ? AND `status` = 'published' ORDER BY `created_at` DESC LIMIT ?", userID, excludeID, relatedPosts)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return results
 }
 
 func postIndex(w http.ResponseWriter, r *http.Request) {
+	createPost(w, r, postStatusPublished)
+}
+
+// createPost は投稿を作成する。status が postStatusDraft なら下書きとして保存し、
+// 一覧には出さないのでキャッシュも無効化しない。
+func createPost(w http.ResponseWriter, r *http.Request, status string) {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRF(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		session := getSession(r)
-		session.Values["notice"] = "画像が必須です"
-		session.Save(r, w)
+	// ボットには成功を装ってDBには書かない
+	if isBotSubmission(r) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
 
-		http.Redirect(w, r, "/", http.StatusFound)
+	// 先行アップロード済みの画像があればそれで投稿を確定する
+	if tokens := r.Form["upload_tokens[]"]; len(tokens) > 0 {
+		postIndexWithUploads(w, r, me, tokens, status)
 		return
 	}
 
-	mime, ext := "", ""
-	if file != nil {
-		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-			ext = "jpg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-			ext = "png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-			ext = "gif"
-		} else {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		file, header = nil, nil
+	}
+
+	body := normalizeText(r.FormValue("body"))
+
+	mime, ext, err := validateUpload(file, header)
+	if err != nil {
+		var uerr *UploadError
+		if !errors.As(err, &uerr) {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// テキストのみの投稿を許可している場合、画像が無くても本文があれば投稿できる
+		if uerr.Kind != UploadErrorMissing || !allowTextPost || strings.TrimSpace(body) == "" {
 			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
+			session.Values["notice"] = uerr.Notice()
 			session.Save(r, w)
 
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
+		mime, ext = "", ""
 	}
 
-	// filedata, err := io.ReadAll(file)
-	// if err != nil {
-	// 	log.Print(err)
-	// 	return
-	// }
-
-	if header.Size > UploadLimit {
+	geo, err := parseGeo(r)
+	if err != nil {
 		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
+		session.Values["notice"] = "位置情報は緯度-90〜90、経度-180〜180で指定してください"
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	if mime != "" {
+		fillGeoFromExif(r, &geo, file, mime)
+	}
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
+	// 説明文が入力されていれば手動設定として自動生成より優先する
+	imageAlt := formImageAlt(r)
+	imageAltManual := 0
+	if imageAlt != "" {
+		imageAltManual = 1
+	}
+
+	// 頻度制限は入力の検証を通って実際に作成する投稿だけ数える
+	if ok, retryAfter := allowPost(me); !ok {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	// 作成日時はクライアントの値を使わずサーバーの現在時刻にする。
+	// 例外は移行モードのバッチAPIだけで、範囲を検査した移行元の値を使う（bulkCreatedAt）
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `image_alt`, `image_alt_manual`, `lang`, `status`, `lat`, `lng`, `geo_public`, `created_at`) VALUES (?,?,?,?,?,?,?,?,?,?,?,NOW(6))"
 	emptyImage := []byte{}
 	result, err := db.Exec(
 		query,
 		me.ID,
 		mime,
 		emptyImage, // 静的ファイル配信のためNULLを設定
-		r.FormValue("body"),
+		body,
+		imageAlt,
+		imageAltManual,
+		detectLang(body),
+		status,
+		geo.Lat,
+		geo.Lng,
+		geo.Public,
 	)
 	if err != nil {
 		log.Print(err)
@@ -854,44 +1962,100 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 画像を静的ファイルとして保存
-	saveStaticFile(int(pid), ext, file)
+	savePostTags(int(pid), body)
+	clearAutosave(me.ID)
 
-	// キャッシュを無効化
-	memcacheClient.Delete("index_posts")
-	// 投稿したユーザーのアカウントページキャッシュも無効化
-	cacheKey := fmt.Sprintf("account:%s", me.AccountName)
-	memcacheClient.Delete(cacheKey)
+	if mime != "" {
+		// 画像を静的ファイルとして保存
+		saveStaticFile(int(pid), ext, file)
+
+		// 説明文の自動生成はアップロードをブロックしないよう非同期で行う
+		if imageAltManual == 0 {
+			go generateImageAlt(int(pid), ext, mime, me.AccountName)
+		}
+		enqueueBlurhash(int(pid), ext, me.AccountName)
+	}
 
-	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
+	if status == postStatusPublished {
+		go indexPost(int(pid))
+		notifyWebhooks(webhookEventPostCreated, int(pid))
+
+		// 最新投稿IDが変わるのでトップページのキャッシュは次のリクエストで作り直される
+		memcacheClient.Delete("latest_post_id")
+		// 投稿したユーザーのアカウントページキャッシュも無効化
+		cacheKey := fmt.Sprintf("account:%s", me.AccountName)
+		memcacheClient.Delete(cacheKey)
+	}
+
+	respondCreated(w, r, "/posts/"+strconv.FormatInt(pid, 10), func() interface{} {
+		p := Post{}
+		if err := db.Get(&p, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count` FROM `posts` WHERE `id` = ?", pid); err != nil {
+			log.Print(err)
+			return nil
+		}
+		return newAPIPost(p)
+	})
 }
 
-func saveStaticFile(pid int, ext string, file multipart.File) {
-	os.MkdirAll("../public/image", 0755)
-	filePath := fmt.Sprintf("../public/image/%d.%s", pid, ext)
+// postPostsAlt は投稿者が画像の説明文を手動で上書きする
+func postPostsAlt(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
 
-	// ファイルを作成
-	dst, err := os.Create(filePath)
+	pid, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		log.Print(err)
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	defer dst.Close()
 
-	// ストリーミングコピー（メモリに全体を読み込まない）
-	_, err = io.Copy(dst, file)
+	// 空にした場合は手動設定を解除して空altに戻す
+	imageAlt := formImageAlt(r)
+	imageAltManual := 0
+	if imageAlt != "" {
+		imageAltManual = 1
+	}
+
+	result, err := db.Exec("UPDATE `posts` SET `image_alt` = ?, `image_alt_manual` = ? WHERE `id` = ? AND `user_id` = ?", imageAlt, imageAltManual, pid, me.ID)
 	if err != nil {
 		log.Print(err)
-		os.Remove(filePath) // エラー時はファイル削除
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	// ファイル権限設定
-	err = os.Chmod(filePath, 0644)
-	if err != nil {
+	invalidateIndexPosts()
+	memcacheClient.Delete(fmt.Sprintf("account:%s", me.AccountName))
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", pid), http.StatusFound)
+}
+
+// staticFilePath は投稿の画像を書き出した静的ファイルのパスを返す
+func staticFilePath(p Post) string {
+	return localImages.path(p.ID, imageExtByMime(p.Mime))
+}
+
+func saveStaticFile(pid int, ext string, file multipart.File) {
+	// ストリーミングコピー（メモリに全体を読み込まない）
+	if err := localImages.Save(pid, ext, file); err != nil {
 		log.Print(err)
 		return
 	}
+
+	// スマホの縦撮り写真などはEXIFの向きに合わせてピクセルを回転しておく
+	saveImageDimensions(pid, localImages.path(pid, ext), ext == "jpg")
+
+	// 加工し終えた画像をオリジンに保存する
+	publishImage(pid, ext)
 }
 
 func getImage(w http.ResponseWriter, r *http.Request) {
@@ -903,31 +2067,71 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	post := Post{}
-	err = db.Get(&post, "SELECT `id`, `mime` FROM `posts` WHERE `id` = ?", pid)
+	filePath := ""
+	err = db.Get(&post, "SELECT `id`, `user_id`, `mime`, `status` FROM `posts` WHERE `id` = ?", pid)
+	if errors.Is(err, sql.ErrNoRows) {
+		archived, ok := getArchivedPost(pid)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		post, filePath, err = archived, archiveImagePath(archived), nil
+	}
 	if err != nil {
 		log.Print(err)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	// 下書き・公開予約中の画像は本人以外には存在しないものとして扱う
+	if isOwnerOnlyStatus(post.Status) && post.UserID != getSessionUser(r).ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	ext := r.PathValue("ext")
 
-	if ext == "jpg" && post.Mime == "image/jpeg" ||
-		ext == "png" && post.Mime == "image/png" ||
-		ext == "gif" && post.Mime == "image/gif" {
+	if ext != "" && ext == imageExtByMime(post.Mime) {
 
-		// ファイルシステムから画像ファイルを読み込み
-		filePath := fmt.Sprintf("../public/image/%d.%s", pid, ext)
-		imageData, err := os.ReadFile(filePath)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusNotFound)
-			return
+		// アーカイブ済みの画像はローカルのアーカイブ用のディレクトリにある（オリジンからは消していない）
+		var rc io.ReadCloser
+		if filePath != "" {
+			if f, err := os.Open(filePath); err == nil {
+				rc = f
+			}
+		}
+
+		if rc == nil {
+			if presigner, ok := imageStore.(imagePresigner); ok && imagePresignRedirect {
+				url, err := presigner.PresignedURL(r.Context(), pid, ext)
+				if err != nil {
+					log.Print(err)
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				http.Redirect(w, r, url, http.StatusFound)
+				return
+			}
+
+			rc, err = imageStore.Open(pid, ext)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				log.Print(err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
 		}
+		defer rc.Close()
 
-		// レスポンスとして返す
+		// 画像全体をメモリに載せないようストリーミングで返す
 		w.Header().Set("Content-Type", post.Mime)
-		_, err = w.Write(imageData)
+		if size, ok := imageSize(rc); ok {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		_, err = io.Copy(w, rc)
 		if err != nil {
 			log.Print(err)
 			return
@@ -945,7 +2149,7 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRF(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
@@ -956,15 +2160,72 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = db.Exec(query, postID, me.ID, r.FormValue("comment"))
+	// ボットには成功を装ってDBには書かない
+	if isBotSubmission(r) {
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusSeeOther)
+		return
+	}
+
+	// 下書きにはコメントできない
+	var status string
+	err = db.Get(&status, "SELECT `status` FROM `posts` WHERE `id` = ?", postID)
+	if err != nil || status != postStatusPublished {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	comment := normalizeText(r.FormValue("comment"))
+
+	// 返信先は同じ投稿のコメントに限る。返信への返信は同じ親への返信にしてネストを1段に保つ
+	var parentID sql.NullInt64
+	if v := r.FormValue("parent_comment_id"); v != "" {
+		pcid, err := strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parent := Comment{}
+		err = db.Get(&parent, "SELECT `id`, `post_id`, `parent_id` FROM `comments` WHERE `id` = ?", pcid)
+		if err != nil || parent.PostID != postID {
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				log.Print(err)
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if parent.ParentID.Valid {
+			parentID = parent.ParentID
+		} else {
+			parentID = sql.NullInt64{Int64: int64(parent.ID), Valid: true}
+		}
+	}
+
+	// 作成日時はクライアントの値を使わずサーバーの現在時刻にする（例外は bulkCreatedAt を参照）
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`, `lang`, `parent_id`, `created_at`) VALUES (?,?,?,?,?,NOW(6))"
+	result, err := db.Exec(query, postID, me.ID, comment, detectLang(comment), parentID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	cid, err := result.LastInsertId()
 	if err != nil {
 		log.Print(err)
 		return
 	}
+	// シャドウバンされたユーザーのコメントは他の人には見えないので数えない
+	if me.ShadowBanned == 0 {
+		incrCounter(commentCountKey(getCacheGeneration(), postID), 1)
+	}
+	notifyWebhooks(webhookEventCommentCreated, int(cid))
 
-	// キャッシュを無効化
-	memcacheClient.Delete("index_posts")
+	// コメントも検索対象なので投稿ごとインデックスし直す
+	go indexPost(postID)
+
+	// トップページのキャッシュはコメントでは作り直さず、TTLで反映する
 	// コメントしたユーザーのアカウントページキャッシュも無効化
 	cacheKey := fmt.Sprintf("account:%s", me.AccountName)
 	memcacheClient.Delete(cacheKey)
@@ -977,7 +2238,14 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		memcacheClient.Delete(postUserCacheKey)
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+	respondCreated(w, r, fmt.Sprintf("/posts/%d#cid_%d", postID, cid), func() interface{} {
+		c := Comment{}
+		if err := db.Get(&c, "SELECT * FROM `comments` WHERE `id` = ?", cid); err != nil {
+			log.Print(err)
+			return nil
+		}
+		return newAPIComment(c)
+	})
 }
 
 func getAdminBanned(w http.ResponseWriter, r *http.Request) {
@@ -999,14 +2267,33 @@ func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	type bannedUser struct {
+		ID             int    `db:"id"`
+		AccountName    string `db:"account_name"`
+		Reason         string `db:"reason"`
+		PurgedPosts    int    `db:"purged_posts"`
+		PurgedComments int    `db:"purged_comments"`
+	}
+	bannedUsers := []bannedUser{}
+	err = db.Select(&bannedUsers, "SELECT u.`id`, u.`account_name`, "+
+		"COALESCE((SELECT l.`reason` FROM `ban_logs` l WHERE l.`user_id` = u.`id` ORDER BY l.`id` DESC LIMIT 1), '') AS `reason`, "+
+		"COALESCE((SELECT l.`purged_posts` FROM `ban_logs` l WHERE l.`user_id` = u.`id` ORDER BY l.`id` DESC LIMIT 1), 0) AS `purged_posts`, "+
+		"COALESCE((SELECT l.`purged_comments` FROM `ban_logs` l WHERE l.`user_id` = u.`id` ORDER BY l.`id` DESC LIMIT 1), 0) AS `purged_comments` "+
+		"FROM `users` u WHERE u.`authority` = 0 AND u.`del_flg` = 1 ORDER BY u.`created_at` DESC")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
 	template.Must(template.ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("banned.html")),
 	).Execute(w, struct {
-		Users     []User
-		Me        User
-		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+		Users       []User
+		BannedUsers []bannedUser
+		Me          User
+		CSRFToken   string
+	}{users, bannedUsers, me, getCSRFToken(r)})
 }
 
 func postAdminBanned(w http.ResponseWriter, r *http.Request) {
@@ -1021,7 +2308,7 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRF(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
@@ -1034,20 +2321,49 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 理由は任意入力
+	reason := r.FormValue("reason")
+	purgeContent := r.FormValue("purge_content") == "1"
+
 	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		db.Exec(query, 1, uid)
+		result, err := db.Exec("INSERT INTO `ban_logs` (`user_id`, `admin_id`, `reason`) VALUES (?,?,?)", uid, me.ID, reason)
+		if err != nil {
+			log.Print(err)
+		} else if purgeContent {
+			// 大量の投稿があってもレスポンスを待たせないようバックグラウンドで削除する
+			banLogID, err := result.LastInsertId()
+			if err != nil {
+				log.Print(err)
+			} else {
+				go purgeBannedUserContent(uid, banLogID)
+			}
+		}
 		// バンされたユーザーのキャッシュを削除
 		cacheKey := fmt.Sprintf("user:%s", id)
 		memcacheClient.Delete(cacheKey)
 	}
 
 	// キャッシュを無効化（ユーザーがバンされると投稿一覧が変わる可能性がある）
-	memcacheClient.Delete("index_posts")
+	invalidateIndexPosts()
 
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
 }
 
 func main() {
+	backfill := flag.Bool("backfill-blurhash", false, "プレースホルダ画像が未生成の既存投稿について生成して終了する")
+	reindex := flag.Bool("reindex", false, "全文検索のインデックスを再構築して終了する")
+	archive := flag.Bool("archive", false, "ISUCONP_ARCHIVE_AFTER より古い投稿を posts_archive に移して終了する")
+	fixImagesFlag := flag.Bool("fix-images", false, "mime と画像ファイルの拡張子・中身が食い違っている投稿を直して終了する")
+	fixImagesFrom := flag.Int("fix-images-from", 0, "-fix-images でこのID以降の投稿を調べる")
+	fixImagesLimit := flag.Int("fix-images-limit", 0, "-fix-images で調べる投稿数の上限（0なら最後まで）")
+	dryRun := flag.Bool("dry-run", false, "-fix-images で修正せずに報告だけする")
+	flag.Parse()
+
 	host := os.Getenv("ISUCONP_DB_HOST")
 	if host == "" {
 		host = "localhost"
@@ -1085,26 +2401,167 @@ func main() {
 	}
 	defer db.Close()
 
+	// 0（既定）なら上限を設けない
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_DB_MAX_OPEN_CONNS")); err == nil && n > 0 {
+		db.SetMaxOpenConns(n)
+	}
+
+	if *backfill {
+		if err := backfillBlurhash(); err != nil {
+			log.Fatalf("Failed to backfill blurhash: %s.", err.Error())
+		}
+		return
+	}
+
+	if *reindex {
+		if err := reindexAll(); err != nil {
+			log.Fatalf("Failed to reindex: %s.", err.Error())
+		}
+		return
+	}
+
+	if *archive {
+		n, err := archiveOldPosts()
+		if err != nil {
+			log.Fatalf("Failed to archive posts: %s.", err.Error())
+		}
+		log.Printf("archived %d posts", n)
+		bumpCacheGeneration()
+		return
+	}
+
+	if *fixImagesFlag {
+		if err := initImageStore(); err != nil {
+			log.Fatalf("Failed to initialize image store: %s.", err.Error())
+		}
+		res, err := fixImages(fixImagesOptions{DryRun: *dryRun, FromID: *fixImagesFrom, Limit: *fixImagesLimit})
+		if err != nil {
+			log.Fatalf("Failed to fix images: %s.", err.Error())
+		}
+		log.Printf("fix-images: checked %d posts up to %d, fixed %d, problems %d (dry run: %t)", res.Checked, res.LastID, res.Fixed, res.Problems, *dryRun)
+		return
+	}
+
+	if err := initImageStore(); err != nil {
+		log.Fatalf("Failed to initialize image store: %s.", err.Error())
+	}
+	if err := loadFormTokenKey(); err != nil {
+		log.Fatalf("Failed to load the form token key: %s.", err.Error())
+	}
+
+	go cleanupPendingUploads()
+	go cleanupPreparedPosts()
+	go runBlurhashWorker()
+	go runTrendingTicker()
+	go runArchiveTicker()
+	go runViewFlusher()
+	runWebhookWorkers()
+	go runScheduler()
+	go runCacheTTLTuner()
+	go runBackpressureMonitor()
+
 	r := chi.NewRouter()
+	r.Use(limitRequestBody(r))
+	r.Use(sessionLifetime)
+
+	// 内部の統計は管理者にだけ見せる
+	r.With(adminOnly).Handle("/debug/vars", expvar.Handler())
+	r.With(adminOnly).Get("/debug/cache-stats", getDebugCacheStats)
+	r.Get("/healthz", getHealthz)
+	r.Get("/readyz", getReadyz)
 
 	r.Get("/initialize", getInitialize)
 	r.Get("/login", getLogin)
-	r.Post("/login", postLogin)
+	r.With(checkOrigin).Post("/login", postLogin)
 	r.Get("/register", getRegister)
-	r.Post("/register", postRegister)
+	r.With(writeBackpressure("postRegister"), checkOrigin).Post("/register", postRegister)
 	r.Get("/logout", getLogout)
-	r.Get("/", getIndex)
-	r.Get("/posts", getPosts)
+	r.With(pageCache).Get("/", getIndex)
+	r.With(pageCache).Get("/posts", getPosts)
+	r.Get("/posts/since", getPostsSince)
 	r.Get("/posts/{id}", getPostsID)
-	r.Post("/", postIndex)
+	r.Get("/api/posts", getAPIPosts)
+	r.Get("/api/posts/has_new", getPostsHasNew)
+	r.Get("/search", getSearch)
+	r.Get("/trending", getTrending)
+	r.Get("/map", getMap)
+	r.Get("/mutes", getMutesList)
+	r.Post("/mutes", postMutes)
+	r.Delete("/mutes", deleteMutes)
+	r.With(writeBackpressure("postIndex"), checkOrigin).Post("/", postIndex)
+	r.Post("/api/upload", postAPIUpload)
+	r.Get("/api/upload/chunk", getAPIUploadChunk)
+	r.Post("/api/preview", postAPIPreview)
+	r.Get("/api/draft/autosave", getAPIDraftAutosave)
+	r.Put("/api/draft/autosave", putAPIDraftAutosave)
+	r.Get("/api/tags/suggest", getAPITagsSuggest)
+	r.Post("/api/posts/prepare", postAPIPostsPrepare)
+	r.Post("/api/posts/{id}/commit", postAPIPostsCommit)
+	r.Post("/api/upload/chunk", postAPIUploadChunk)
+	r.Post("/posts/{id}/alt", postPostsAlt)
+	r.Get("/posts/{id}/edit", getPostsEdit)
+	r.Post("/posts/{id}/edit", postPostsEdit)
+	r.Get("/posts/{id}/history", getPostsHistory)
+	r.Post("/posts/{id}/like", postPostsLike)
+	r.Post("/posts/{id}/react", postPostsReact)
+	r.Post("/comments/{id}/react", postCommentsReact)
+	r.Get("/settings/account-name", getSettingsAccountName)
+	r.Post("/settings/account-name", postSettingsAccountName)
+	r.Post("/settings/likes_public", postSettingsLikesPublic)
+	r.Get("/settings/drafts", getSettingsDrafts)
+	r.Get("/settings/export/images", getSettingsExportImages)
+	r.Post("/posts/draft", postPostsDraft)
+	r.Post("/posts/{id}/quote", postPostsQuote)
+	r.Post("/posts/{id}/publish", postPostsPublish)
+	r.Post("/posts/{id}/schedule", postPostsSchedule)
+	r.Post("/posts/{id}/unschedule", postPostsUnschedule)
 	r.Get("/image/{id}.{ext}", getImage)
-	r.Post("/comment", postComment)
+	r.With(writeBackpressure("postComment"), checkOrigin).Post("/comment", postComment)
 	r.Get("/admin/banned", getAdminBanned)
-	r.Post("/admin/banned", postAdminBanned)
-	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
-	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
-		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
-	})
+	r.With(checkOrigin).Post("/admin/banned", postAdminBanned)
+	r.Post("/admin/shadowban", postAdminShadowBan)
+	r.Post("/api/admin/bulk", postAPIAdminBulk)
+	r.Get("/admin/reports", getAdminReports)
+	r.Get("/admin/analytics", getAdminAnalytics)
+	r.Get("/admin/webhooks", getAdminWebhooks)
+	r.Post("/admin/webhooks", postAdminWebhooks)
+	r.Post("/admin/webhooks/{id}", postAdminWebhooksUpdate)
+	r.Post("/admin/reports/{id}", postAdminReportsResolve)
+	r.Post("/posts/{id}/report", postPostsReport)
+	r.Post("/comments/{id}/report", postCommentsReport)
+	r.With(pageCache).Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
+	r.Get(`/@{accountName:[a-zA-Z]+}/likes`, getAccountLikes)
+	r.Get(`/@{accountName:[a-zA-Z]+}/posts.json`, getAccountPostsJSON)
+	loadAssetManifest()
+	static, err := newStaticHandler("../public")
+	if err != nil {
+		log.Fatalf("Failed to resolve public directory: %s.", err.Error())
+	}
+	r.Get("/*", staticCacheControl(static).ServeHTTP)
+
+	go prepareReadiness()
+
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	// LBに切り離されるよう先に /readyz を503にしてから処理中のリクエストを待つ
+	setReadiness(&shuttingDown, "shutting_down", true)
+	time.Sleep(shutdownDrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Print(err)
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	// 処理中のリクエストが数えた分まで書き戻してから終了する
+	flushViewCounts()
 }
@@ -0,0 +1,993 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// expectMakePostsCounts は makePosts がカウンタ（コメント数・いいね数・リアクション数）を数えるクエリを期待する
+func expectMakePostsCounts(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM comments c JOIN users u ON c.user_id = u.id WHERE c.post_id IN")).
+		WillReturnRows(sqlmock.NewRows([]string{"post_id", "count"}))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM likes WHERE post_id IN")).
+		WillReturnRows(sqlmock.NewRows([]string{"post_id", "count"}))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM `reactions` WHERE `post_id` IN")).
+		WillReturnRows(sqlmock.NewRows([]string{"post_id", "comment_id", "emoji", "count"}))
+}
+
+func commentIDs(comments []Comment) []int {
+	ids := make([]int, len(comments))
+	for i, c := range comments {
+		ids[i] = c.ID
+	}
+	return ids
+}
+
+func TestMakePostsCommentOrder(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name        string
+		allComments bool
+		order       string
+		queryOrder  string
+		rowIDs      []int // DBが返す順（created_at はIDの順に新しい）
+		want        []int
+	}{
+		{"詳細ページは既定で古い順", true, commentOrderAsc, "ASC", []int{1, 2, 3, 4, 5}, []int{1, 2, 3, 4, 5}},
+		{"詳細ページで新しい順", true, commentOrderDesc, "DESC", []int{5, 4, 3, 2, 1}, []int{5, 4, 3, 2, 1}},
+		{"不明な指定は古い順", true, "random", "ASC", []int{1, 2, 3, 4, 5}, []int{1, 2, 3, 4, 5}},
+		{"一覧は最新3件を古い順", false, commentOrderAsc, "DESC", []int{5, 4, 3, 2, 1}, []int{3, 4, 5}},
+		{"一覧は順序の指定に関わらず古い順", false, commentOrderDesc, "DESC", []int{5, 4, 3, 2, 1}, []int{3, 4, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeMemcache(t)
+			mock := useMockDB(t)
+
+			expectMakePostsCounts(mock)
+			rows := sqlmock.NewRows([]string{"id", "post_id", "user_id", "comment", "created_at"})
+			for _, id := range tt.rowIDs {
+				rows.AddRow(id, 1, 2, "comment", base.Add(time.Duration(id)*time.Second))
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM comments WHERE post_id IN (?) ORDER BY created_at " + tt.queryOrder)).
+				WillReturnRows(rows)
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id IN")).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "account_name", "del_flg"}).AddRow(2, "alice", 0))
+
+			posts, err := makePostsWith([]Post{{ID: 1, UserID: 2}}, "", tt.allComments, tt.order, postsPerPage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(posts) != 1 {
+				t.Fatalf("got %d posts, want 1", len(posts))
+			}
+			if got := commentIDs(posts[0].Comments); !equalInts(got, tt.want) {
+				t.Errorf("comments = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGetPostsHasNew(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	since := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	hasNew := func(since string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		getPostsHasNew(w, httptest.NewRequest(http.MethodGet, "/api/posts/has_new?since="+url.QueryEscape(since), nil))
+		res := map[string]interface{}{}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, res
+	}
+
+	// 同じ since への2回目以降はキャッシュから返し、DBには1回しか問い合わせない
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM `posts`")).
+		WithArgs(since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	for i := 0; i < 3; i++ {
+		code, res := hasNew(since.Format(ISO8601Format))
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", code)
+		}
+		if res["has_new"] != true || res["count"] != float64(2) || res["refresh_url"] != "/" {
+			t.Errorf("response = %v, want has_new with count 2", res)
+		}
+	}
+
+	later := since.Add(time.Hour)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM `posts`")).
+		WithArgs(later).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	_, res := hasNew(later.Format(ISO8601Format))
+	if res["has_new"] != false || res["count"] != float64(0) {
+		t.Errorf("response = %v, want no new posts", res)
+	}
+	if _, ok := res["refresh_url"]; ok {
+		t.Errorf("refresh_url should be omitted without new posts: %v", res)
+	}
+
+	if code, _ := hasNew("yesterday"); code != http.StatusBadRequest {
+		t.Errorf("invalid since: status = %d, want 400", code)
+	}
+}
+
+func TestIsBotSubmission(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		accept   string
+		required bool
+		want     bool
+	}{
+		// 正規ユーザーを誤検知しない
+		{"表示から十分経った送信", url.Values{"form_token": {formTokenAt(now.Add(-5 * time.Second))}, "website": {""}}, "text/html", false, false},
+		{"ちょうど最短時間で送信", url.Values{"form_token": {formTokenAt(now.Add(-formMinInterval - 10*time.Millisecond))}}, "text/html", false, false},
+		{"フォームを長時間開いたままの送信", url.Values{"form_token": {formTokenAt(now.Add(-24 * time.Hour))}}, "text/html", false, false},
+		{"トークンを送らない既存のクライアント", url.Values{}, "text/html", false, false},
+		{"Acceptの無いトークン省略", url.Values{}, "", false, false},
+		{"トークンを必須にしても有効なトークンは通す", url.Values{"form_token": {formTokenAt(now.Add(-5 * time.Second))}}, "text/html", true, false},
+
+		// ボット
+		{"honeypotが埋まっている", url.Values{"form_token": {formTokenAt(now.Add(-5 * time.Second))}, "website": {"http://spam.example"}}, "text/html", false, true},
+		{"トークンが無くてもhoneypotは検査する", url.Values{"website": {"x"}}, "application/json", false, true},
+		{"表示直後の送信", url.Values{"form_token": {formTokenAt(now)}}, "text/html", false, true},
+		{"JSONを求めても表示直後の送信は検査する", url.Values{"form_token": {formTokenAt(now)}}, "application/json", false, true},
+		{"トークンを必須にしたときの省略", url.Values{}, "text/html", true, true},
+		{"トークンを必須にしたときはAcceptで逃れられない", url.Values{}, "application/json", true, true},
+		{"改ざんしたトークン", url.Values{"form_token": {"1.deadbeef"}}, "text/html", false, true},
+		{"形式が不正なトークン", url.Values{"form_token": {"token"}}, "text/html", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := formTokenRequired
+			formTokenRequired = tt.required
+			t.Cleanup(func() { formTokenRequired = old })
+
+			if got := isBotSubmission(formRequest(tt.form, tt.accept)); got != tt.want {
+				t.Errorf("isBotSubmission = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func formRequest(form url.Values, accept string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/comment", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	return r
+}
+
+// 再起動や別のインスタンスでもDBに保存した同じ鍵を使うので、前に表示したフォームのトークンが通る
+func TestLoadFormTokenKey(t *testing.T) {
+	t.Setenv("ISUCONP_FORM_TOKEN_KEY", "")
+	old := formTokenKey
+	t.Cleanup(func() { formTokenKey = old })
+
+	load := func(stored string) {
+		t.Helper()
+		mock := useMockDB(t)
+		mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO `app_secrets`")).
+			WithArgs("form_token_key", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT `value` FROM `app_secrets` WHERE `name` = ?")).
+			WithArgs("form_token_key").
+			WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(stored))
+		if err := loadFormTokenKey(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load("stored-key")
+	token := formTokenAt(time.Now().Add(-time.Minute))
+
+	// 再起動した
+	formTokenKey = []byte("per-process-key")
+	load("stored-key")
+	if isBotSubmission(formRequest(url.Values{"form_token": {token}}, "text/html")) {
+		t.Error("token issued before the restart was rejected")
+	}
+
+	// 鍵を作り直したら前の鍵のトークンは改ざんとみなす
+	load("rotated-key")
+	if !isBotSubmission(formRequest(url.Values{"form_token": {token}}, "text/html")) {
+		t.Error("token signed with an old key was accepted")
+	}
+}
+
+func TestLoadFormTokenKeyCreatesTable(t *testing.T) {
+	t.Setenv("ISUCONP_FORM_TOKEN_KEY", "")
+	old := formTokenKey
+	t.Cleanup(func() { formTokenKey = old })
+
+	mock := useMockDB(t)
+	mock.MatchExpectationsInOrder(true)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO `app_secrets`")).
+		WillReturnError(&mysql.MySQLError{Number: 1146, Message: "Table 'isuconp.app_secrets' doesn't exist"})
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `app_secrets`")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO `app_secrets`")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `value` FROM `app_secrets`")).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("new-key"))
+
+	if err := loadFormTokenKey(); err != nil {
+		t.Fatal(err)
+	}
+	if string(formTokenKey) != "new-key" {
+		t.Errorf("formTokenKey = %q, want the stored key", formTokenKey)
+	}
+}
+
+func TestLoadFormTokenKeyFromEnv(t *testing.T) {
+	t.Setenv("ISUCONP_FORM_TOKEN_KEY", "configured-key")
+	old := formTokenKey
+	t.Cleanup(func() { formTokenKey = old })
+
+	// 設定されていればDBは見ない
+	useMockDB(t)
+	if err := loadFormTokenKey(); err != nil {
+		t.Fatal(err)
+	}
+	if string(formTokenKey) != "configured-key" {
+		t.Errorf("formTokenKey = %q, want the configured key", formTokenKey)
+	}
+}
+
+// useImageDir はテストの間だけ投稿画像の置き場所を一時ディレクトリにし、id の画像として data を置く
+func useImageDir(t testing.TB, id int, ext string, data []byte) {
+	t.Helper()
+
+	oldLocal, oldStore := localImages, imageStore
+	localImages = &localImageStore{dir: t.TempDir()}
+	imageStore = localImages
+	t.Cleanup(func() { localImages, imageStore = oldLocal, oldStore })
+
+	if err := localImages.Save(id, ext, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectImagePost(mock sqlmock.Sqlmock, id int, mime string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id`, `user_id`, `mime`, `status` FROM `posts` WHERE `id` = ?")).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "mime", "status"}).AddRow(id, 1, mime, postStatusPublished))
+}
+
+func requestImage(id int, ext string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/image/"+strconv.Itoa(id)+"."+ext, nil)
+	r.SetPathValue("id", strconv.Itoa(id))
+	r.SetPathValue("ext", ext)
+	w := httptest.NewRecorder()
+	getImage(w, r)
+	return w
+}
+
+func TestGetImage(t *testing.T) {
+	data := bytes.Repeat([]byte("GIF89a"), 1000)
+
+	t.Run("Content-Lengthを付けて返す", func(t *testing.T) {
+		mock := useMockDB(t)
+		useImageDir(t, 1, "gif", data)
+		expectImagePost(mock, 1, "image/gif")
+
+		w := requestImage(1, "gif")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "image/gif" {
+			t.Errorf("Content-Type = %q", got)
+		}
+		if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(data)) {
+			t.Errorf("Content-Length = %q, want %d", got, len(data))
+		}
+		if !bytes.Equal(w.Body.Bytes(), data) {
+			t.Error("body differs from the image file")
+		}
+	})
+
+	t.Run("拡張子とmimeが合わなければ404", func(t *testing.T) {
+		mock := useMockDB(t)
+		useImageDir(t, 1, "gif", data)
+		expectImagePost(mock, 1, "image/gif")
+
+		if w := requestImage(1, "png"); w.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", w.Code)
+		}
+	})
+
+	t.Run("ファイルが無ければ404", func(t *testing.T) {
+		mock := useMockDB(t)
+		useImageDir(t, 1, "gif", data)
+		expectImagePost(mock, 2, "image/gif")
+
+		if w := requestImage(2, "gif"); w.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", w.Code)
+		}
+	})
+}
+
+// BenchmarkGetImage は画像の配信で確保するメモリを比べる。
+// stream（getImage）は画像の大きさによらず B/op がほぼ一定で、readfile（以前の実装）は画像の大きさだけ確保する
+func BenchmarkGetImage(b *testing.B) {
+	data := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 1<<19) // 2MB
+
+	b.Run("stream", func(b *testing.B) {
+		mockDB, mock, err := sqlmock.New()
+		if err != nil {
+			b.Fatal(err)
+		}
+		old := db
+		db = sqlx.NewDb(mockDB, "mysql")
+		b.Cleanup(func() { db.Close(); db = old })
+		useImageDir(b, 1, "png", data)
+		for i := 0; i < b.N; i++ {
+			expectImagePost(mock, 1, "image/png")
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/image/1.png", nil)
+			r.SetPathValue("id", "1")
+			r.SetPathValue("ext", "png")
+			getImage(discardResponseWriter{}, r)
+		}
+	})
+
+	b.Run("readfile", func(b *testing.B) {
+		useImageDir(b, 1, "png", data)
+		path := localImages.path(1, "png")
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			discardResponseWriter{}.Write(buf)
+		}
+	})
+}
+
+// discardResponseWriter はレスポンスを捨てる。httptest.ResponseRecorder は本文を溜めるので計測に使えない
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header         { return http.Header{} }
+func (discardResponseWriter) Write(p []byte) (int, error) { return io.Discard.Write(p) }
+func (discardResponseWriter) WriteHeader(int)             {}
+
+// expectAppliedMigrations は schema_migrations に ids が記録されている状態にする
+func expectAppliedMigrations(mock sqlmock.Sqlmock, ids ...string) {
+	rows := sqlmock.NewRows([]string{"id"})
+	for _, id := range ids {
+		rows.AddRow(id)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id` FROM `schema_migrations`")).WillReturnRows(rows)
+}
+
+func expectRecordMigration(mock sqlmock.Sqlmock, id string) {
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO `schema_migrations` (`id`) VALUES (?)")).
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestRunMigrations(t *testing.T) {
+	allIDs := []string{createdAtPrecisionMigration}
+	for _, q := range migrations {
+		allIDs = append(allIDs, migrationID(q))
+	}
+
+	t.Run("適用済みならDDLを実行しない", func(t *testing.T) {
+		mock := useMockDB(t)
+		expectAppliedMigrations(mock, allIDs...)
+
+		if err := runMigrations(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("未適用のものだけ実行して記録する", func(t *testing.T) {
+		mock := useMockDB(t)
+		last := migrations[len(migrations)-1]
+		expectAppliedMigrations(mock, allIDs[:len(allIDs)-1]...)
+		mock.ExpectExec(regexp.QuoteMeta(last)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectRecordMigration(mock, migrationID(last))
+
+		if err := runMigrations(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("記録が無ければすべて実行する", func(t *testing.T) {
+		mock := useMockDB(t)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT `id` FROM `schema_migrations`")).
+			WillReturnError(&mysql.MySQLError{Number: 1146, Message: "Table 'isuconp.schema_migrations' doesn't exist"})
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `schema_migrations`")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		for i, q := range migrations {
+			e := mock.ExpectExec(regexp.QuoteMeta(q))
+			if i == 0 {
+				// 記録を始める前に適用済みだったもの
+				e.WillReturnError(&mysql.MySQLError{Number: 1060, Message: "Duplicate column name 'image_alt'"})
+			} else {
+				e.WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			expectRecordMigration(mock, migrationID(q))
+		}
+		for _, table := range []string{"posts", "comments", "posts_archive"} {
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT `DATETIME_PRECISION` FROM `information_schema`.`COLUMNS`")).
+				WithArgs(table).
+				WillReturnRows(sqlmock.NewRows([]string{"DATETIME_PRECISION"}).AddRow(6))
+		}
+		expectRecordMigration(mock, createdAtPrecisionMigration)
+
+		if err := runMigrations(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCreatedAtPrecision(t *testing.T) {
+	created := time.Date(2024, 1, 1, 12, 0, 5, 123456000, time.Local)
+
+	t.Run("カーソルのマイクロ秒を落とさない", func(t *testing.T) {
+		useFakeMemcache(t)
+		mock := useMockDB(t)
+
+		cursor := created.Format("2006-01-02T15:04:05.000000-07:00")
+		got, err := time.Parse(ISO8601Format, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(created) {
+			t.Fatalf("time.Parse(ISO8601Format, %q) = %s, want %s", cursor, got, created)
+		}
+
+		// 同じ秒の投稿を取りこぼさないよう、DBにはマイクロ秒のまま渡す
+		mock.ExpectQuery(regexp.QuoteMeta("FROM `posts` WHERE `created_at` <= ?")).
+			WithArgs(created, postsPerPage*2).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		w := httptest.NewRecorder()
+		getPosts(w, httptest.NewRequest(http.MethodGet, "/posts?max_created_at="+url.QueryEscape(cursor), nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404 for no posts", w.Code)
+		}
+	})
+
+	t.Run("経過時間の表示は秒単位のまま", func(t *testing.T) {
+		tmpl := template.Must(template.New("post.html").Funcs(fmap).ParseFiles(getTemplPath("post.html")))
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, Post{ID: 1, CreatedAt: created, User: User{AccountName: "alice"}}); err != nil {
+			t.Fatal(err)
+		}
+		got := html.UnescapeString(buf.String())
+
+		timeago := `<time class="timeago" datetime="` + created.Format("2006-01-02T15:04:05-07:00") + `">`
+		if !strings.Contains(got, timeago) {
+			t.Errorf("want %s in %s", timeago, got)
+		}
+		cursor := `data-created-at="` + created.Format("2006-01-02T15:04:05.000000-07:00") + `"`
+		if !strings.Contains(got, cursor) {
+			t.Errorf("want %s in %s", cursor, got)
+		}
+	})
+}
+
+func TestGetPostsSince(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	since := func(lastID string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		getPostsSince(w, httptest.NewRequest(http.MethodGet, "/posts/since?last_id="+lastID, nil))
+		res := map[string]interface{}{}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, res
+	}
+
+	// has_new と同じ数え方で、上限+1件までしか数えない
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (SELECT 1 FROM `posts` p JOIN `users` u ON p.`user_id` = u.`id` WHERE p.`id` > ? AND p.`status` = 'published' AND u.`del_flg` = 0 AND u.`shadow_banned` = 0 LIMIT ?) t")).
+		WithArgs(10, maxSinceCount+1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(maxSinceCount + 1))
+	mock.ExpectQuery(regexp.QuoteMeta("ORDER BY p.`id` DESC LIMIT 1")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(200))
+	_, res := since("10")
+	if res["count"] != float64(maxSinceCount) || res["has_more"] != true || res["latest_id"] != float64(200) {
+		t.Errorf("response = %v, want %d+ posts up to 200", res, maxSinceCount)
+	}
+
+	// 件数はキャッシュし、新着が無ければ最新IDも引かない
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (SELECT 1 FROM `posts`")).
+		WithArgs(200, maxSinceCount+1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	for i := 0; i < 2; i++ {
+		_, res = since("200")
+		if res["count"] != float64(0) || res["has_more"] != false || res["latest_id"] != float64(200) {
+			t.Errorf("response = %v, want no new posts", res)
+		}
+	}
+
+	if code, _ := since("-1"); code != http.StatusBadRequest {
+		t.Errorf("invalid last_id: status = %d, want 400", code)
+	}
+}
+
+// シャドウバンされたユーザーの投稿は新着に数えない。本人には自分の投稿を数える
+func TestCountNewPostsShadowBan(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	since := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	banned := User{ID: 2, AccountName: "bob", ShadowBanned: 1}
+
+	mock.ExpectQuery(regexp.QuoteMeta("AND p.`status` = 'published' AND u.`del_flg` = 0 AND u.`shadow_banned` = 0")).
+		WithArgs(since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta("AND p.`status` = 'published' AND u.`del_flg` = 0 AND (u.`shadow_banned` = 0 OR u.`id` = ?)")).
+		WithArgs(since, banned.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	// キャッシュはシャドウバンされた閲覧者の分だけ別にする
+	for i := 0; i < 2; i++ {
+		for _, tt := range []struct {
+			viewer User
+			want   int
+		}{{User{}, 1}, {User{ID: 3, AccountName: "carol"}, 1}, {banned, 2}} {
+			got, err := countNewPosts("has_new:test", "p.`created_at` > ?", since, 0, tt.viewer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("viewer %d: count = %d, want %d", tt.viewer.ID, got, tt.want)
+			}
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNormalizeCursorTime(t *testing.T) {
+	now := time.Now()
+	edge := time.Date(2024, 1, 1, 12, 0, 5, 123456000, time.Local)
+
+	tests := []struct {
+		name string
+		in   time.Time
+		want time.Time
+	}{
+		{"過去の時刻はそのまま", edge, edge},
+		{"マイクロ秒未満は切り捨てる", edge.Add(999 * time.Nanosecond), edge},
+		{"切り上げない", edge.Add(-time.Nanosecond), edge.Add(-time.Microsecond)},
+		{"許容範囲内の未来はそのまま", now.Add(cursorFutureTolerance - time.Second).Truncate(time.Microsecond), now.Add(cursorFutureTolerance - time.Second).Truncate(time.Microsecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeCursorTime(tt.in); !got.Equal(tt.want) {
+				t.Errorf("normalizeCursorTime(%s) = %s, want %s", tt.in.Format(time.RFC3339Nano), got.Format(time.RFC3339Nano), tt.want.Format(time.RFC3339Nano))
+			}
+		})
+	}
+
+	t.Run("大幅に未来なら現在時刻", func(t *testing.T) {
+		got := normalizeCursorTime(now.Add(cursorFutureTolerance + time.Second))
+		if got.Before(now.Truncate(time.Microsecond)) || got.After(time.Now()) {
+			t.Errorf("normalizeCursorTime = %s, want about %s", got, now)
+		}
+		if got.Nanosecond()%1000 != 0 {
+			t.Errorf("normalizeCursorTime = %s, want microsecond precision", got.Format(time.RFC3339Nano))
+		}
+	})
+}
+
+// 前のページの最後の投稿と同じ created_at の投稿が次のページの先頭に来ても取りこぼさない
+func TestGetPostsCursorAtPageEdge(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	edge := time.Date(2024, 1, 1, 12, 0, 5, 123456000, time.Local)
+	// マイクロ秒より細かいカーソルが来ても、MySQLに丸めさせると edge より新しい投稿まで含まれる
+	cursor := edge.Add(900 * time.Nanosecond).Format("2006-01-02T15:04:05.000000000-07:00")
+
+	// 同じ時刻の投稿も含めるため < ではなく <= で、切り捨てた時刻で問い合わせる
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE `created_at` <= ? AND `status` = 'published' ORDER BY `created_at` DESC LIMIT ?")).
+		WithArgs(edge, postsPerPage*2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	w := httptest.NewRecorder()
+	getPosts(w, httptest.NewRequest(http.MethodGet, "/posts?max_created_at="+url.QueryEscape(cursor), nil))
+}
+
+func TestMakePostsTextOnly(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	expectMakePostsCounts(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM comments WHERE post_id IN (?, ?) ORDER BY created_at DESC")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "post_id", "user_id", "comment", "created_at"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id IN")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_name", "del_flg"}).AddRow(2, "alice", 0))
+
+	results := []Post{
+		{ID: 2, UserID: 2, Body: "テキストだけの投稿", CreatedAt: time.Now()},
+		{ID: 1, UserID: 2, Body: "画像付きの投稿", Mime: "image/png", CreatedAt: time.Now()},
+	}
+	posts, err := makePostsWith(results, "", false, commentOrderAsc, postsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("got %d posts, want both the text and the image post", len(posts))
+	}
+
+	tmpl := template.Must(template.New("post.html").Funcs(fmap).ParseFiles(getTemplPath("post.html")))
+	for _, p := range posts {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, p); err != nil {
+			t.Fatalf("post %d: %v", p.ID, err)
+		}
+		hasImage := strings.Contains(buf.String(), `class="isu-image"`)
+		if want := p.Mime != ""; hasImage != want {
+			t.Errorf("post %d: image rendered = %v, want %v", p.ID, hasImage, want)
+		}
+		if !strings.Contains(buf.String(), p.Body) {
+			t.Errorf("post %d: body %q is not rendered", p.ID, p.Body)
+		}
+	}
+	if got := imageURL(posts[0]); got != "" {
+		t.Errorf("imageURL of a text post = %q, want empty", got)
+	}
+}
+
+func TestMakePostsViewCount(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	// 書き戻し済みの閲覧数は results の値を使い、posts を読み直さない
+	expectMakePostsCounts(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM comments WHERE post_id IN (?, ?) ORDER BY created_at DESC")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "post_id", "user_id", "comment", "created_at"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id IN")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_name", "del_flg"}).AddRow(2, "alice", 0))
+
+	if err := memcacheClient.Set(&memcache.Item{Key: viewsKey(1), Value: []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	results := []Post{
+		{ID: 2, UserID: 2, Body: "未反映の閲覧なし", CreatedAt: time.Now(), ViewCount: 5},
+		{ID: 1, UserID: 2, Body: "未反映の閲覧あり", CreatedAt: time.Now(), ViewCount: 10},
+	}
+	posts, err := makePostsWith(results, "", false, commentOrderAsc, postsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]int{2: 5, 1: 13}
+	for _, p := range posts {
+		if p.ViewCount != want[p.ID] {
+			t.Errorf("post %d: view count = %d, want %d", p.ID, p.ViewCount, want[p.ID])
+		}
+	}
+}
+
+// setIndexPostsCache はトップページの一覧のキャッシュを latestID の時点で作ったものとして置く
+func setIndexPostsCache(t *testing.T, latestID int, posts []Post) {
+	t.Helper()
+	data, err := json.Marshal(indexPostsCache{LatestID: latestID, Generation: getCacheGeneration(), Posts: posts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memcacheClient.Set(&memcache.Item{Key: "index_posts", Value: data})
+}
+
+func TestGetIndexCacheConsistency(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	index := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		getIndex(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+		return w.Body.String()
+	}
+	old := Post{ID: 5, UserID: 2, Body: "キャッシュ済みの投稿", CreatedAt: time.Now(), User: User{ID: 2, AccountName: "alice"}}
+
+	// 最新IDが一致していればDBを引かずにキャッシュを使う
+	memcacheClient.Set(&memcache.Item{Key: "latest_post_id", Value: []byte("5")})
+	setIndexPostsCache(t, 5, []Post{old})
+	if body := index(); !strings.Contains(body, old.Body) {
+		t.Fatalf("cached post is not shown: %s", body)
+	}
+
+	// 新しい投稿があれば作り直す
+	memcacheClient.Set(&memcache.Item{Key: "latest_post_id", Value: []byte("6")})
+	mock.ExpectQuery(regexp.QuoteMeta("FROM `posts` WHERE `status` = 'published' ORDER BY `created_at` DESC LIMIT ?")).
+		WithArgs(postsPerPage * 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "body", "mime", "created_at"}).
+			AddRow(6, 2, "新しい投稿", "", time.Now()).
+			AddRow(5, 2, old.Body, "", old.CreatedAt))
+	expectMakePostsCounts(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM comments WHERE post_id IN (?, ?) ORDER BY created_at DESC")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "post_id", "user_id", "comment", "created_at"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id IN")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_name", "del_flg"}).AddRow(2, "alice", 0))
+	if body := index(); !strings.Contains(body, "新しい投稿") {
+		t.Fatalf("new post is not shown: %s", body)
+	}
+
+	// 作り直したキャッシュは新しい最新IDを持ち、次からはそれを使う
+	item, err := memcacheClient.Get("index_posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cached indexPostsCache
+	if err := json.Unmarshal(item.Value, &cached); err != nil {
+		t.Fatal(err)
+	}
+	if cached.LatestID != 6 || len(cached.Posts) != 2 {
+		t.Errorf("cache = latest %d with %d posts, want latest 6 with 2 posts", cached.LatestID, len(cached.Posts))
+	}
+	index()
+}
+
+func TestGetLatestPostIDCached(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	// 数秒キャッシュするので、続けて呼んでもクエリは1回
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(`id`), 0) FROM `posts` WHERE `status` = 'published'")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	for i := 0; i < 3; i++ {
+		id, err := getLatestPostID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 42 {
+			t.Errorf("getLatestPostID = %d, want 42", id)
+		}
+	}
+}
+
+func TestGetAPIPostsViewer(t *testing.T) {
+	tests := []struct {
+		name   string
+		viewer *User
+		want   []int
+	}{
+		{"未ログインにはシャドウバンされたユーザーの投稿を見せない", nil, []int{1}},
+		{"他のユーザーにも見せない", &User{ID: 3, AccountName: "carol"}, []int{1}},
+		{"シャドウバンされた本人には自分の投稿も見せる", &User{ID: 2, AccountName: "bob", ShadowBanned: 1}, []int{2, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeMemcache(t)
+			mock := useMockDB(t)
+			r := httptest.NewRequest(http.MethodGet, "/api/posts", nil)
+			if tt.viewer != nil {
+				r = withCookies(r, loginCookies(t, *tt.viewer, "token"))
+			}
+
+			mock.ExpectQuery(regexp.QuoteMeta("FROM `posts` WHERE `created_at` <= ? AND `status` = 'published'")).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "body", "mime", "created_at"}).
+					AddRow(2, 2, "shadow", "", time.Now()).
+					AddRow(1, 1, "normal", "", time.Now().Add(-time.Minute)))
+			expectMakePostsCounts(mock)
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM comments WHERE post_id IN")).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "post_id", "user_id", "comment", "created_at"}))
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users WHERE id IN")).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "account_name", "del_flg", "shadow_banned"}).
+					AddRow(1, "alice", 0, 0).
+					AddRow(2, "bob", 0, 1))
+			if tt.viewer != nil && tt.viewer.ShadowBanned != 0 {
+				mock.ExpectQuery(regexp.QuoteMeta("AND user_id = ? GROUP BY post_id")).
+					WillReturnRows(sqlmock.NewRows([]string{"post_id", "count"}))
+			}
+
+			w := httptest.NewRecorder()
+			getAPIPosts(w, r)
+			res := struct {
+				Posts []struct {
+					ID int `json:"id"`
+				} `json:"posts"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			got := []int{}
+			for _, p := range res.Posts {
+				got = append(got, p.ID)
+			}
+			if !equalInts(got, tt.want) {
+				t.Errorf("posts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 下書きの公開や公開予約で created_at とIDの順が入れ替わっていても、全ページをたどると漏れも重複も無い
+func TestAccountPostsPaging(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	alice := User{ID: 1, AccountName: "alice"}
+	data, _ := json.Marshal(alice)
+	memcacheClient.Set(&memcache.Item{Key: "user:1", Value: data})
+
+	// IDの小さい投稿ほど後から公開されたものが混じる。同じ時刻の投稿もある
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	const total = 50
+	posts := make([]Post, total)
+	for i := range posts {
+		id := i + 1
+		createdAt := base.Add(time.Duration(id) * time.Minute)
+		switch {
+		case id%7 == 0:
+			createdAt = base.Add(time.Duration(total+id) * time.Minute)
+		case id%5 == 0:
+			createdAt = base.Add(time.Duration(id-1) * time.Minute)
+		}
+		posts[i] = Post{ID: id, UserID: alice.ID, Body: fmt.Sprintf("post %d", id), CreatedAt: createdAt}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].CreatedAt.Equal(posts[j].CreatedAt) {
+			return posts[i].CreatedAt.After(posts[j].CreatedAt)
+		}
+		return posts[i].ID > posts[j].ID
+	})
+
+	postRows := func(ps []Post) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "user_id", "body", "mime", "created_at", "image_alt", "lang", "blurhash", "quoted_post_id", "quote_count", "view_count"})
+		for _, p := range ps {
+			rows.AddRow(p.ID, p.UserID, p.Body, "", p.CreatedAt, "", "", "", nil, 0, 0)
+		}
+		return rows
+	}
+	pages := (total + postsPerPage - 1) / postsPerPage
+	counted := map[int]bool{}
+	for page := 0; page < pages; page++ {
+		start := page * postsPerPage
+		rest := posts[start:min(start+40, total)]
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `users` WHERE `account_name` = ?")).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "account_name", "del_flg"}).AddRow(alice.ID, alice.AccountName, 0))
+		if page == 0 {
+			mock.ExpectQuery(regexp.QuoteMeta("WHERE `user_id` = ? AND `status` = 'published' ORDER BY `created_at` DESC, `id` DESC LIMIT 40")).
+				WithArgs(alice.ID).
+				WillReturnRows(postRows(rest))
+		} else {
+			cursor := posts[start-1]
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT `created_at` FROM `posts` WHERE `id` = ? AND `user_id` = ?")).
+				WithArgs(cursor.ID, alice.ID).
+				WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(cursor.CreatedAt))
+			mock.ExpectQuery(regexp.QuoteMeta("AND (`created_at` < ? OR (`created_at` = ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT 40")).
+				WithArgs(alice.ID, sameTime(cursor.CreatedAt), sameTime(cursor.CreatedAt), cursor.ID).
+				WillReturnRows(postRows(rest))
+		}
+		// カウンタはキャッシュされるので、前のページで数えていない投稿があるときだけ数える
+		if !counted[rest[len(rest)-1].ID] {
+			expectMakePostsCounts(mock)
+			for _, p := range rest {
+				counted[p.ID] = true
+			}
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM comments WHERE post_id IN")).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "post_id", "user_id", "comment", "created_at"}))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM `posts` WHERE `user_id` = ?")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(total))
+	}
+
+	seen := map[int]bool{}
+	got := []int{}
+	beforeID := 0
+	for page := 0; page < pages+1; page++ {
+		target := "/@alice/posts.json"
+		if beforeID > 0 {
+			target += "?before_id=" + strconv.Itoa(beforeID)
+		}
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.SetPathValue("accountName", alice.AccountName)
+		w := httptest.NewRecorder()
+		getAccountPostsJSON(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d: status = %d", page, w.Code)
+		}
+
+		var res struct {
+			Posts []struct {
+				ID int `json:"id"`
+			} `json:"posts"`
+			NextBeforeID int `json:"next_before_id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range res.Posts {
+			if seen[p.ID] {
+				t.Errorf("post %d appears twice", p.ID)
+			}
+			seen[p.ID] = true
+			got = append(got, p.ID)
+		}
+		if res.NextBeforeID == 0 {
+			break
+		}
+		beforeID = res.NextBeforeID
+	}
+
+	want := make([]int, total)
+	for i, p := range posts {
+		want[i] = p.ID
+	}
+	if !equalInts(got, want) {
+		t.Errorf("posts over all pages = %v, want %v", got, want)
+	}
+}
+
+func TestAccountPostsPageDeletedCursor(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `created_at` FROM `posts` WHERE `id` = ? AND `user_id` = ?")).
+		WithArgs(10, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+
+	posts, err := accountPostsPage(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 0 {
+		t.Errorf("got %d posts after a deleted cursor, want none", len(posts))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	archiveImageDir = "../public/image_archive"
+)
+
+var (
+	// これより古い投稿をアーカイブする
+	archiveAfter = 365 * 24 * time.Hour
+	// 1回に移す件数と、次の回までの間隔（DBとディスクの負荷を抑える）
+	archiveBatchSize     = 500
+	archiveBatchInterval = 100 * time.Millisecond
+	// 定期実行の間隔。0なら定期実行しない（-archive で手動実行する）
+	archiveInterval time.Duration
+)
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_ARCHIVE_AFTER")); err == nil && d > 0 {
+		archiveAfter = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_ARCHIVE_BATCH_SIZE")); err == nil && n > 0 {
+		archiveBatchSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_ARCHIVE_INTERVAL")); err == nil && d > 0 {
+		archiveInterval = d
+	}
+}
+
+// archiveImagePath はアーカイブした投稿の画像の保存先を返す
+func archiveImagePath(p Post) string {
+	return filepath.Join(archiveImageDir, filepath.Base(staticFilePath(p)))
+}
+
+// archiveOldPosts は古い公開済みの投稿を posts_archive に移し、画像もアーカイブ用のディレクトリに移す。
+// 途中で止まっても、もう一度実行すれば続きから同じ結果になるよう、
+// 行のコピー・画像の移動・元の行の削除の順に行い、それぞれ既に済んでいれば何もしない。
+func archiveOldPosts() (int, error) {
+	if err := os.MkdirAll(archiveImageDir, 0755); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for {
+		cutoff := time.Now().Add(-archiveAfter)
+		posts := []Post{}
+		err := db.Select(&posts, "SELECT `id`, `mime` FROM `posts` WHERE `status` = 'published' AND `created_at` < ? ORDER BY `id` LIMIT ?", cutoff, archiveBatchSize)
+		if err != nil {
+			return total, err
+		}
+		if len(posts) == 0 {
+			return total, nil
+		}
+
+		ids := make([]int, len(posts))
+		for i, p := range posts {
+			ids[i] = p.ID
+		}
+
+		if _, err := execIn("INSERT IGNORE INTO `posts_archive` SELECT * FROM `posts` WHERE `id` IN (?)", ids); err != nil {
+			return total, err
+		}
+
+		for _, p := range posts {
+			if p.Mime == "" {
+				continue
+			}
+			if err := os.Rename(staticFilePath(p), archiveImagePath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return total, err
+			}
+		}
+
+		// コピーできた行だけ消す
+		n, err := execIn("DELETE FROM `posts` WHERE `id` IN (?) AND `id` IN (SELECT `id` FROM `posts_archive`)", ids)
+		if err != nil {
+			return total, err
+		}
+		total += n
+
+		// アーカイブした投稿は検索の対象にもしない
+		for _, id := range ids {
+			deleteFromIndex(id)
+		}
+
+		time.Sleep(archiveBatchInterval)
+	}
+}
+
+// runArchiveTicker は ISUCONP_ARCHIVE_INTERVAL ごとに古い投稿をアーカイブする
+func runArchiveTicker() {
+	if archiveInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := archiveOldPosts()
+		if err != nil {
+			log.Print(err)
+		}
+		if n > 0 {
+			log.Printf("archived %d posts", n)
+			bumpCacheGeneration()
+		}
+	}
+}
+
+// getArchivedPost はアーカイブした投稿を返す。見つからなければ ok が false
+func getArchivedPost(pid int) (Post, bool) {
+	post := Post{}
+	err := db.Get(&post, "SELECT * FROM `posts_archive` WHERE `id` = ?", pid)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		return Post{}, false
+	}
+	return post, true
+}
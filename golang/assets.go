@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// style.abc12345.css のように内容のハッシュを含むファイル名
+	hashedAssetPattern = regexp.MustCompile(`\.[0-9a-f]{8,}\.[0-9A-Za-z]+$`)
+
+	// ハッシュの無いファイルは内容が変わりうるので短めにキャッシュする
+	staticMaxAge = 5 * time.Minute
+
+	assetManifestPath = "../public/assets-manifest.json"
+	// 元のパスからハッシュ付きのパスへの対応（/css/style.css → /css/style.abc12345.css）
+	assetManifest = map[string]string{}
+)
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_STATIC_MAX_AGE")); err == nil && d >= 0 {
+		staticMaxAge = d
+	}
+	if p := os.Getenv("ISUCONP_ASSET_MANIFEST"); p != "" {
+		assetManifestPath = p
+	}
+}
+
+// loadAssetManifest はビルド時に生成したアセットマニフェストを読み込む。
+// マニフェストが無ければハッシュ無しのパスをそのまま使う。
+func loadAssetManifest() {
+	data, err := os.ReadFile(assetManifestPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Print(err)
+		}
+		return
+	}
+
+	m := map[string]string{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Print(err)
+		return
+	}
+
+	// マニフェストは先頭の / を付けずに書かれていてもよい
+	manifest := make(map[string]string, len(m))
+	for k, v := range m {
+		manifest["/"+strings.TrimPrefix(k, "/")] = "/" + strings.TrimPrefix(v, "/")
+	}
+	assetManifest = manifest
+}
+
+// asset はテンプレートから参照するアセットのパスを返す
+func asset(p string) string {
+	if hashed, ok := assetManifest[p]; ok {
+		return hashed
+	}
+	return p
+}
+
+// staticCacheControl は静的ファイルにキャッシュヘッダを付ける。
+// ハッシュ付きのファイル名は内容が変わらないので長期間のimmutableにする。
+// 画像は専用のハンドラで配信するのでここでは扱わない。
+func staticCacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheControl := "public, max-age=" + strconv.Itoa(int(staticMaxAge/time.Second))
+		if hashedAssetPattern.MatchString(r.URL.Path) {
+			cacheControl = "public, max-age=31536000, immutable"
+		}
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: cacheControl}, r)
+	})
+}
+
+// cacheControlWriter は404などのエラーをキャッシュさせないよう、成功したときだけヘッダを付ける
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusNotModified || code == http.StatusPartialContent {
+			w.Header().Set("Cache-Control", w.value)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// 自動保存できる本文などの合計の最大バイト数
+	autosaveMaxBytes = 64 * 1024
+)
+
+// 自動保存したフォームの内容を残しておく秒数
+var autosaveTTL int32 = 30 * 60
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_AUTOSAVE_TTL")); err == nil && d > 0 {
+		autosaveTTL = int32(d.Seconds())
+	}
+}
+
+// autosave は投稿フォームの入力途中の内容。画像は含めない
+type autosave struct {
+	Body     string    `json:"body"`
+	ImageAlt string    `json:"image_alt"`
+	SavedAt  time.Time `json:"saved_at"`
+}
+
+func autosaveKey(userID int) string {
+	return fmt.Sprintf("autosave:%d", userID)
+}
+
+// clearAutosave は投稿できたときに自動保存した内容を消す
+func clearAutosave(userID int) {
+	if err := memcacheClient.Delete(autosaveKey(userID)); err != nil && err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+}
+
+// getAPIDraftAutosave は自動保存した内容を返す。無ければ204。
+// saved_at を返すので、クライアントは手元の入力より古ければ復元しないようにできる。
+func getAPIDraftAutosave(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	item, err := memcacheClient.Get(autosaveKey(me.ID))
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var saved autosave
+	if err := json.Unmarshal(item.Value, &saved); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, saved)
+}
+
+// putAPIDraftAutosave は投稿フォームの入力途中の内容を保存する。
+// 複数のタブから保存された場合は最後に保存したものが残る。
+func putAPIDraftAutosave(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !validCSRFHeader(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	var req struct {
+		Body     string `json:"body"`
+		ImageAlt string `json:"image_alt"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, autosaveMaxBytes)).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	saved := autosave{
+		Body:     normalizeText(req.Body),
+		ImageAlt: normalizeText(req.ImageAlt),
+		SavedAt:  time.Now(),
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := memcacheClient.Set(&memcache.Item{Key: autosaveKey(me.ID), Value: data, Expiration: autosaveTTL}); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"saved_at": saved.SavedAt})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DBのコネクションプールが埋まりかけているときは書き込み系のリクエストを503で断り、
+// 読み取り系のリクエストにコネクションを回す。プールに余裕が戻れば自動的に受け付けを再開する。
+// 使用率はプールの上限（ISUCONP_DB_MAX_OPEN_CONNS）に対する割合なので、上限を設定していないときは働かない。
+
+var (
+	// 1なら書き込み系のリクエストにバックプレッシャーをかける
+	backpressureEnabled = os.Getenv("ISUCONP_BACKPRESSURE") == "1"
+	// プールの使用率（%）がこれ以上なら書き込みを断る
+	backpressureThreshold = 90
+	// プールの状態を調べる間隔
+	backpressureInterval = 500 * time.Millisecond
+	// 断るときに Retry-After で伝える秒数
+	backpressureRetryAfter = 5
+)
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_BACKPRESSURE_THRESHOLD")); err == nil && n > 0 && n <= 100 {
+		backpressureThreshold = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_BACKPRESSURE_INTERVAL")); err == nil && d > 0 {
+		backpressureInterval = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_BACKPRESSURE_RETRY_AFTER")); err == nil && n > 0 {
+		backpressureRetryAfter = n
+	}
+}
+
+// backpressureState は最後に調べたプールの状態
+type backpressureState struct {
+	Enabled     bool  `json:"enabled"`
+	Active      bool  `json:"active"` // 書き込みを断っている
+	InUse       int   `json:"in_use"`
+	MaxOpen     int   `json:"max_open"`
+	UsagePct    int   `json:"usage_pct"`
+	WaitCount   int64 `json:"wait_count"`
+	Activations int64 `json:"activations"` // 書き込みを断り始めた回数
+}
+
+var (
+	backpressureMu sync.RWMutex
+	backpressure   = backpressureState{Enabled: backpressureEnabled}
+
+	// /debug/vars で確認できる、バックプレッシャーで断ったリクエスト数（ハンドラ別）
+	backpressureRejected = expvar.NewMap("backpressure_rejected")
+)
+
+func init() {
+	expvar.Publish("backpressure", expvar.Func(func() any {
+		backpressureMu.RLock()
+		defer backpressureMu.RUnlock()
+		return backpressure
+	}))
+}
+
+// backpressureActive は書き込みを断るべきときに true を返す
+func backpressureActive() bool {
+	backpressureMu.RLock()
+	defer backpressureMu.RUnlock()
+	return backpressure.Active
+}
+
+// updateBackpressure はプールの状態から書き込みを断るかを決める。
+// 前回から接続待ちが発生していれば、調べた瞬間の使用率が低くてもプールは埋まっていたとみなす
+func updateBackpressure(lastWaitCount int64) int64 {
+	st := db.Stats()
+	usage := st.InUse * 100 / st.MaxOpenConnections
+	active := usage >= backpressureThreshold || st.WaitCount > lastWaitCount
+
+	backpressureMu.Lock()
+	defer backpressureMu.Unlock()
+	if active != backpressure.Active {
+		if active {
+			backpressure.Activations++
+			log.Printf("backpressure: rejecting writes (in use %d/%d, wait count %d)", st.InUse, st.MaxOpenConnections, st.WaitCount)
+		} else {
+			log.Printf("backpressure: accepting writes (in use %d/%d)", st.InUse, st.MaxOpenConnections)
+		}
+	}
+	backpressure.Active = active
+	backpressure.InUse = st.InUse
+	backpressure.MaxOpen = st.MaxOpenConnections
+	backpressure.UsagePct = usage
+	backpressure.WaitCount = st.WaitCount
+	return st.WaitCount
+}
+
+// runBackpressureMonitor は一定間隔でプールの状態を調べる
+func runBackpressureMonitor() {
+	if !backpressureEnabled {
+		return
+	}
+	if db.Stats().MaxOpenConnections == 0 {
+		log.Print("backpressure: ISUCONP_DB_MAX_OPEN_CONNS is not set, so the pool usage cannot be measured")
+		return
+	}
+
+	lastWaitCount := db.Stats().WaitCount
+	ticker := time.NewTicker(backpressureInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		lastWaitCount = updateBackpressure(lastWaitCount)
+	}
+}
+
+// writeBackpressure はプールが埋まりかけている間、書き込み系のハンドラへのリクエストを503で断るミドルウェア
+func writeBackpressure(handler string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if backpressureActive() {
+				backpressureRejected.Add(handler, 1)
+				w.Header().Set("Retry-After", strconv.Itoa(backpressureRetryAfter))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// プレースホルダ画像の長辺のピクセル数
+	blurhashSize = 16
+	// 生成待ちのキューの長さ（溢れた分は後埋めバッチで生成する）
+	blurhashQueueSize = 1024
+	// 後埋めバッチで1回に取得する投稿数
+	blurhashBackfillBatch = 100
+)
+
+// 画像読み込み中に表示する極小プレースホルダ（LQIP）の生成依頼
+type blurhashJob struct {
+	PostID      int
+	Ext         string
+	AccountName string
+}
+
+var blurhashQueue = make(chan blurhashJob, blurhashQueueSize)
+
+// enqueueBlurhash はプレースホルダの生成を依頼する。アップロードをブロックしないよう
+// キューが一杯のときは諦める。
+func enqueueBlurhash(pid int, ext, accountName string) {
+	select {
+	case blurhashQueue <- blurhashJob{PostID: pid, Ext: ext, AccountName: accountName}:
+	default:
+		log.Printf("blurhash queue is full, skip post %d", pid)
+	}
+}
+
+// runBlurhashWorker はキューに入った画像のプレースホルダを順に生成して保存する
+func runBlurhashWorker() {
+	for job := range blurhashQueue {
+		if err := saveBlurhash(job.PostID, job.Ext); err != nil {
+			log.Print(err)
+			continue
+		}
+		invalidateIndexPosts()
+		memcacheClient.Delete(fmt.Sprintf("account:%s", job.AccountName))
+	}
+}
+
+func saveBlurhash(pid int, ext string) error {
+	filePath, err := localImageFile(pid, ext)
+	if err != nil {
+		return fmt.Errorf("blurhash of post %d: %w", pid, err)
+	}
+	hash, err := generateBlurhash(filePath)
+	if err != nil {
+		return fmt.Errorf("blurhash of post %d: %w", pid, err)
+	}
+	_, err = db.Exec("UPDATE `posts` SET `blurhash` = ? WHERE `id` = ?", hash, pid)
+	return err
+}
+
+// generateBlurhash は画像を縮小したPNGをbase64で返す。gifは先頭フレームから生成する。
+func generateBlurhash(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// image.Decode はアニメーションgifでも先頭フレームを返す
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, shrinkImage(src, blurhashSize)); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// shrinkImage は長辺が size になるよう、各ピクセルを元画像の範囲の平均色で縮小する
+func shrinkImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, size*b.Dy()/b.Dx())
+	} else {
+		w = max(1, size*b.Dx()/b.Dy())
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// RGBA() はアルファ乗算済みなので、非乗算の NRGBA に戻す
+			c := color.NRGBA{A: uint8(a / n >> 8)}
+			if a > 0 {
+				c.R = uint8(r * 0xffff / a >> 8)
+				c.G = uint8(g * 0xffff / a >> 8)
+				c.B = uint8(bl * 0xffff / a >> 8)
+			}
+			dst.SetNRGBA(x, y, c)
+		}
+	}
+	return dst
+}
+
+// blurhashURI はプレースホルダをCSSの url() に使えるdata URIにする
+func blurhashURI(hash string) template.URL {
+	if hash == "" || strings.ContainsAny(hash, "\"'()\\ ") {
+		return ""
+	}
+	return template.URL("data:image/png;base64," + hash)
+}
+
+// backfillBlurhash はプレースホルダが未生成の既存投稿について生成する
+func backfillBlurhash() error {
+	lastID := 0
+	for {
+		posts := []Post{}
+		err := db.Select(&posts, "SELECT `id`, `mime` FROM `posts` WHERE `id` > ? AND `blurhash` = '' AND `mime` != '' ORDER BY `id` LIMIT ?", lastID, blurhashBackfillBatch)
+		if err != nil {
+			return err
+		}
+		if len(posts) == 0 {
+			break
+		}
+
+		for _, p := range posts {
+			lastID = p.ID
+			if err := saveBlurhash(p.ID, imageExt(p)); err != nil {
+				log.Print(err)
+			}
+		}
+		log.Printf("backfill blurhash: done up to post %d", lastID)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// S3などの配信元を使っていてローカルに画像が無くても、配信元から取ってきてプレースホルダを生成する
+func TestSaveBlurhashRemoteStore(t *testing.T) {
+	mock := useMockDB(t)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	useRemoteImageStore(t, 5, "png", buf.Bytes())
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `posts` SET `blurhash` = ? WHERE `id` = ?")).
+		WithArgs(sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := saveBlurhash(5, "png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSaveBlurhashMissingImage(t *testing.T) {
+	useMockDB(t)
+	useRemoteImageStore(t, 5, "png", nil)
+
+	if err := saveBlurhash(6, "png"); err == nil {
+		t.Error("saveBlurhash of a missing image succeeded")
+	}
+}
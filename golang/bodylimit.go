@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// FormFile が使うのと同じメモリ上限（超えた分は一時ファイルに書かれる）
+const multipartMaxMemory = 32 << 20
+
+var (
+	// 画像を受け取らないリクエストのボディの上限
+	maxBodySize int64 = 1024 * 1024
+	// 画像を受け取るリクエストのボディの上限。画像本体に本文などのフィールドとmultipartの境界の分を足す
+	maxUploadBodySize int64 = UploadLimit + 1024*1024
+)
+
+// 画像を受け取るルート。ここに無いルートは maxBodySize までしか受け付けない
+var uploadRoutes = map[string]bool{
+	"POST /":                      true,
+	"POST /posts/draft":           true,
+	"POST /api/upload":            true,
+	"POST /api/upload/chunk":      true,
+	"POST /api/posts/{id}/commit": true,
+}
+
+func init() {
+	if n, err := strconv.ParseInt(os.Getenv("ISUCONP_MAX_BODY_SIZE"), 10, 64); err == nil && n > 0 {
+		maxBodySize = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("ISUCONP_MAX_UPLOAD_BODY_SIZE"), 10, 64); err == nil && n > 0 {
+		maxUploadBodySize = n
+	}
+}
+
+// bodyLimitFor はリクエストが当たるルートのボディの上限を返す
+func bodyLimitFor(mux *chi.Mux, r *http.Request) int64 {
+	pattern := mux.Find(chi.NewRouteContext(), r.Method, r.URL.Path)
+	switch {
+	case uploadRoutes[r.Method+" "+pattern]:
+		return maxUploadBodySize
+	case r.Method == http.MethodPost && pattern == "/api/admin/bulk":
+		// 一括投入はハンドラ側で bulkMaxBytes に制限している
+		return bulkMaxBytes
+	}
+	return maxBodySize
+}
+
+// limitRequestBody は全リクエストのボディの大きさを制限し、超えたら413を返す。
+// ハンドラは FormValue・FormFile でパースのエラーを無視してしまうので、
+// フォームはここで先にパースして上限を超えたかどうかを確かめる。
+func limitRequestBody(mux *chi.Mux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limit := bodyLimitFor(mux, r)
+			if r.ContentLength > limit {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+			var err error
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			switch mediaType {
+			case "multipart/form-data":
+				err = r.ParseMultipartForm(multipartMaxMemory)
+			case "application/x-www-form-urlencoded":
+				err = r.ParseForm()
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// useBodyLimits はテストの間だけボディの上限を小さくする
+func useBodyLimits(t *testing.T, body, upload int64) {
+	t.Helper()
+	oldBody, oldUpload := maxBodySize, maxUploadBodySize
+	maxBodySize, maxUploadBodySize = body, upload
+	t.Cleanup(func() { maxBodySize, maxUploadBodySize = oldBody, oldUpload })
+}
+
+// bodyLimitMux は受け取ったフォームの body を返すハンドラを、画像を受け取るルートと受け取らないルートに置く
+func bodyLimitMux() *chi.Mux {
+	mux := chi.NewRouter()
+	mux.Use(limitRequestBody(mux))
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.FormValue("body")))
+	}
+	mux.Post("/", echo)
+	mux.Post("/comment", echo)
+	return mux
+}
+
+func formBody(size int) string {
+	return url.Values{"body": {strings.Repeat("a", size)}}.Encode()
+}
+
+func multipartBody(t *testing.T, size int) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("body", "text")
+	fw, err := mw.CreateFormFile("file", "a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte{0xff}, size))
+	mw.Close()
+	return buf.String(), mw.FormDataContentType()
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	useBodyLimits(t, 1024, 8192)
+	mux := bodyLimitMux()
+
+	tests := []struct {
+		name          string
+		path          string
+		body          string
+		contentType   string
+		unknownLength bool
+		want          int
+	}{
+		{"上限以下のフォーム", "/comment", formBody(100), "application/x-www-form-urlencoded", false, http.StatusOK},
+		{"Content-Lengthが上限を超える", "/comment", formBody(2000), "application/x-www-form-urlencoded", false, http.StatusRequestEntityTooLarge},
+		// Content-Lengthが無くてもパースの途中で上限を超えれば413
+		{"長さ不明で上限を超えるフォーム", "/comment", formBody(2000), "application/x-www-form-urlencoded", true, http.StatusRequestEntityTooLarge},
+		{"画像を受け取らないルートへのmultipart", "/comment", "", "", true, http.StatusRequestEntityTooLarge},
+		{"画像を受け取るルートは大きい上限", "/", "", "", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := tt.body, tt.contentType
+			if body == "" {
+				body, contentType = multipartBody(t, 4096)
+			}
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			if tt.unknownLength {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitRequestBodyUploadLimit(t *testing.T) {
+	useBodyLimits(t, 1024, 8192)
+	mux := bodyLimitMux()
+
+	// 画像を受け取るルートでも maxUploadBodySize を超えれば413
+	body, contentType := multipartBody(t, 10000)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", w.Code)
+	}
+
+	// 上限以内ならハンドラまで届き、フォームが読める
+	body, contentType = multipartBody(t, 4096)
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "text" {
+		t.Errorf("status = %d, body = %q, want 200 with the form value", w.Code, w.Body.String())
+	}
+}
+
+func TestBodyLimitFor(t *testing.T) {
+	mux := chi.NewRouter()
+	h := func(w http.ResponseWriter, r *http.Request) {}
+	mux.Post("/", h)
+	mux.Post("/comment", h)
+	mux.Post("/api/posts/{id}/commit", h)
+	mux.Post("/api/admin/bulk", h)
+
+	tests := []struct {
+		path string
+		want int64
+	}{
+		{"/", maxUploadBodySize},
+		{"/api/posts/12/commit", maxUploadBodySize},
+		{"/comment", maxBodySize},
+		{"/api/admin/bulk", bulkMaxBytes},
+	}
+	for _, tt := range tests {
+		if got := bodyLimitFor(mux, httptest.NewRequest(http.MethodPost, tt.path, nil)); got != tt.want {
+			t.Errorf("bodyLimitFor(POST %s) = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// botに返すための前回キャッシュの有効期限
+	staleCacheTTL = 3600
+)
+
+var (
+	botUAPattern = regexp.MustCompile(`(?i)bot|crawler|spider`)
+
+	// /debug/vars で確認できるbotアクセス数（ハンドラ別、キャッシュミス時は *_cache_miss）
+	botRequests = expvar.NewMap("bot_requests")
+)
+
+func init() {
+	if p := os.Getenv("ISUCONP_BOT_UA_PATTERN"); p != "" {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			log.Printf("invalid ISUCONP_BOT_UA_PATTERN: %s", err)
+		} else {
+			botUAPattern = re
+		}
+	}
+}
+
+// isBotRequest はUser-Agentからクローラかを判定し、ハンドラ別にアクセス数を記録する
+func isBotRequest(r *http.Request, handler string) bool {
+	if !botUAPattern.MatchString(r.UserAgent()) {
+		return false
+	}
+	botRequests.Add(handler, 1)
+	return true
+}
+
+// setCacheWithStale はキャッシュと同時に、botに返すための長寿命のコピーを保存する
+func setCacheWithStale(key string, data []byte, ttl int32) {
+	memcacheClient.Set(&memcache.Item{
+		Key:        key,
+		Value:      data,
+		Expiration: ttl,
+	})
+	memcacheClient.Set(&memcache.Item{
+		Key:        "stale:" + key,
+		Value:      data,
+		Expiration: staleCacheTTL,
+	})
+}
+
+// getStaleCache は前回のキャッシュを v に読み込む。無ければ false を返す
+func getStaleCache(key string, v interface{}) bool {
+	item, err := memcacheClient.Get("stale:" + key)
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(item.Value, v); err != nil {
+		log.Print("Failed to unmarshal stale cache:", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const testBotUA = "Mozilla/5.0 (compatible; Googlebot/2.1)"
+
+// botCount は /debug/vars の bot_requests の値を返す
+func botCount(key string) int64 {
+	v, ok := botRequests.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func botRequest(target string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("User-Agent", testBotUA)
+	return r
+}
+
+// キャッシュにヒットしたbotのアクセスも数える
+func TestBotRequestsCountedOnCacheHit(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+
+	memcacheClient.Set(&memcache.Item{Key: "latest_post_id", Value: []byte("5")})
+	setIndexPostsCache(t, 5, []Post{{ID: 5, UserID: 2, Body: "キャッシュ済みの投稿", CreatedAt: time.Now(), User: User{ID: 2, AccountName: "alice"}}})
+
+	index, miss := botCount("index"), botCount("index_cache_miss")
+	w := httptest.NewRecorder()
+	getIndex(w, botRequest("/"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "キャッシュ済みの投稿") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := botCount("index") - index; got != 1 {
+		t.Errorf("index count increased by %d, want 1", got)
+	}
+	if got := botCount("index_cache_miss") - miss; got != 0 {
+		t.Errorf("index_cache_miss count increased by %d, want 0", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// キャッシュの無いページでもbotにはDBを引かずに投稿の無いページを返す
+func TestBotAccountWithoutCache(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+
+	account, miss := botCount("account"), botCount("account_cache_miss")
+	for _, target := range []string{"/@alice", "/@alice?before_id=10"} {
+		r := botRequest(target)
+		r.SetPathValue("accountName", "alice")
+		w := httptest.NewRecorder()
+		getAccountName(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", target, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "aliceさん") {
+			t.Errorf("%s: account name is not shown: %s", target, w.Body.String())
+		}
+	}
+	if got := botCount("account") - account; got != 2 {
+		t.Errorf("account count increased by %d, want 2", got)
+	}
+	if got := botCount("account_cache_miss") - miss; got != 2 {
+		t.Errorf("account_cache_miss count increased by %d, want 2", got)
+	}
+}
+
+func TestBotPostsEmpty(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+
+	posts := botCount("posts")
+	w := httptest.NewRecorder()
+	getPosts(w, botRequest("/posts?max_created_at="+url.QueryEscape(time.Now().Format(ISO8601Format))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "" {
+		t.Errorf("Retry-After = %q, want none", w.Header().Get("Retry-After"))
+	}
+	if strings.Contains(w.Body.String(), `class="isu-post"`) {
+		t.Errorf("posts are returned to a bot: %s", w.Body.String())
+	}
+	if got := botCount("posts") - posts; got != 1 {
+		t.Errorf("posts count increased by %d, want 1", got)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	bulkItemPost    = "post"
+	bulkItemComment = "comment"
+
+	// バッチのリクエストボディの上限
+	bulkMaxBytes = 16 * 1024 * 1024
+)
+
+var (
+	// 1リクエストで作成できる投稿・コメントの合計件数
+	bulkMaxItems = 1000
+	// 1なら移行モード。移行元の created_at を指定できる
+	bulkMigrationMode = os.Getenv("ISUCONP_BULK_MIGRATION") == "1"
+	// 移行モードで指定できる created_at の下限
+	bulkMinCreatedAt = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_BULK_MAX_ITEMS")); err == nil && n > 0 {
+		bulkMaxItems = n
+	}
+	if v := os.Getenv("ISUCONP_BULK_MIN_CREATED_AT"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			bulkMinCreatedAt = t
+		} else {
+			log.Printf("invalid ISUCONP_BULK_MIN_CREATED_AT: %s", v)
+		}
+	}
+}
+
+// バッチで作成する投稿またはコメント。画像の無いテキストの投稿だけを作成できる
+type bulkItem struct {
+	Type      string     `json:"type"`
+	UserID    int        `json:"user_id"`
+	Body      string     `json:"body"`    // 投稿の本文
+	PostID    int        `json:"post_id"` // コメント先の投稿
+	Comment   string     `json:"comment"`
+	CreatedAt *time.Time `json:"created_at"` // 移行元の作成日時。移行モードでだけ指定できる（省略時は現在時刻）
+}
+
+type bulkPostRow struct {
+	UserID    int       `db:"user_id"`
+	Body      string    `db:"body"`
+	Lang      string    `db:"lang"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type bulkCommentRow struct {
+	PostID    int       `db:"post_id"`
+	UserID    int       `db:"user_id"`
+	Comment   string    `db:"comment"`
+	Lang      string    `db:"lang"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// bulkError は失敗した要素の位置を返す。位置が特定できない失敗は index を省く
+type bulkError struct {
+	Index *int   `json:"index,omitempty"`
+	Error string `json:"error"`
+}
+
+func writeBulkError(w http.ResponseWriter, status int, index int, msg string) {
+	e := bulkError{Error: msg}
+	if index >= 0 {
+		e.Index = &index
+	}
+	writeJSON(w, status, e)
+}
+
+// bulkCreatedAt は要素の作成日時を決める。created_at はサーバーが決めるのが原則で、
+// 移行モードのときだけ bulkMinCreatedAt から現在時刻（時計のずれは許容する）までの移行元の値を使う
+func bulkCreatedAt(v *time.Time, now time.Time) (time.Time, error) {
+	if v == nil {
+		return now, nil
+	}
+	if !bulkMigrationMode {
+		return time.Time{}, errors.New("created_atは移行モード（ISUCONP_BULK_MIGRATION=1）でだけ指定できます")
+	}
+	if v.Before(bulkMinCreatedAt) || v.After(now.Add(cursorFutureTolerance)) {
+		return time.Time{}, fmt.Errorf("created_atは%sから現在までの日時にしてください", bulkMinCreatedAt.Format(time.RFC3339))
+	}
+	return v.Truncate(time.Microsecond), nil
+}
+
+// postAPIAdminBulk はデータ移行用に投稿・コメントをまとめて作成する。
+// すべての要素を1トランザクションで作成し、1件でも失敗すれば何も作成しない。
+func postAPIAdminBulk(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	if !validCSRFHeader(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	items := []bulkItem{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, bulkMaxBytes))
+	if err := dec.Decode(&items); err != nil {
+		writeBulkError(w, http.StatusBadRequest, -1, "JSONの配列を送ってください")
+		return
+	}
+	if len(items) == 0 {
+		writeJSON(w, http.StatusOK, map[string]int{"posts": 0, "comments": 0})
+		return
+	}
+	if len(items) > bulkMaxItems {
+		writeBulkError(w, http.StatusRequestEntityTooLarge, -1, fmt.Sprintf("1回に作成できるのは%d件までです", bulkMaxItems))
+		return
+	}
+
+	now := time.Now()
+	posts := []bulkPostRow{}
+	comments := []bulkCommentRow{}
+	userIDs := map[int]int{} // ユーザーID → 最初に使われた要素の位置
+	commentPostIDs := map[int]int{}
+	for i, it := range items {
+		createdAt, err := bulkCreatedAt(it.CreatedAt, now)
+		if err != nil {
+			writeBulkError(w, http.StatusBadRequest, i, err.Error())
+			return
+		}
+		if _, ok := userIDs[it.UserID]; !ok {
+			userIDs[it.UserID] = i
+		}
+
+		switch it.Type {
+		case bulkItemPost:
+			body := normalizeText(it.Body)
+			if strings.TrimSpace(body) == "" {
+				writeBulkError(w, http.StatusBadRequest, i, "本文が空です")
+				return
+			}
+			posts = append(posts, bulkPostRow{UserID: it.UserID, Body: body, Lang: detectLang(body), CreatedAt: createdAt})
+		case bulkItemComment:
+			comment := normalizeText(it.Comment)
+			if strings.TrimSpace(comment) == "" {
+				writeBulkError(w, http.StatusBadRequest, i, "コメントが空です")
+				return
+			}
+			if _, ok := commentPostIDs[it.PostID]; !ok {
+				commentPostIDs[it.PostID] = i
+			}
+			comments = append(comments, bulkCommentRow{PostID: it.PostID, UserID: it.UserID, Comment: comment, Lang: detectLang(comment), CreatedAt: createdAt})
+		default:
+			writeBulkError(w, http.StatusBadRequest, i, "typeは post か comment です")
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// 存在しないユーザー・投稿を参照している要素を特定して返す
+	if i, err := firstMissing(tx, "SELECT `id` FROM `users` WHERE `id` IN (?) AND `del_flg` = 0", userIDs); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if i >= 0 {
+		writeBulkError(w, http.StatusBadRequest, i, "ユーザーが存在しません")
+		return
+	}
+	if i, err := firstMissing(tx, "SELECT `id` FROM `posts` WHERE `id` IN (?) AND `status` = 'published'", commentPostIDs); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if i >= 0 {
+		writeBulkError(w, http.StatusBadRequest, i, "コメント先の投稿が存在しません")
+		return
+	}
+
+	firstPostID := int64(0)
+	if len(posts) > 0 {
+		result, err := tx.NamedExec(
+			"INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `lang`, `status`, `created_at`) "+
+				"VALUES (:user_id, '', '', :body, :lang, 'published', :created_at)", posts)
+		if err != nil {
+			log.Print(err)
+			writeBulkError(w, http.StatusInternalServerError, -1, "投稿を作成できませんでした")
+			return
+		}
+		// 複数VALUESのINSERTでは連番で採番され、最初のIDが返る
+		firstPostID, err = result.LastInsertId()
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(comments) > 0 {
+		_, err := tx.NamedExec(
+			"INSERT INTO `comments` (`post_id`, `user_id`, `comment`, `lang`, `created_at`) "+
+				"VALUES (:post_id, :user_id, :comment, :lang, :created_at)", comments)
+		if err != nil {
+			log.Print(err)
+			writeBulkError(w, http.StatusInternalServerError, -1, "コメントを作成できませんでした")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	postIDs := make([]int64, len(posts))
+	for i := range posts {
+		postIDs[i] = firstPostID + int64(i)
+		savePostTags(int(postIDs[i]), posts[i].Body)
+	}
+
+	// 作成した投稿・コメントがどの一覧に出るかは列挙しきれないので、世代を進めて一括で無効化する
+	memcacheClient.Delete("latest_post_id")
+	bumpCacheGeneration()
+
+	// 検索インデックスは件数が多いので後から順に作る
+	go func() {
+		indexed := map[int]bool{}
+		for _, id := range postIDs {
+			indexed[int(id)] = true
+			indexPost(int(id))
+		}
+		for _, c := range comments {
+			if !indexed[c.PostID] {
+				indexed[c.PostID] = true
+				indexPost(c.PostID)
+			}
+		}
+	}()
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"posts":    len(posts),
+		"comments": len(comments),
+		"post_ids": postIDs,
+	})
+}
+
+// firstMissing は ids（ID → 最初に参照した要素の位置）のうちクエリで見つからないものがあれば、
+// その要素の位置を返す。すべて見つかれば -1 を返す。
+func firstMissing(tx *sqlx.Tx, query string, ids map[int]int) (int, error) {
+	if len(ids) == 0 {
+		return -1, nil
+	}
+	list := make([]int, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+
+	q, args, err := sqlx.In(query, list)
+	if err != nil {
+		return -1, err
+	}
+	found := []int{}
+	if err := tx.Select(&found, tx.Rebind(q), args...); err != nil {
+		return -1, err
+	}
+	exists := make(map[int]bool, len(found))
+	for _, id := range found {
+		exists[id] = true
+	}
+
+	missing := -1
+	for id, i := range ids {
+		if !exists[id] && (missing < 0 || i < missing) {
+			missing = i
+		}
+	}
+	return missing, nil
+}
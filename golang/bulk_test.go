@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBulkCreatedAt(t *testing.T) {
+	now := time.Now()
+	at := func(t time.Time) *time.Time { return &t }
+
+	tests := []struct {
+		name      string
+		migration bool
+		v         *time.Time
+		want      time.Time
+		wantErr   bool
+	}{
+		{"省略すれば現在時刻", false, nil, now, false},
+		{"移行モードでも省略すれば現在時刻", true, nil, now, false},
+		{"移行モードでなければ指定できない", false, at(now.Add(-time.Hour)), time.Time{}, true},
+		{"移行元の日時", true, at(now.Add(-365 * 24 * time.Hour)), now.Add(-365 * 24 * time.Hour).Truncate(time.Microsecond), false},
+		{"下限ちょうど", true, at(bulkMinCreatedAt), bulkMinCreatedAt, false},
+		{"下限より前", true, at(bulkMinCreatedAt.Add(-time.Second)), time.Time{}, true},
+		{"ゼロ値", true, at(time.Time{}), time.Time{}, true},
+		{"時計のずれの範囲の未来", true, at(now.Add(cursorFutureTolerance - time.Second)), now.Add(cursorFutureTolerance - time.Second).Truncate(time.Microsecond), false},
+		{"大幅な未来", true, at(now.Add(cursorFutureTolerance + time.Second)), time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := bulkMigrationMode
+			bulkMigrationMode = tt.migration
+			t.Cleanup(func() { bulkMigrationMode = old })
+
+			got, err := bulkCreatedAt(tt.v, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bulkCreatedAt error = %v, want error %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("bulkCreatedAt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// 一覧のキャッシュの世代。キャッシュには生成時の世代を持たせ、世代が変わったものは使わない。
+// 大量のデータを入れたときなど、どのキーが影響を受けるか列挙できないときに世代を進めて一括で無効化する。
+const cacheGenerationKey = "cache_generation"
+
+// getCacheGeneration は現在の世代を返す。memcacheに無ければ0とする
+func getCacheGeneration() uint64 {
+	return getGeneration(cacheGenerationKey)
+}
+
+// bumpCacheGeneration は世代を進め、それまでの一覧のキャッシュをすべて無効にする
+func bumpCacheGeneration() {
+	if err := incrGeneration(cacheGenerationKey); err != nil {
+		// 世代を進められなくても、一覧のキャッシュはTTLで作り直される
+		invalidateIndexPosts()
+	}
+}
+
+// トップページの件数指定（?limit=）ごとの一覧のキャッシュの世代。キーに含めるので、進めると全件数分が一度に無効になる
+const indexPostsGenerationKey = "index_posts_generation"
+
+// indexPostsCacheKey はトップページの一覧のキャッシュキーを返す。
+// デフォルトの件数はウォーミングするので固定のキー、それ以外は件数と世代をキーに含める
+func indexPostsCacheKey(limit int) string {
+	if limit == postsPerPage {
+		return "index_posts"
+	}
+	return fmt.Sprintf("index_posts:%d:%d", limit, getGeneration(indexPostsGenerationKey))
+}
+
+// invalidateIndexPosts はトップページの一覧のキャッシュを件数指定のものも含めて無効にする
+func invalidateIndexPosts() {
+	invalidateCache("index_posts")
+	if err := incrGeneration(indexPostsGenerationKey); err != nil {
+		log.Print(err)
+	}
+}
+
+func getGeneration(key string) uint64 {
+	item, err := memcacheClient.Get(key)
+	if err != nil {
+		return 0
+	}
+	gen, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return gen
+}
+
+func incrGeneration(key string) error {
+	_, err := memcacheClient.Increment(key, 1)
+	if err == memcache.ErrCacheMiss {
+		// 消えていた場合は0として扱っていたので1にする（同時に作られたら進めなおす）
+		err = memcacheClient.Add(&memcache.Item{Key: key, Value: []byte("1")})
+		if err == memcache.ErrNotStored {
+			_, err = memcacheClient.Increment(key, 1)
+		}
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestInvalidateIndexPosts(t *testing.T) {
+	m := useFakeMemcache(t)
+
+	keys := []string{}
+	for _, limit := range []int{postsPerPage, 1, 50, maxPostsLimit} {
+		key := indexPostsCacheKey(limit)
+		keys = append(keys, key)
+		memcacheClient.Set(&memcache.Item{Key: key, Value: []byte("cached")})
+	}
+
+	invalidateIndexPosts()
+
+	if m.has("index_posts") {
+		t.Error("index_posts was not deleted")
+	}
+	// 件数指定のキャッシュは世代が進んだので、どの件数でも前のキャッシュを読まない
+	for i, limit := range []int{postsPerPage, 1, 50, maxPostsLimit} {
+		key := indexPostsCacheKey(limit)
+		if _, err := memcacheClient.Get(key); err != memcache.ErrCacheMiss {
+			t.Errorf("limit %d: cache %q (was %q) is still readable after invalidation", limit, key, keys[i])
+		}
+	}
+
+	// 世代のキーが消えていても進められる
+	memcacheClient.Delete(indexPostsGenerationKey)
+	before := indexPostsCacheKey(50)
+	invalidateIndexPosts()
+	if after := indexPostsCacheKey(50); after == before {
+		t.Errorf("cache key did not change: %q", after)
+	}
+}
+
+func TestBumpCacheGeneration(t *testing.T) {
+	useFakeMemcache(t)
+
+	if got := getCacheGeneration(); got != 0 {
+		t.Fatalf("initial generation = %d, want 0", got)
+	}
+	bumpCacheGeneration()
+	bumpCacheGeneration()
+	if got := getCacheGeneration(); got != 2 {
+		t.Errorf("generation = %d, want 2", got)
+	}
+}
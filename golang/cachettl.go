@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// この件数に満たない区間ではTTLを変えない（たまたまのアクセスで振れないように）
+	adaptiveTTLMinSamples = 10
+	// ヒット率がこれ以上で無効化が無ければTTLを延ばす
+	adaptiveTTLHitRate = 0.9
+)
+
+var (
+	// 1ならアクセス状況に応じてキャッシュのTTLを自動で調整する
+	adaptiveTTLEnabled = os.Getenv("ISUCONP_ADAPTIVE_TTL") == "1"
+	// 自動調整するTTLの下限と上限
+	adaptiveTTLMin = 10 * time.Second
+	adaptiveTTLMax = 10 * time.Minute
+	// TTLを見直す間隔
+	adaptiveTTLInterval = time.Minute
+)
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_ADAPTIVE_TTL_MIN")); err == nil && d >= time.Second {
+		adaptiveTTLMin = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_ADAPTIVE_TTL_MAX")); err == nil && d >= time.Second {
+		adaptiveTTLMax = d
+	}
+	if adaptiveTTLMax < adaptiveTTLMin {
+		adaptiveTTLMax = adaptiveTTLMin
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_ADAPTIVE_TTL_INTERVAL")); err == nil && d > 0 {
+		adaptiveTTLInterval = d
+	}
+}
+
+// cacheKeyStats はキャッシュキーの種類ごとの統計。window* は前回TTLを見直してからの数
+type cacheKeyStats struct {
+	hits          uint64
+	misses        uint64
+	invalidations uint64
+
+	windowHits          uint64
+	windowMisses        uint64
+	windowInvalidations uint64
+
+	ttl int32 // 現在のTTL（秒）。0ならまだ使われていない
+}
+
+var (
+	cacheStatsMu sync.Mutex
+	cacheStats   = map[string]*cacheKeyStats{}
+)
+
+// cacheFamily はキャッシュキーから集計に使う種類を取り出す。
+// index_posts:20 や account:foo のような派生キーは ":" より前の部分でまとめて集計する
+func cacheFamily(key string) string {
+	family, _, _ := strings.Cut(key, ":")
+	return family
+}
+
+// getCacheKeyStats は種類の統計を返す。cacheStatsMu を取った状態で呼ぶ
+func getCacheKeyStats(family string) *cacheKeyStats {
+	s, ok := cacheStats[family]
+	if !ok {
+		s = &cacheKeyStats{}
+		cacheStats[family] = s
+	}
+	return s
+}
+
+func recordCacheHit(key string) {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	s := getCacheKeyStats(cacheFamily(key))
+	s.hits++
+	s.windowHits++
+}
+
+func recordCacheMiss(key string) {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	s := getCacheKeyStats(cacheFamily(key))
+	s.misses++
+	s.windowMisses++
+}
+
+func recordCacheInvalidation(key string) {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	s := getCacheKeyStats(cacheFamily(key))
+	s.invalidations++
+	s.windowInvalidations++
+}
+
+// invalidateCache はキャッシュを消して無効化の回数に数える
+func invalidateCache(key string) {
+	memcacheClient.Delete(key)
+	recordCacheInvalidation(key)
+}
+
+// clampTTL はTTLを自動調整の下限と上限の間に収める
+func clampTTL(ttl int32) int32 {
+	lo, hi := int32(adaptiveTTLMin.Seconds()), int32(adaptiveTTLMax.Seconds())
+	if ttl < lo {
+		return lo
+	}
+	if ttl > hi {
+		return hi
+	}
+	return ttl
+}
+
+// cacheTTL はキャッシュを保存するときのTTLを返す。自動調整が無効なら def をそのまま返す
+func cacheTTL(key string, def int32) int32 {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	s := getCacheKeyStats(cacheFamily(key))
+	if !adaptiveTTLEnabled {
+		s.ttl = def
+		return def
+	}
+	if s.ttl == 0 {
+		s.ttl = clampTTL(def)
+	}
+	return s.ttl
+}
+
+// nextTTL は直近の区間の統計から次のTTLを決める。
+// TTLの間に1回以上無効化されるほど更新が多ければ半分に、ヒット率が高く無効化も無ければ倍にする。
+func nextTTL(ttl int32, hits, misses, invalidations uint64, window time.Duration) int32 {
+	if invalidations > 0 && float64(invalidations)*float64(ttl) >= window.Seconds() {
+		return clampTTL(ttl / 2)
+	}
+	if hits+misses < adaptiveTTLMinSamples {
+		return ttl
+	}
+	if invalidations == 0 && float64(hits)/float64(hits+misses) >= adaptiveTTLHitRate {
+		return clampTTL(ttl * 2)
+	}
+	return ttl
+}
+
+// adjustCacheTTLs は区間の統計で各種類のTTLを見直し、区間の数を0に戻す
+func adjustCacheTTLs(window time.Duration) {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	for _, s := range cacheStats {
+		if s.ttl != 0 {
+			s.ttl = nextTTL(s.ttl, s.windowHits, s.windowMisses, s.windowInvalidations, window)
+		}
+		s.windowHits, s.windowMisses, s.windowInvalidations = 0, 0, 0
+	}
+}
+
+// runCacheTTLTuner は一定間隔でキャッシュのTTLを見直す
+func runCacheTTLTuner() {
+	if !adaptiveTTLEnabled {
+		return
+	}
+	ticker := time.NewTicker(adaptiveTTLInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		adjustCacheTTLs(adaptiveTTLInterval)
+	}
+}
+
+// getDebugCacheStats はキャッシュキーの種類ごとのヒット数・ミス数・無効化回数と現在のTTLをJSONで返す
+func getDebugCacheStats(w http.ResponseWriter, r *http.Request) {
+	type keyStats struct {
+		Key           string  `json:"key"`
+		Hits          uint64  `json:"hits"`
+		Misses        uint64  `json:"misses"`
+		Invalidations uint64  `json:"invalidations"`
+		HitRate       float64 `json:"hit_rate"`
+		TTL           int32   `json:"ttl"`
+	}
+	res := struct {
+		Adaptive bool       `json:"adaptive"`
+		MinTTL   int32      `json:"min_ttl"`
+		MaxTTL   int32      `json:"max_ttl"`
+		Keys     []keyStats `json:"keys"`
+	}{
+		Adaptive: adaptiveTTLEnabled,
+		MinTTL:   int32(adaptiveTTLMin.Seconds()),
+		MaxTTL:   int32(adaptiveTTLMax.Seconds()),
+		Keys:     []keyStats{},
+	}
+
+	cacheStatsMu.Lock()
+	for family, s := range cacheStats {
+		ks := keyStats{Key: family, Hits: s.hits, Misses: s.misses, Invalidations: s.invalidations, TTL: s.ttl}
+		if s.hits+s.misses > 0 {
+			ks.HitRate = float64(s.hits) / float64(s.hits+s.misses)
+		}
+		res.Keys = append(res.Keys, ks)
+	}
+	cacheStatsMu.Unlock()
+	sort.Slice(res.Keys, func(i, j int) bool { return res.Keys[i].Key < res.Keys[j].Key })
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// 1回に送れるチャンクの最大サイズ
+	maxChunkSize = 1 * 1024 * 1024
+)
+
+// チャンクアップロードの進捗。ファイル本体は一時ディレクトリに追記していく
+type chunkUpload struct {
+	UserID      int    `json:"user_id"`
+	TotalSize   int64  `json:"total_size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+	Received    int64  `json:"received"`
+}
+
+func chunkUploadKey(id string) string {
+	return "upload_chunk:" + id
+}
+
+// 途中のファイルも cleanupPendingUploads で更新からTTL経過後に削除される
+func chunkUploadPath(id string) string {
+	return filepath.Join(uploadTmpDir, "chunk-"+id+".part")
+}
+
+// postAPIUploadChunk は大きな画像を分割して受け取る。
+//
+//   - upload_id を指定しない場合は total_size・sha256・content_type で新しいアップロードを開始する
+//   - upload_id と offset を指定して chunk を送ると一時ファイルに追記する
+//   - 全体を受信したら合計サイズとSHA-256を検証し、先行アップロードと同じトークンを返す
+//
+// offset が受信済みサイズと一致しなければ409と受信済みサイズを返すので、そこから再開できる。
+func postAPIUploadChunk(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	id := r.FormValue("upload_id")
+	if id == "" {
+		startChunkUpload(w, r, me)
+		return
+	}
+
+	item, err := memcacheClient.Get(chunkUploadKey(id))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "アップロードが見つからないか期限切れです"})
+		return
+	}
+	var cu chunkUpload
+	if err := json.Unmarshal(item.Value, &cu); err != nil || cu.UserID != me.ID {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "アップロードが見つからないか期限切れです"})
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	if err != nil || offset != cu.Received {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"upload_id": id, "offset": cu.Received})
+		return
+	}
+
+	chunk, _, err := r.FormFile("chunk")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "chunkが必要です"})
+		return
+	}
+	defer chunk.Close()
+
+	n, err := appendChunk(id, offset, io.LimitReader(chunk, min(maxChunkSize, cu.TotalSize-offset)+1))
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n > maxChunkSize || offset+n > cu.TotalSize {
+		// 受信済みサイズは更新しないので、正しいチャンクで送り直せる
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{"upload_id": id, "offset": cu.Received})
+		return
+	}
+
+	// 同じオフセットへの同時送信は一方だけを受け付ける
+	cu.Received += n
+	item.Value, _ = json.Marshal(cu)
+	item.Expiration = int32(uploadTTL / time.Second)
+	if err := memcacheClient.CompareAndSwap(item); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"upload_id": id, "offset": offset})
+		return
+	}
+
+	if cu.Received < cu.TotalSize {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"upload_id": id, "offset": cu.Received})
+		return
+	}
+
+	token, err := promoteChunkUpload(id, me, cu)
+	if err != nil {
+		var uerr *UploadError
+		if errors.As(err, &uerr) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": uerr.Notice()})
+			return
+		}
+		log.Print(err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "アップロードしたファイルが壊れています"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// getAPIUploadChunk は中断したアップロードを再開するために受信済みサイズを返す
+func getAPIUploadChunk(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id := r.URL.Query().Get("upload_id")
+	item, err := memcacheClient.Get(chunkUploadKey(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var cu chunkUpload
+	if err := json.Unmarshal(item.Value, &cu); err != nil || cu.UserID != me.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"upload_id": id, "offset": cu.Received, "total_size": cu.TotalSize})
+}
+
+func startChunkUpload(w http.ResponseWriter, r *http.Request, me User) {
+	total, err := strconv.ParseInt(r.FormValue("total_size"), 10, 64)
+	if err != nil || total <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "total_sizeが不正です"})
+		return
+	}
+	if total > UploadLimit {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": (&UploadError{Kind: UploadErrorTooLarge}).Notice()})
+		return
+	}
+	sum := strings.ToLower(r.FormValue("sha256"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sha256が不正です"})
+		return
+	}
+
+	if err := os.MkdirAll(uploadTmpDir, 0700); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id := secureRandomStr(uploadTokenBytes)
+	f, err := os.OpenFile(chunkUploadPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	data, _ := json.Marshal(chunkUpload{
+		UserID:      me.ID,
+		TotalSize:   total,
+		SHA256:      sum,
+		ContentType: r.FormValue("content_type"),
+	})
+	err = memcacheClient.Set(&memcache.Item{
+		Key:        chunkUploadKey(id),
+		Value:      data,
+		Expiration: int32(uploadTTL / time.Second),
+	})
+	if err != nil {
+		os.Remove(chunkUploadPath(id))
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"upload_id": id, "offset": 0})
+}
+
+// appendChunk はチャンクを一時ファイルの offset の位置に書き込む
+func appendChunk(id string, offset int64, chunk io.Reader) (int64, error) {
+	f, err := os.OpenFile(chunkUploadPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, chunk)
+	if err != nil {
+		return n, err
+	}
+	// 再送に備えて、書き込んだ位置より後ろの古いデータは切り捨てる
+	return n, f.Truncate(offset + n)
+}
+
+// promoteChunkUpload は受信し終えたファイルを検証し、先行アップロードの画像として登録する
+func promoteChunkUpload(id string, me User, cu chunkUpload) (string, error) {
+	path := chunkUploadPath(id)
+	defer memcacheClient.Delete(chunkUploadKey(id))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() != cu.TotalSize {
+		os.Remove(path)
+		return "", fmt.Errorf("size mismatch: got %d, want %d", fi.Size(), cu.TotalSize)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != cu.SHA256 {
+		os.Remove(path)
+		return "", errors.New("sha256 mismatch")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	header := &multipart.FileHeader{
+		Size:   fi.Size(),
+		Header: textproto.MIMEHeader{"Content-Type": {cu.ContentType}},
+	}
+	mime, ext, err := validateUpload(f, header)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	token := secureRandomStr(uploadTokenBytes)
+	if err := os.Rename(path, pendingUploadPath(token, ext)); err != nil {
+		return "", err
+	}
+
+	meta, _ := json.Marshal(pendingUpload{UserID: me.ID, Mime: mime, Ext: ext})
+	err = memcacheClient.Set(&memcache.Item{
+		Key:        pendingUploadKey(token),
+		Value:      meta,
+		Expiration: int32(uploadTTL / time.Second),
+	})
+	if err != nil {
+		os.Remove(pendingUploadPath(token, ext))
+		return "", err
+	}
+
+	return token, nil
+}
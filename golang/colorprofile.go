@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+const (
+	// jpegのAPP2に埋め込まれるICCプロファイルの識別子
+	iccMarkerPrefix = "ICC_PROFILE\x00"
+	// APP2の1セグメントに入るプロファイルのバイト数（セグメント長2・識別子12・番号2を除く）
+	iccChunkSize = 65535 - 2 - len(iccMarkerPrefix) - 2
+)
+
+// ISUCONP_CONVERT_SRGB=1 ならjpegの埋め込みプロファイルからsRGBに変換して保存する。
+// 全ピクセルを再計算して再エンコードするので既定では行わない。
+var convertToSRGB = os.Getenv("ISUCONP_CONVERT_SRGB") == "1"
+
+var errUnsupportedProfile = errors.New("unsupported icc profile")
+
+// sRGBの原色をD50に順応させたXYZ（ICCのPCSはD50）。列がR・G・B
+var srgbMatrix = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// iccProfile はマトリクス・TRC形式のRGBプロファイル（一般的なカメラ・編集ソフトのもの）
+type iccProfile struct {
+	matrix [3][3]float64 // 線形RGBからPCS（D50のXYZ）への変換
+	trc    [3]toneCurve  // 各チャンネルの値から線形値への変換
+}
+
+type toneCurve func(float64) float64
+
+// readICCProfile はjpegのAPP2セグメントに分割して埋め込まれたICCプロファイルを返す。
+// 埋め込まれていなければnilを返す。
+func readICCProfile(filePath string) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, fmt.Errorf("%s is not a jpeg", filePath)
+	}
+
+	chunks := map[int][]byte{}
+	total := 0
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:2]); err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xff {
+			return nil, fmt.Errorf("%s: broken jpeg marker", filePath)
+		}
+		// 画像データ（SOS）より後ろにプロファイルは無い
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			break
+		}
+		if _, err := io.ReadFull(br, marker[2:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("%s: broken jpeg segment", filePath)
+		}
+		if marker[1] != 0xe2 {
+			if _, err := br.Discard(length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		if len(data) < len(iccMarkerPrefix)+2 || string(data[:len(iccMarkerPrefix)]) != iccMarkerPrefix {
+			continue
+		}
+		seq, count := int(data[len(iccMarkerPrefix)]), int(data[len(iccMarkerPrefix)+1])
+		chunks[seq] = data[len(iccMarkerPrefix)+2:]
+		total = count
+	}
+
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	var profile []byte
+	for i := 1; i <= total; i++ {
+		c, ok := chunks[i]
+		if !ok {
+			return nil, fmt.Errorf("%s: icc profile chunk %d of %d is missing", filePath, i, total)
+		}
+		profile = append(profile, c...)
+	}
+	return profile, nil
+}
+
+// parseICCProfile はマトリクス・TRC形式のRGBプロファイルを読む。
+// LUT形式（CMYKなど）は変換できないので errUnsupportedProfile を返す。
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("%w: broken header", errUnsupportedProfile)
+	}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("%w: color space %q, pcs %q", errUnsupportedProfile, data[16:20], data[20:24])
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, fmt.Errorf("%w: broken tag table", errUnsupportedProfile)
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, fmt.Errorf("%w: tag out of range", errUnsupportedProfile)
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p := &iccProfile{}
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := parseXYZTag(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", errUnsupportedProfile, sig, err)
+		}
+		for i := range xyz {
+			p.matrix[i][c] = xyz[i]
+		}
+	}
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseCurveTag(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", errUnsupportedProfile, sig, err)
+		}
+		p.trc[c] = curve
+	}
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseXYZTag(b []byte) ([3]float64, error) {
+	if len(b) < 20 || string(b[:4]) != "XYZ " {
+		return [3]float64{}, errors.New("not an XYZ tag")
+	}
+	return [3]float64{s15Fixed16(b[8:]), s15Fixed16(b[12:]), s15Fixed16(b[16:])}, nil
+}
+
+// parseCurveTag は curv（ガンマ値か表）と para（パラメトリック曲線）に対応する
+func parseCurveTag(b []byte) (toneCurve, error) {
+	if len(b) < 12 {
+		return nil, errors.New("no curve")
+	}
+	switch string(b[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(b[8:]))
+		if len(b) < 12+n*2 {
+			return nil, errors.New("short curve")
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(b[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(b[12+i*2:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case "para":
+		fn := int(binary.BigEndian.Uint16(b[8:]))
+		nparams := []int{1, 3, 4, 5, 7}
+		if fn >= len(nparams) || len(b) < 12+nparams[fn]*4 {
+			return nil, fmt.Errorf("unknown parametric curve %d", fn)
+		}
+		var v [7]float64
+		for i := 0; i < nparams[fn]; i++ {
+			v[i] = s15Fixed16(b[12+i*4:])
+		}
+		g, a, bb, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+		return func(x float64) float64 {
+			switch fn {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -bb/a {
+					return math.Pow(a*x+bb, g)
+				}
+				return 0
+			case 2:
+				if x >= -bb/a {
+					return math.Pow(a*x+bb, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+bb, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+bb, g) + e
+				}
+				return c*x + f
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown curve type %q", b[:4])
+}
+
+// srgbDecode はsRGBの値を線形値にする
+func srgbDecode(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+// srgbEncode は線形値をsRGBの値にする
+func srgbEncode(x float64) float64 {
+	if x <= 0.0031308 {
+		return x * 12.92
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+// isSRGB はプロファイルがsRGBと（実用上）同じかを判定する。同じなら変換せずにそのまま保存する
+func (p *iccProfile) isSRGB() bool {
+	for i := range p.matrix {
+		for j := range p.matrix[i] {
+			if math.Abs(p.matrix[i][j]-srgbMatrix[i][j]) > 0.005 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.trc {
+		for _, x := range []float64{0.02, 0.1, 0.25, 0.5, 0.75, 0.9} {
+			if math.Abs(curve(x)-srgbDecode(x)) > 0.005 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toSRGB は画像の色をプロファイルの色空間からsRGBに変換する（相対的な色域の外はクリップする）
+func (p *iccProfile) toSRGB(src image.Image) image.Image {
+	// 入力は8bitなのでチャンネルごとの線形化は表を引く
+	var lin [3][256]float64
+	for c := range lin {
+		for v := range lin[c] {
+			lin[c][v] = p.trc[c](float64(v) / 255)
+		}
+	}
+	m := mul3(inv3(srgbMatrix), p.matrix)
+
+	const encSteps = 4096
+	var enc [encSteps + 1]uint8
+	for i := range enc {
+		enc[i] = uint8(math.Round(srgbEncode(float64(i)/encSteps) * 255))
+	}
+	encode := func(x float64) uint8 {
+		x = math.Min(math.Max(x, 0), 1)
+		return enc[int(x*encSteps+0.5)]
+	}
+
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	ycc, isYCbCr := src.(*image.YCbCr)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var r, g, bl uint8
+			if isYCbCr {
+				yi, ci := ycc.YOffset(b.Min.X+x, b.Min.Y+y), ycc.COffset(b.Min.X+x, b.Min.Y+y)
+				r, g, bl = color.YCbCrToRGB(ycc.Y[yi], ycc.Cb[ci], ycc.Cr[ci])
+			} else {
+				cr, cg, cb, _ := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				r, g, bl = uint8(cr>>8), uint8(cg>>8), uint8(cb>>8)
+			}
+
+			lr, lg, lb := lin[0][r], lin[1][g], lin[2][bl]
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = encode(m[0][0]*lr + m[0][1]*lg + m[0][2]*lb)
+			dst.Pix[i+1] = encode(m[1][0]*lr + m[1][1]*lg + m[1][2]*lb)
+			dst.Pix[i+2] = encode(m[2][0]*lr + m[2][1]*lg + m[2][2]*lb)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func inv3(a [3][3]float64) [3][3]float64 {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	return [3][3]float64{
+		{(a[1][1]*a[2][2] - a[1][2]*a[2][1]) / det, (a[0][2]*a[2][1] - a[0][1]*a[2][2]) / det, (a[0][1]*a[1][2] - a[0][2]*a[1][1]) / det},
+		{(a[1][2]*a[2][0] - a[1][0]*a[2][2]) / det, (a[0][0]*a[2][2] - a[0][2]*a[2][0]) / det, (a[0][2]*a[1][0] - a[0][0]*a[1][2]) / det},
+		{(a[1][0]*a[2][1] - a[1][1]*a[2][0]) / det, (a[0][1]*a[2][0] - a[0][0]*a[2][1]) / det, (a[0][0]*a[1][1] - a[0][1]*a[1][0]) / det},
+	}
+}
+
+var (
+	srgbProfileOnce sync.Once
+	srgbProfileData []byte
+)
+
+// srgbICCProfile は変換後の画像に埋め込むsRGBのプロファイルを返す。
+// タグ無しの画像をsRGBとして扱わないブラウザ（Firefoxの既定設定など）でも色が揃うよう明示する。
+func srgbICCProfile() []byte {
+	srgbProfileOnce.Do(func() {
+		curve := make([]uint16, 1024)
+		for i := range curve {
+			curve[i] = uint16(math.Round(srgbDecode(float64(i)/float64(len(curve)-1)) * 65535))
+		}
+		srgbProfileData = buildMatrixTRCProfile("sRGB IEC61966-2.1", srgbMatrix, curve)
+	})
+	return srgbProfileData
+}
+
+// buildMatrixTRCProfile はマトリクス・TRC形式のディスプレイ用プロファイル（ICC v2）を作る
+func buildMatrixTRCProfile(desc string, matrix [3][3]float64, curve []uint16) []byte {
+	be := binary.BigEndian
+	fixed := func(v float64) []byte {
+		return be.AppendUint32(nil, uint32(int32(math.Round(v*65536))))
+	}
+	xyzTag := func(x, y, z float64) []byte {
+		b := append([]byte("XYZ \x00\x00\x00\x00"), fixed(x)...)
+		b = append(b, fixed(y)...)
+		return append(b, fixed(z)...)
+	}
+
+	descTag := append([]byte("desc\x00\x00\x00\x00"), be.AppendUint32(nil, uint32(len(desc)+1))...)
+	descTag = append(descTag, desc...)
+	descTag = append(descTag, 0)
+	// Unicode・ScriptCodeの説明は持たない
+	descTag = append(descTag, make([]byte, 4+4+2+1+67)...)
+
+	curveTag := append([]byte("curv\x00\x00\x00\x00"), be.AppendUint32(nil, uint32(len(curve)))...)
+	for _, v := range curve {
+		curveTag = be.AppendUint16(curveTag, v)
+	}
+
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{
+		{"desc", descTag},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright, use freely\x00")},
+		{"wtpt", xyzTag(0.9642, 1.0, 0.8249)},
+		{"rXYZ", xyzTag(matrix[0][0], matrix[1][0], matrix[2][0])},
+		{"gXYZ", xyzTag(matrix[0][1], matrix[1][1], matrix[2][1])},
+		{"bXYZ", xyzTag(matrix[0][2], matrix[1][2], matrix[2][2])},
+		{"rTRC", curveTag},
+		{"gTRC", curveTag},
+		{"bTRC", curveTag},
+	}
+
+	header := make([]byte, 128)
+	be.PutUint32(header[8:], 0x02100000) // v2.1
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	be.PutUint16(header[24:], 2025)
+	be.PutUint16(header[26:], 1)
+	be.PutUint16(header[28:], 1)
+	copy(header[36:], "acsp")
+	copy(header[68:], xyzTag(0.9642, 1.0, 0.8249)[8:]) // PCSの光源（D50）
+
+	table := be.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := len(header) + 4 + len(tags)*12
+	// rTRC・gTRC・bTRC は同じ曲線なのでデータを共有する
+	written := map[*byte]int{}
+	for _, t := range tags {
+		at, ok := written[&t.data[0]]
+		if !ok {
+			at = offset + len(data)
+			written[&t.data[0]] = at
+			data = append(data, t.data...)
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		table = append(table, t.sig...)
+		table = be.AppendUint32(table, uint32(at))
+		table = be.AppendUint32(table, uint32(len(t.data)))
+	}
+
+	profile := append(append(header, table...), data...)
+	be.PutUint32(profile[0:], uint32(len(profile)))
+	return profile
+}
+
+// encodeJPEGWithICC はjpegにエンコードし、icc が空でなければAPP2に埋め込む
+func encodeJPEGWithICC(w io.Writer, img image.Image, quality int, icc []byte) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	encoded := buf.Bytes()
+	if len(icc) == 0 {
+		_, err := w.Write(encoded)
+		return err
+	}
+
+	// SOIの直後にプロファイルを分割して入れる
+	if _, err := w.Write(encoded[:2]); err != nil {
+		return err
+	}
+	count := (len(icc) + iccChunkSize - 1) / iccChunkSize
+	for i := 0; i < count; i++ {
+		chunk := icc[i*iccChunkSize : min((i+1)*iccChunkSize, len(icc))]
+		seg := []byte{0xff, 0xe2}
+		seg = binary.BigEndian.AppendUint16(seg, uint16(2+len(iccMarkerPrefix)+2+len(chunk)))
+		seg = append(seg, iccMarkerPrefix...)
+		seg = append(seg, byte(i+1), byte(count))
+		seg = append(seg, chunk...)
+		if _, err := w.Write(seg); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(encoded[2:])
+	return err
+}
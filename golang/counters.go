@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jmoiron/sqlx"
+)
+
+// 非正規化したカウンタ（コメント数・いいね数・リアクション数）について
+//
+// カウンタはmemcacheに置き、表示時に無ければDBで数えて初期化する。
+// 更新は CompareAndSwap で読み出しから書き込みまでの間に他の更新が無かったときだけ行い、
+// 衝突したら読み直すので、同時に更新されても増減が失われない。
+// 数え始める前に「数えている途中」の印を置き、数えている間に更新があれば印ごと消すので、
+// 更新前に数えた古い件数がキャッシュに残ることもない。
+// キーにはキャッシュの世代を含め、/initialize や一括投入の後はDBから数え直させる。
+
+const (
+	// CAS が衝突したときに読み直す回数
+	casMaxRetries = 20
+	// CAS が衝突したときに待つ時間の単位。衝突するたびに待つ上限を伸ばし、その範囲でばらつかせる
+	casRetryWait = time.Millisecond
+	// カウンタの秒数。消えても次の表示でDBから数え直す
+	counterTTL = 60 * 60
+	// 数えている途中の印の秒数。数えている途中で落ちても、これが過ぎれば数え直せる
+	counterLoadingTTL = 10
+)
+
+// counterLoading はDBで数えている途中のカウンタに置く印
+const counterLoading = "loading"
+
+var errCASRetryExceeded = errors.New("memcache: compare-and-swap retries exceeded")
+
+// casIncr は key の整数を delta だけアトミックに増減し、更新後の値を返す。
+// key が無ければ memcache.ErrCacheMiss を返す。
+// 数えている途中なら、その件数はこの更新より前のものかもしれないので印を消して ErrCacheMiss を返す。
+func casIncr(key string, delta int) (int, error) {
+	for i := 0; i < casMaxRetries; i++ {
+		item, err := memcacheClient.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if string(item.Value) == counterLoading {
+			if err := memcacheClient.Delete(key); err != nil && err != memcache.ErrCacheMiss {
+				return 0, err
+			}
+			return 0, memcache.ErrCacheMiss
+		}
+
+		n, err := strconv.Atoi(string(item.Value))
+		if err != nil {
+			return 0, fmt.Errorf("counter %s: %w", key, err)
+		}
+		n += delta
+		item.Value = []byte(strconv.Itoa(n))
+		item.Expiration = counterTTL
+
+		// ErrNotStored は読んだ後に消されたとき。どちらも読み直す
+		err = memcacheClient.CompareAndSwap(item)
+		if err == nil {
+			return n, nil
+		}
+		if err != memcache.ErrCASConflict && err != memcache.ErrNotStored {
+			return 0, err
+		}
+		// 同時に更新している相手と読み直しのタイミングをずらす
+		time.Sleep(rand.N(time.Duration(i+1) * casRetryWait))
+	}
+	return 0, errCASRetryExceeded
+}
+
+// incrCounter はDBの件数で初期化するカウンタを delta だけ増減する。
+// 無いカウンタを0から数え始めると件数とずれるので、無ければ何もせず次の表示でDBから数えさせる。
+// DBを更新した後に呼ぶこと。
+func incrCounter(key string, delta int) {
+	if _, err := casIncr(key, delta); err != nil && err != memcache.ErrCacheMiss {
+		log.Print(err)
+		// 反映できなかったカウンタは消して数え直させる
+		memcacheClient.Delete(key)
+	}
+}
+
+// getCounters は keys のカウンタをまとめて取得する。
+// 無いものは load で数え（load の結果に無いキーは0）、その値で初期化する。
+// 数えている間に incrCounter で更新されたカウンタは初期化しない。
+func getCounters(keys []string, load func(missing []string) (map[string]int, error)) (map[string]int, error) {
+	counts := make(map[string]int, len(keys))
+	if len(keys) == 0 {
+		return counts, nil
+	}
+
+	items, err := memcacheClient.GetMulti(keys)
+	if err != nil {
+		// memcacheに繋がらなくてもDBで数えて表示する
+		log.Print(err)
+		items = map[string]*memcache.Item{}
+	}
+
+	missing := []string{}
+	for _, k := range keys {
+		if item, ok := items[k]; ok {
+			if n, err := strconv.Atoi(string(item.Value)); err == nil {
+				counts[k] = n
+				continue
+			}
+		}
+		missing = append(missing, k)
+	}
+	if len(missing) == 0 {
+		return counts, nil
+	}
+
+	// 数える前に印を置き、CAS用に読み直す。既に他で置いた印でも同じように扱う
+	for _, k := range missing {
+		memcacheClient.Add(&memcache.Item{Key: k, Value: []byte(counterLoading), Expiration: counterLoadingTTL})
+	}
+	markers, err := memcacheClient.GetMulti(missing)
+	if err != nil {
+		log.Print(err)
+		markers = map[string]*memcache.Item{}
+	}
+
+	loaded, err := load(missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range missing {
+		counts[k] = loaded[k]
+		item, ok := markers[k]
+		if !ok || string(item.Value) != counterLoading {
+			continue
+		}
+		// 数えている間に印が消されて（更新されて）いたり、他で初期化されていたりすれば何もしない
+		item.Value = []byte(strconv.Itoa(loaded[k]))
+		item.Expiration = counterTTL
+		if err := memcacheClient.CompareAndSwap(item); err != nil &&
+			err != memcache.ErrCASConflict && err != memcache.ErrNotStored && err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+	}
+	return counts, nil
+}
+
+func commentCountKey(gen uint64, postID int) string {
+	return fmt.Sprintf("comment_count:%d:%d", gen, postID)
+}
+
+func likeCountKey(gen uint64, postID int) string {
+	return fmt.Sprintf("like_count:%d:%d", gen, postID)
+}
+
+// reactionCountKey は投稿（commentID が0）またはコメントへの絵文字ごとのリアクション数のキー。
+// 絵文字は環境変数で任意の文字列にできるので、キーに使えない文字が入らないよう16進にする。
+func reactionCountKey(gen uint64, postID, commentID int, emoji string) string {
+	return fmt.Sprintf("reaction_count:%d:%d:%d:%s", gen, postID, commentID, hex.EncodeToString([]byte(emoji)))
+}
+
+// countByPost は投稿ごとのカウンタをまとめて取得する。
+// query は post_id IN (?) で絞って post_id・count を返す集計で、カウンタが無い投稿の分だけ実行する。
+func countByPost(postIDs []int, key func(postID int) string, query string) (map[int]int, error) {
+	keys := make([]string, len(postIDs))
+	pidByKey := make(map[string]int, len(postIDs))
+	for i, pid := range postIDs {
+		keys[i] = key(pid)
+		pidByKey[keys[i]] = pid
+	}
+
+	counts, err := getCounters(keys, func(missing []string) (map[string]int, error) {
+		ids := make([]int, len(missing))
+		for i, k := range missing {
+			ids[i] = pidByKey[k]
+		}
+		q, args, err := sqlx.In(query, ids)
+		if err != nil {
+			return nil, err
+		}
+		rows := []struct {
+			PostID int `db:"post_id"`
+			Count  int `db:"count"`
+		}{}
+		if err := db.Select(&rows, q, args...); err != nil {
+			return nil, err
+		}
+		loaded := make(map[string]int, len(rows))
+		for _, row := range rows {
+			loaded[key(row.PostID)] = row.Count
+		}
+		return loaded, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int]int, len(postIDs))
+	for k, n := range counts {
+		res[pidByKey[k]] = n
+	}
+	return res, nil
+}
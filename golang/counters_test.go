@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func counterValue(t *testing.T, key string) (int, bool) {
+	t.Helper()
+
+	item, err := memcacheClient.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return 0, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(string(item.Value))
+	if err != nil {
+		t.Fatalf("counter %s = %q", key, item.Value)
+	}
+	return n, true
+}
+
+func TestIncrCounterParallel(t *testing.T) {
+	useFakeMemcache(t)
+
+	const key, workers, perWorker = "comment_count:0:1", 4, 50
+	if err := memcacheClient.Set(&memcache.Item{Key: key, Value: []byte("10")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				incrCounter(key, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n, ok := counterValue(t, key); !ok || n != 10+workers*perWorker {
+		t.Errorf("counter = %d (exists %v), want %d", n, ok, 10+workers*perWorker)
+	}
+}
+
+func TestIncrCounterMissing(t *testing.T) {
+	m := useFakeMemcache(t)
+
+	// 無いカウンタは0から数え始めず、次の表示でDBから数えさせる
+	incrCounter("comment_count:0:1", 1)
+	if m.has("comment_count:0:1") {
+		t.Error("missing counter must not be created by incrCounter")
+	}
+}
+
+func TestGetCounters(t *testing.T) {
+	useFakeMemcache(t)
+
+	if err := memcacheClient.Set(&memcache.Item{Key: "a", Value: []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	var asked []string
+	counts, err := getCounters([]string{"a", "b", "c"}, func(missing []string) (map[string]int, error) {
+		asked = missing
+		return map[string]int{"b": 5}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(asked) != 2 || asked[0] != "b" || asked[1] != "c" {
+		t.Errorf("load called with %v, want [b c]", asked)
+	}
+	for k, want := range map[string]int{"a": 3, "b": 5, "c": 0} {
+		if counts[k] != want {
+			t.Errorf("counts[%s] = %d, want %d", k, counts[k], want)
+		}
+		// 数えた値で初期化され、以降の更新が反映される
+		if n, ok := counterValue(t, k); !ok || n != want {
+			t.Errorf("cached %s = %d (exists %v), want %d", k, n, ok, want)
+		}
+	}
+}
+
+func TestGetCountersUpdatedWhileLoading(t *testing.T) {
+	useFakeMemcache(t)
+
+	const key = "comment_count:0:1"
+	counts, err := getCounters([]string{key}, func(missing []string) (map[string]int, error) {
+		// 数え終わった直後にコメントが投稿された
+		incrCounter(key, 1)
+		return map[string]int{key: 2}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[key] != 2 {
+		t.Errorf("counts = %d, want 2", counts[key])
+	}
+
+	// 更新前の件数をキャッシュしてはいけない
+	if n, ok := counterValue(t, key); ok {
+		t.Errorf("stale counter %d was cached", n)
+	}
+
+	// 次の表示で数え直した値が使われる
+	counts, err = getCounters([]string{key}, func(missing []string) (map[string]int, error) {
+		return map[string]int{key: 3}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := counterValue(t, key); counts[key] != 3 || !ok || n != 3 {
+		t.Errorf("counts = %d, cached %d (exists %v), want 3", counts[key], n, ok)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	// SPAがJavaScriptから読めるCSRFトークンのCookie（HttpOnlyにしない）
+	xsrfCookieName = "XSRF-TOKEN"
+	xsrfHeaderName = "X-XSRF-TOKEN"
+)
+
+// setXSRFCookie はセッションのCSRFトークンを、SPAがヘッダに付けられるようCookieにも出力する。
+// HTTPSで受けたリクエストなら平文の通信に漏れないよう Secure にする
+func setXSRFCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   xsrfCookieName,
+		Value:  token,
+		Path:   "/",
+		Secure: requestScheme(r) == "https",
+		// 他サイトからのPOSTではCookieが送られない
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func deleteXSRFCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     xsrfCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// validCSRF はフォームの csrf_token か X-XSRF-TOKEN ヘッダがセッションのトークンと一致すれば正当なリクエストとみなす。
+// Cookie は攻撃者がサブドメインなどから書き込めるので、ヘッダと Cookie の一致だけでは通さない。
+// 比較はタイミング攻撃を避けるため定数時間で行う。
+func validCSRF(r *http.Request) bool {
+	token := getCSRFToken(r)
+	if token == "" {
+		return false
+	}
+	return secureCompare(r.FormValue("csrf_token"), token) || secureCompare(r.Header.Get(xsrfHeaderName), token)
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// validCSRFHeader はAPI向けに X-XSRF-TOKEN ヘッダだけでCSRFトークンを検証する。
+// ヘッダの値がセッションのトークンと一致すれば正当とみなす。
+func validCSRFHeader(r *http.Request) bool {
+	token := getCSRFToken(r)
+	return token != "" && secureCompare(r.Header.Get(xsrfHeaderName), token)
+}
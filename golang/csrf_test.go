@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSetXSRFCookie(t *testing.T) {
+	w := httptest.NewRecorder()
+	setXSRFCookie(w, httptest.NewRequest(http.MethodPost, "/login", nil), "token")
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	c := cookies[0]
+	if c.Name != xsrfCookieName || c.Value != "token" || c.Path != "/" {
+		t.Errorf("cookie = %+v", c)
+	}
+	// 他サイトからのPOSTには付かず、SPAのJavaScriptからは読める
+	if c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("SameSite = %v, want Lax", c.SameSite)
+	}
+	if c.HttpOnly {
+		t.Error("XSRF-TOKEN must be readable from JavaScript")
+	}
+	if c.Secure {
+		t.Error("XSRF-TOKEN over plain HTTP must not be Secure")
+	}
+}
+
+// HTTPSで受けたリクエスト（TLSを終端するプロキシの後ろを含む）では Secure にする
+func TestSetXSRFCookieSecure(t *testing.T) {
+	tls := httptest.NewRequest(http.MethodPost, "https://example.com/login", nil)
+	proxied := httptest.NewRequest(http.MethodPost, "/login", nil)
+	proxied.Header.Set("X-Forwarded-Proto", "https")
+
+	for name, r := range map[string]*http.Request{"TLS": tls, "X-Forwarded-Proto": proxied} {
+		w := httptest.NewRecorder()
+		setXSRFCookie(w, r, "token")
+		if c := w.Result().Cookies()[0]; !c.Secure {
+			t.Errorf("%s: XSRF-TOKEN is not Secure", name)
+		}
+	}
+}
+
+func TestValidCSRF(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+	session := loginCookies(t, User{ID: 1, AccountName: "alice"}, "session-token")
+	xsrf := &http.Cookie{Name: xsrfCookieName, Value: "cookie-token"}
+
+	tests := []struct {
+		name    string
+		form    url.Values
+		header  string
+		cookies []*http.Cookie
+		want    bool
+	}{
+		{"フォームのトークンがセッションと一致", url.Values{"csrf_token": {"session-token"}}, "", session, true},
+		{"ヘッダがセッションと一致", nil, "session-token", session, true},
+
+		{"フォームのトークンが違う", url.Values{"csrf_token": {"other"}}, "", session, false},
+		{"セッションの無いフォーム送信", url.Values{"csrf_token": {"session-token"}}, "", nil, false},
+		// 攻撃者が書き込んだCookieとヘッダを揃えても、セッションのトークンと違えば通らない
+		{"ヘッダとCookieが一致してもセッションと違う", nil, "cookie-token", append([]*http.Cookie{xsrf}, session...), false},
+		{"セッションの無いヘッダとCookie", nil, "cookie-token", []*http.Cookie{xsrf}, false},
+		{"ヘッダが違う", nil, "attacker", session, false},
+		{"空のヘッダ", nil, "", session, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/comment", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.header != "" {
+				r.Header.Set(xsrfHeaderName, tt.header)
+			}
+			if got := validCSRF(withCookies(r, tt.cookies)); got != tt.want {
+				t.Errorf("validCSRF = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidCSRFHeader(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+	session := loginCookies(t, User{ID: 1, AccountName: "alice"}, "session-token")
+
+	tests := []struct {
+		name    string
+		header  string
+		cookies []*http.Cookie
+		want    bool
+	}{
+		{"ヘッダがセッションのトークンと一致", "session-token", session, true},
+		{"ヘッダが無い", "", session, false},
+		{"セッションの無いヘッダとCookie", "cookie-token", []*http.Cookie{{Name: xsrfCookieName, Value: "cookie-token"}}, false},
+		{"ヘッダとCookieが一致してもセッションと違う", "cookie-token", append([]*http.Cookie{{Name: xsrfCookieName, Value: "cookie-token"}}, session...), false},
+		{"ヘッダがセッションと違う", "attacker", session, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/posts", nil)
+			if tt.header != "" {
+				r.Header.Set(xsrfHeaderName, tt.header)
+			}
+			if got := validCSRFHeader(withCookies(r, tt.cookies)); got != tt.want {
+				t.Errorf("validCSRFHeader = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
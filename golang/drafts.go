@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// postPostsDraft は投稿を公開せずに下書きとして保存する
+func postPostsDraft(w http.ResponseWriter, r *http.Request) {
+	createPost(w, r, postStatusDraft)
+}
+
+// isOwnerOnlyStatus は投稿者本人にしか見せない状態（下書き・公開予約中）かを判定する
+func isOwnerOnlyStatus(status string) bool {
+	return status == postStatusDraft || status == postStatusScheduled
+}
+
+// getSettingsDrafts は自分の下書きと公開予約中の投稿の一覧を表示する
+func getSettingsDrafts(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	results := []Post{}
+	err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count`, `status`, `publish_at` FROM `posts` WHERE `user_id` = ? AND `status` IN ('draft', 'scheduled') ORDER BY `created_at` DESC", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	posts, err := makePosts(results, getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("drafts.html"),
+		getTemplPath("post.html"),
+	)).Execute(w, struct {
+		Posts     []Post
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postPostsPublish は下書きを公開する。
+// update_created_at が指定されれば投稿日時を公開した時刻にする。
+func postPostsPublish(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := "UPDATE `posts` SET `status` = 'published' WHERE `id` = ? AND `user_id` = ? AND `status` = 'draft'"
+	if r.FormValue("update_created_at") == "1" {
+		query = "UPDATE `posts` SET `status` = 'published', `created_at` = NOW(6) WHERE `id` = ? AND `user_id` = ? AND `status` = 'draft'"
+	}
+
+	result, err := db.Exec(query, pid, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 他人の投稿・公開済みの投稿は下書きとして存在しないものとして扱う
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	go indexPost(pid)
+	notifyWebhooks(webhookEventPostCreated, pid)
+
+	// 下書きのIDは最新とは限らないので、最新投稿IDでの失効に頼らず一覧のキャッシュも消す
+	memcacheClient.Delete("latest_post_id")
+	invalidateIndexPosts()
+	memcacheClient.Delete(fmt.Sprintf("account:%s", me.AccountName))
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", pid), http.StatusSeeOther)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var (
+	// エクスポート1回の処理時間の上限
+	exportTimeout = 2 * time.Minute
+	// 同じユーザーが続けてエクスポートできるまでの間隔
+	exportInterval = 10 * time.Minute
+)
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_EXPORT_TIMEOUT")); err == nil && d > 0 {
+		exportTimeout = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_EXPORT_INTERVAL")); err == nil && d > 0 {
+		exportInterval = d
+	}
+}
+
+// getSettingsExportImages は自分の全投稿の画像をzipにまとめて返す。
+// 画像は1枚ずつ zip.Writer に書き込み、全体をメモリに載せない。
+func getSettingsExportImages(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// 間隔を空けずに繰り返しエクスポートされないよう、ユーザーごとに1回分の枠をmemcacheに取る
+	err := memcacheClient.Add(&memcache.Item{
+		Key:        fmt.Sprintf("export:%d", me.ID),
+		Value:      []byte("1"),
+		Expiration: int32(exportInterval / time.Second),
+	})
+	if errors.Is(err, memcache.ErrNotStored) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(exportInterval/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		log.Print(err)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+
+	// 自分の投稿だけを対象にする（下書きも含む）
+	posts := []Post{}
+	err = db.SelectContext(ctx, &posts, "SELECT `id`, `mime` FROM `posts` WHERE `user_id` = ? AND `mime` != '' ORDER BY `id`", me.ID)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="images.zip"`)
+
+	zw := zip.NewWriter(w)
+	for _, p := range posts {
+		if ctx.Err() != nil {
+			// ヘッダは送信済みなので、途中までのzipとして終える
+			log.Printf("export images of user %d: %s", me.ID, ctx.Err())
+			break
+		}
+		if err := addImageToZip(zw, p); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				log.Printf("export images of user %d: skip post %d: %s", me.ID, p.ID, err)
+				continue
+			}
+			log.Print(err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Print(err)
+	}
+}
+
+func addImageToZip(zw *zip.Writer, p Post) error {
+	filePath := staticFilePath(p)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 画像は圧縮済みなので再圧縮せずに格納する
+	header := &zip.FileHeader{
+		Name:     path.Base(filePath),
+		Method:   zip.Store,
+		Modified: fi.ModTime(),
+	}
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
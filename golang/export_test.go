@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetSettingsExportImages(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+	useImageDir(t, 1, "jpg", []byte("alice-1"))
+	// 他のユーザーの画像も同じディレクトリにある
+	localImages.Save(2, "jpg", bytes.NewReader([]byte("bob-2")))
+	localImages.Save(3, "png", bytes.NewReader([]byte("alice-3")))
+	cookies := loginCookies(t, User{ID: 10, AccountName: "alice"}, "token")
+
+	// 自分の投稿だけを対象にする。画像が消えている投稿（4）は飛ばす
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id`, `mime` FROM `posts` WHERE `user_id` = ? AND `mime` != '' ORDER BY `id`")).
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "mime"}).
+			AddRow(1, "image/jpeg").
+			AddRow(3, "image/png").
+			AddRow(4, "image/gif"))
+
+	export := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		getSettingsExportImages(w, withCookies(httptest.NewRequest(http.MethodGet, "/settings/export/images", nil), cookies))
+		return w
+	}
+
+	w := export()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "1.jpg" || names[1] != "3.png" {
+		t.Errorf("zip entries = %v, want only alice's images [1.jpg 3.png]", names)
+	}
+
+	// 続けてのエクスポートは断る
+	if w := export(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second export: status = %d, want 429", w.Code)
+	}
+}
+
+func TestGetSettingsExportImagesRequiresLogin(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+
+	w := httptest.NewRecorder()
+	getSettingsExportImages(w, httptest.NewRequest(http.MethodGet, "/settings/export/images", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login" {
+		t.Errorf("status = %d, location = %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+}
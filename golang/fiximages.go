@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+// 1回に調べる投稿の数
+const fixImagesBatch = 100
+
+// fixImagesOptions は -fix-images の実行方法。
+// 大量の投稿を分けて処理するときは、ログに出る続きのIDを FromID に指定して再実行する
+type fixImagesOptions struct {
+	DryRun bool // 修正せず、修正内容と問題のある投稿を報告するだけにする
+	FromID int  // このID以降の投稿を調べる
+	Limit  int  // 調べる投稿数の上限。0なら最後まで
+}
+
+type fixImagesResult struct {
+	Checked  int // 調べた投稿の数
+	Fixed    int // 修正した（ドライランでは修正が必要な）投稿の数
+	Problems int // 自動では直せない投稿の数
+	LastID   int // 最後に調べた投稿のID
+}
+
+// imageFixRow は調べる投稿。アーカイブした投稿は画像の置き場所が違う
+type imageFixRow struct {
+	ID       int    `db:"id"`
+	Mime     string `db:"mime"`
+	Archived bool   `db:"archived"`
+}
+
+// fixImages は posts.mime と画像ファイルの拡張子・中身が食い違っている投稿を探して直す。
+// 中身を http.DetectContentType で判定し、jpeg・png・gif なら mime と拡張子をそれに合わせる。
+// それ以外の形式や画像が見つからない投稿は報告だけして直さない。
+//
+// 新しい名前で画像を保存 → mime を更新 → 古い名前の画像を削除 の順に行うので、途中で止まっても
+// もう一度実行すれば続きから同じ結果になり、修正済みの投稿には何もしない。
+func fixImages(opts fixImagesOptions) (fixImagesResult, error) {
+	res := fixImagesResult{LastID: opts.FromID - 1}
+	archived := &localImageStore{dir: archiveImageDir}
+
+	for opts.Limit == 0 || res.Checked < opts.Limit {
+		n := fixImagesBatch
+		if opts.Limit > 0 && opts.Limit-res.Checked < n {
+			n = opts.Limit - res.Checked
+		}
+
+		rows := []imageFixRow{}
+		err := db.Select(&rows,
+			"SELECT `id`, `mime`, 0 AS `archived` FROM `posts` WHERE `id` > ? AND `mime` != '' "+
+				"UNION ALL SELECT `id`, `mime`, 1 AS `archived` FROM `posts_archive` WHERE `id` > ? AND `mime` != '' "+
+				"ORDER BY `id` LIMIT ?",
+			res.LastID, res.LastID, n)
+		if err != nil {
+			return res, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			res.LastID = row.ID
+			res.Checked++
+
+			store, table := imageStore, "posts"
+			if row.Archived {
+				store, table = archived, "posts_archive"
+			}
+			fixed, err := fixImage(row, store, table, opts.DryRun)
+			if err != nil {
+				log.Printf("fix-images: post %d: %s", row.ID, err)
+				res.Problems++
+				continue
+			}
+			if fixed {
+				res.Fixed++
+			}
+		}
+		log.Printf("fix-images: done up to post %d (resume with -fix-images-from=%d)", res.LastID, res.LastID+1)
+	}
+
+	// 一覧やアカウントページのキャッシュには mime が入っているので作り直させる
+	if !opts.DryRun && res.Fixed > 0 {
+		bumpCacheGeneration()
+	}
+	return res, nil
+}
+
+// fixImage は1件の投稿を調べ、必要なら直す。修正した（ドライランでは修正が必要な）ら true を返す。
+// 自動では直せない投稿はエラーを返す
+func fixImage(row imageFixRow, store ImageStore, table string, dryRun bool) (bool, error) {
+	// 前回の実行が途中で止まった場合に備え、mime に対応する拡張子の次に他の拡張子も探す
+	exts := []string{}
+	if ext := imageExtByMime(row.Mime); ext != "" {
+		exts = append(exts, ext)
+	}
+	for _, t := range imageTypes {
+		exts = append(exts, t.Ext)
+	}
+
+	oldExt := ""
+	var data []byte
+	for _, ext := range exts {
+		rc, err := store.Open(row.ID, ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		data, err = readImage(rc)
+		rc.Close()
+		if err != nil {
+			return false, err
+		}
+		oldExt = ext
+		break
+	}
+	if oldExt == "" {
+		return false, fmt.Errorf("image not found (mime %q)", row.Mime)
+	}
+
+	mime := http.DetectContentType(data)
+	newExt := imageExtByMime(mime)
+	if newExt == "" {
+		return false, fmt.Errorf("%d.%s is %q, not jpeg, png or gif (mime %q)", row.ID, oldExt, mime, row.Mime)
+	}
+	if mime == row.Mime && newExt == oldExt {
+		return false, nil
+	}
+
+	log.Printf("fix-images: post %d: mime %q -> %q, %d.%s -> %d.%s", row.ID, row.Mime, mime, row.ID, oldExt, row.ID, newExt)
+	if dryRun {
+		return true, nil
+	}
+
+	if newExt != oldExt {
+		if err := store.Save(row.ID, newExt, bytes.NewReader(data)); err != nil {
+			return false, err
+		}
+	}
+	if mime != row.Mime {
+		// 調べている間に変わっていたら上書きしない
+		_, err := db.Exec("UPDATE `"+table+"` SET `mime` = ? WHERE `id` = ? AND `mime` = ?", mime, row.ID, row.Mime)
+		if err != nil {
+			return false, err
+		}
+	}
+	if newExt != oldExt {
+		if err := store.Delete(row.ID, oldExt); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
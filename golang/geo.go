@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const (
+	// GET /map で返す投稿の最大件数
+	mapMaxFeatures = 500
+)
+
+var errInvalidGeo = errors.New("invalid geo location")
+
+// 投稿に付ける撮影場所
+type postGeo struct {
+	Lat    sql.NullFloat64
+	Lng    sql.NullFloat64
+	Public int // 1なら本人以外にも位置情報を返す
+}
+
+func validLatLng(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// parseGeo はフォームの lat・lng を取り出す。どちらも空なら位置情報なしとする。
+// 片方だけの指定や範囲外の値は errInvalidGeo を返す。
+func parseGeo(r *http.Request) (postGeo, error) {
+	geo := postGeo{}
+	if r.FormValue("geo_public") == "1" {
+		geo.Public = 1
+	}
+
+	latStr, lngStr := strings.TrimSpace(r.FormValue("lat")), strings.TrimSpace(r.FormValue("lng"))
+	if latStr == "" && lngStr == "" {
+		return geo, nil
+	}
+
+	lat, err := strconv.ParseFloat(latStr, 64)
+	if err != nil {
+		return geo, errInvalidGeo
+	}
+	lng, err := strconv.ParseFloat(lngStr, 64)
+	if err != nil {
+		return geo, errInvalidGeo
+	}
+	if !validLatLng(lat, lng) {
+		return geo, errInvalidGeo
+	}
+
+	geo.Lat = sql.NullFloat64{Float64: lat, Valid: true}
+	geo.Lng = sql.NullFloat64{Float64: lng, Valid: true}
+	return geo, nil
+}
+
+// fillGeoFromExif は位置情報が入力されておらず geo_exif=1 のとき、jpegのEXIF GPSから位置情報を補う。
+// 向きの補正で再エンコードするとEXIFは消えるので、保存前の元ファイルから読む。
+func fillGeoFromExif(r *http.Request, geo *postGeo, f io.ReadSeeker, mime string) {
+	if geo.Lat.Valid || mime != "image/jpeg" || r.FormValue("geo_exif") != "1" {
+		return
+	}
+	defer f.Seek(0, io.SeekStart)
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return
+	}
+	lat, lng, err := x.LatLong()
+	if err != nil || !validLatLng(lat, lng) {
+		return
+	}
+	geo.Lat = sql.NullFloat64{Float64: lat, Valid: true}
+	geo.Lng = sql.NullFloat64{Float64: lng, Valid: true}
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // GeoJSONは [経度, 緯度] の順
+}
+
+// getMap は位置情報付きの投稿をGeoJSONのFeatureCollectionで返す。
+// 位置情報を非公開にしている投稿は投稿者本人にしか返さない。
+// ?bbox=西経,南緯,東経,北緯 で範囲を絞り込める。
+func getMap(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	query := "SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, p.`lat`, p.`lng`, u.`account_name` " +
+		"FROM `posts` p JOIN `users` u ON u.`id` = p.`user_id` " +
+		"WHERE p.`lat` IS NOT NULL AND p.`status` = 'published' AND u.`del_flg` = 0 AND (p.`geo_public` = 1 OR p.`user_id` = ?)"
+	args := []interface{}{me.ID}
+
+	if v := r.URL.Query().Get("bbox"); v != "" {
+		var west, south, east, north float64
+		if _, err := fmt.Sscanf(v, "%g,%g,%g,%g", &west, &south, &east, &north); err != nil ||
+			!validLatLng(south, west) || !validLatLng(north, east) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query += " AND p.`lat` BETWEEN ? AND ? AND p.`lng` BETWEEN ? AND ?"
+		args = append(args, south, north, west, east)
+	}
+	query += " ORDER BY p.`created_at` DESC LIMIT ?"
+	args = append(args, mapMaxFeatures)
+
+	rows := []struct {
+		Post
+		AccountName string `db:"account_name"`
+	}{}
+	if err := db.Select(&rows, query, args...); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	features := make([]geoJSONFeature, 0, len(rows))
+	for _, row := range rows {
+		features = append(features, geoJSONFeature{
+			Type: "Feature",
+			Geometry: geoJSONPoint{
+				Type:        "Point",
+				Coordinates: [2]float64{row.Lng.Float64, row.Lat.Float64},
+			},
+			Properties: map[string]interface{}{
+				"id":           row.ID,
+				"url":          fmt.Sprintf("/posts/%d", row.ID),
+				"image_url":    imageURL(row.Post),
+				"account_name": row.AccountName,
+				"created_at":   row.CreatedAt.Format(ISO8601Format),
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
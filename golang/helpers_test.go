@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/bradfitz/gomemcache/memcache"
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeMemcached はテスト用のmemcached。gomemcache が使うテキストプロトコルのコマンドだけを実装する
+type fakeMemcached struct {
+	mu    sync.Mutex
+	items map[string]fakeMemcachedItem
+	cas   uint64
+	ln    net.Listener
+}
+
+type fakeMemcachedItem struct {
+	value   []byte
+	flags   uint32
+	cas     uint64
+	expires time.Time // ゼロ値なら期限なし
+}
+
+// useFakeMemcache はテストの間だけ memcacheClient とセッションの保存先をテスト用のmemcachedに向ける
+func useFakeMemcache(t *testing.T) *fakeMemcached {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMemcached{items: map[string]fakeMemcachedItem{}, ln: ln}
+	go m.serve()
+
+	oldClient, oldStore := memcacheClient, store
+	memcacheClient = memcache.New(ln.Addr().String())
+	memcacheClient.MaxIdleConns = 16
+	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
+	t.Cleanup(func() {
+		ln.Close()
+		memcacheClient, store = oldClient, oldStore
+	})
+	return m
+}
+
+// useMockDB はテストの間だけ db をモックに差し替える。期待したクエリがすべて実行されたかは終了時に確かめる
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+
+	old := db
+	db = sqlx.NewDb(mockDB, "mysql")
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+		db = old
+	})
+	return mock
+}
+
+// loginCookies は u でログインしたセッションのCookieを返す。
+// ユーザー情報はmemcacheに入れておくので、getSessionUser はDBを引かない
+func loginCookies(t *testing.T, u User, csrfToken string) []*http.Cookie {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, sessionName)
+	if err != nil && session == nil {
+		t.Fatal(err)
+	}
+	session.Values["user_id"] = u.ID
+	session.Values["csrf_token"] = csrfToken
+	startSessionLifetime(session)
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memcacheClient.Set(&memcache.Item{Key: fmt.Sprintf("user:%d", u.ID), Value: data}); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()
+}
+
+// withCookies は r にCookieを付けて返す
+func withCookies(r *http.Request, cookies []*http.Cookie) *http.Request {
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func (m *fakeMemcached) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *fakeMemcached) handle(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if !m.exec(rw, args) {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (m *fakeMemcached) exec(rw *bufio.ReadWriter, args []string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	get := func(key string) (fakeMemcachedItem, bool) {
+		it, ok := m.items[key]
+		if ok && !it.expires.IsZero() && !now.Before(it.expires) {
+			delete(m.items, key)
+			return it, false
+		}
+		return it, ok
+	}
+
+	switch args[0] {
+	case "get", "gets":
+		for _, key := range args[1:] {
+			if it, ok := get(key); ok {
+				fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n%s\r\n", key, it.flags, len(it.value), it.cas, it.value)
+			}
+		}
+		fmt.Fprint(rw, "END\r\n")
+
+	case "set", "add", "replace", "cas", "append", "prepend":
+		if len(args) < 5 {
+			fmt.Fprint(rw, "ERROR\r\n")
+			return false
+		}
+		flags, _ := strconv.ParseUint(args[2], 10, 32)
+		exp, _ := strconv.ParseInt(args[3], 10, 64)
+		size, err := strconv.Atoi(args[4])
+		if err != nil {
+			return false
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return false
+		}
+		data = data[:size]
+
+		key := args[1]
+		cur, exists := get(key)
+		switch {
+		case args[0] == "add" && exists,
+			(args[0] == "replace" || args[0] == "append" || args[0] == "prepend") && !exists:
+			fmt.Fprint(rw, "NOT_STORED\r\n")
+			return true
+		case args[0] == "cas" && !exists:
+			fmt.Fprint(rw, "NOT_FOUND\r\n")
+			return true
+		case args[0] == "cas" && len(args) > 5 && args[5] != strconv.FormatUint(cur.cas, 10):
+			fmt.Fprint(rw, "EXISTS\r\n")
+			return true
+		}
+
+		switch args[0] {
+		case "append":
+			data = append(append([]byte{}, cur.value...), data...)
+		case "prepend":
+			data = append(data, cur.value...)
+		}
+		m.cas++
+		m.items[key] = fakeMemcachedItem{value: data, flags: uint32(flags), cas: m.cas, expires: memcachedExpiry(now, exp)}
+		fmt.Fprint(rw, "STORED\r\n")
+
+	case "delete":
+		if _, ok := get(args[1]); !ok {
+			fmt.Fprint(rw, "NOT_FOUND\r\n")
+			return true
+		}
+		delete(m.items, args[1])
+		fmt.Fprint(rw, "DELETED\r\n")
+
+	case "incr", "decr":
+		it, ok := get(args[1])
+		if !ok {
+			fmt.Fprint(rw, "NOT_FOUND\r\n")
+			return true
+		}
+		n, err := strconv.ParseUint(string(it.value), 10, 64)
+		if err != nil {
+			fmt.Fprint(rw, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+			return true
+		}
+		delta, _ := strconv.ParseUint(args[2], 10, 64)
+		if args[0] == "incr" {
+			n += delta
+		} else if delta > n {
+			n = 0
+		} else {
+			n -= delta
+		}
+		m.cas++
+		it.value, it.cas = []byte(strconv.FormatUint(n, 10)), m.cas
+		m.items[args[1]] = it
+		fmt.Fprintf(rw, "%d\r\n", n)
+
+	case "touch":
+		it, ok := get(args[1])
+		if !ok {
+			fmt.Fprint(rw, "NOT_FOUND\r\n")
+			return true
+		}
+		exp, _ := strconv.ParseInt(args[2], 10, 64)
+		it.expires = memcachedExpiry(now, exp)
+		m.items[args[1]] = it
+		fmt.Fprint(rw, "TOUCHED\r\n")
+
+	case "flush_all":
+		m.items = map[string]fakeMemcachedItem{}
+		fmt.Fprint(rw, "OK\r\n")
+
+	case "version":
+		fmt.Fprint(rw, "VERSION 1.6.0\r\n")
+
+	default:
+		fmt.Fprint(rw, "ERROR\r\n")
+	}
+	return true
+}
+
+// memcachedExpiry は memcached と同じく、30日を超える値はUNIX時刻、それ以外は秒数として期限を決める
+func memcachedExpiry(now time.Time, exp int64) time.Time {
+	switch {
+	case exp == 0:
+		return time.Time{}
+	case exp < 0:
+		return now
+	case exp > 30*24*60*60:
+		return time.Unix(exp, 0)
+	}
+	return now.Add(time.Duration(exp) * time.Second)
+}
+
+// has は key がmemcachedにあるかを返す
+func (m *fakeMemcached) has(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	it, ok := m.items[key]
+	return ok && (it.expires.IsZero() || time.Now().Before(it.expires))
+}
+
+// sameTime はタイムゾーンによらず同じ時刻の引数にマッチする
+type sameTime time.Time
+
+func (t sameTime) Match(v driver.Value) bool {
+	tv, ok := v.(time.Time)
+	return ok && tv.Equal(time.Time(t))
+}
+
+// memImageStore はメモリに置くテスト用の画像の保存先（S3などローカル以外の配信元の代わり）
+type memImageStore struct {
+	mu     sync.Mutex
+	images map[string][]byte
+}
+
+func (s *memImageStore) key(id int, ext string) string {
+	return fmt.Sprintf("%d.%s", id, ext)
+}
+
+func (s *memImageStore) Save(id int, ext string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[s.key(id, ext)] = data
+	return nil
+}
+
+func (s *memImageStore) Open(id int, ext string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.images[s.key(id, ext)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memImageStore) Delete(id int, ext string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.images, s.key(id, ext))
+	return nil
+}
+
+// useRemoteImageStore はテストの間だけ配信元をローカル以外にし、id の画像をそこにだけ置く。
+// ローカルの画像の置き場所は空の一時ディレクトリにする
+func useRemoteImageStore(t *testing.T, id int, ext string, data []byte) {
+	t.Helper()
+
+	oldLocal, oldStore := localImages, imageStore
+	localImages = &localImageStore{dir: t.TempDir()}
+	imageStore = &memImageStore{images: map[string][]byte{fmt.Sprintf("%d.%s", id, ext): data}}
+	t.Cleanup(func() { localImages, imageStore = oldLocal, oldStore })
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"unicode"
+)
+
+// highlight は text をHTMLエスケープし、query の各キーワード（空白区切り）に一致する箇所を<mark>で囲む。
+// 大文字小文字は区別しない。比較は1文字ずつ小文字にしたルーン列で行うので、
+// 小文字にするとバイト長が変わる文字があっても元の文字列の位置がずれない。
+func highlight(text, query string) template.HTML {
+	keywords := [][]rune{}
+	for _, k := range strings.Fields(query) {
+		keywords = append(keywords, foldRunes([]rune(k)))
+	}
+	if len(keywords) == 0 {
+		return template.HTML(template.HTMLEscapeString(text))
+	}
+
+	runes := []rune(text)
+	folded := foldRunes(runes)
+
+	// 一致した文字に印を付ける（重なったり隣り合ったりする一致は1つの<mark>にまとめる）
+	marked := make([]bool, len(runes))
+	for _, k := range keywords {
+		for i := 0; i+len(k) <= len(folded); i++ {
+			if runesEqual(folded[i:i+len(k)], k) {
+				for j := i; j < i+len(k); j++ {
+					marked[j] = true
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && marked[j] == marked[i] {
+			j++
+		}
+		s := template.HTMLEscapeString(string(runes[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + s + "</mark>")
+		} else {
+			b.WriteString(s)
+		}
+		i = j
+	}
+	return template.HTML(b.String())
+}
+
+func foldRunes(rs []rune) []rune {
+	folded := make([]rune, len(rs))
+	for i, r := range rs {
+		folded[i] = unicode.ToLower(r)
+	}
+	return folded
+}
+
+func runesEqual(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		query string
+		want  string
+	}{
+		{"一致しなければエスケープだけ", "a < b", "c", "a &lt; b"},
+		{"大文字小文字を区別しない", "Go and GO", "go", "<mark>Go</mark> and <mark>GO</mark>"},
+		{"複数のキーワード", "猫と犬", "猫 犬", "<mark>猫</mark>と<mark>犬</mark>"},
+		{"重なる一致はまとめる", "abcd", "abc bcd", "<mark>abcd</mark>"},
+		{"空のクエリ", "<b>", " ", "&lt;b&gt;"},
+		// エスケープ後の文字列ではなく元の文字列で比較するので、実体参照の中には<mark>を入れない
+		{"実体参照の中は一致しない", "a < b & c", "lt amp", "a &lt; b &amp; c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(highlight(tt.text, tt.query)); got != tt.want {
+				t.Errorf("highlight(%q, %q) = %q, want %q", tt.text, tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightInjection(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		query     string
+		marks     int
+		forbidden []string
+	}{
+		{"本文のscriptタグ", "<script>alert(1)</script>", "script", 2, []string{"<script", "</script"}},
+		{"クエリのscriptタグ", "<script>alert(1)</script>", "<script>", 1, []string{"<script"}},
+		{"クエリでタグを閉じる", `"></mark><script>alert(1)</script>`, `"></mark><script>`, 1, []string{"<script", `"></mark>`}},
+		{"javascriptスキーム", "javascript:alert(1)", "javascript:", 1, []string{"<a", "href"}},
+		{"本文の<mark>", "<mark>偽物</mark>本物", "本物", 1, nil},
+		{"クエリの<mark>", "<mark>x</mark>", "<mark>", 1, nil},
+		{"markという語", "<mark>x</mark>", "mark", 2, nil},
+		{"属性への注入", `<img src=x onerror=alert(1)>`, "onerror", 1, []string{"<img"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(highlight(tt.text, tt.query))
+
+			for _, f := range tt.forbidden {
+				if strings.Contains(got, f) {
+					t.Errorf("highlight(%q, %q) = %q, must not contain %q", tt.text, tt.query, got, f)
+				}
+			}
+			// 出力に含まれるタグは highlight が入れた<mark>だけ
+			if n := strings.Count(got, "<mark>"); n != tt.marks || strings.Count(got, "</mark>") != tt.marks {
+				t.Errorf("highlight(%q, %q) = %q, want %d marks", tt.text, tt.query, got, tt.marks)
+			}
+			// <mark>を外すとエスケープした本文そのものになる
+			stripped := strings.NewReplacer("<mark>", "", "</mark>", "").Replace(got)
+			if want := template.HTMLEscapeString(tt.text); stripped != want {
+				t.Errorf("highlight(%q, %q) without marks = %q, want %q", tt.text, tt.query, stripped, want)
+			}
+		})
+	}
+}
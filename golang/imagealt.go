@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// alt属性の最大文字数
+	imageAltMaxLength = 255
+	// altが無いときに代わりに使う本文の先頭の文字数
+	imageAltFallbackLength = 100
+)
+
+// AltGenerator は画像からalt属性用の説明文を生成する
+type AltGenerator interface {
+	Generate(ctx context.Context, filePath, mime string) (string, error)
+}
+
+var (
+	altGenerator AltGenerator = noopAltGenerator{}
+	altTimeout                = 5 * time.Second
+)
+
+func init() {
+	switch os.Getenv("ISUCONP_ALT_ENGINE") {
+	case "api":
+		altGenerator = &apiAltGenerator{
+			endpoint: os.Getenv("ISUCONP_ALT_API_URL"),
+			client:   &http.Client{},
+		}
+	case "local":
+		altGenerator = localAltGenerator{}
+	}
+
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_ALT_TIMEOUT")); err == nil && d > 0 {
+		altTimeout = d
+	}
+}
+
+// noopAltGenerator は説明文を生成しない（空altになる）
+type noopAltGenerator struct{}
+
+func (noopAltGenerator) Generate(ctx context.Context, filePath, mime string) (string, error) {
+	return "", nil
+}
+
+// localAltGenerator は画像の形式と寸法だけから簡易な説明文を作る
+type localAltGenerator struct{}
+
+func (localAltGenerator) Generate(ctx context.Context, filePath, mime string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d×%dの%s画像", cfg.Width, cfg.Height, strings.ToUpper(format)), nil
+}
+
+// apiAltGenerator は外部の画像認識APIに画像を送って説明文を得る。
+// APIは画像を本文として受け取り {"alt": "..."} を返すものとする。
+type apiAltGenerator struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (g *apiAltGenerator) Generate(ctx context.Context, filePath, mime string) (string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mime)
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("alt api returned %d", res.StatusCode)
+	}
+
+	var body struct {
+		Alt string `json:"alt"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	return body.Alt, nil
+}
+
+// normalizeImageAlt は説明文の前後の空白を除き、最大長で切り詰める
+func normalizeImageAlt(alt string) string {
+	alt = strings.TrimSpace(normalizeText(alt))
+	if utf8.RuneCountInString(alt) > imageAltMaxLength {
+		alt = string([]rune(alt)[:imageAltMaxLength])
+	}
+	return alt
+}
+
+// formImageAlt は投稿フォームで入力された説明文を返す。
+// 説明文のフォーム名は image_alt だが、alt でも受け付ける。
+//
+// 入力された説明文は自動生成の説明文と同じ image_alt カラムに保存し、image_alt_manual を1にする。
+// 自動生成は image_alt_manual が0の投稿だけを更新するので、入力された説明文は後から上書きされない。
+// 説明文を空にして保存し直すと image_alt_manual は0に戻り、表示は本文の先頭で代用する（altText）。
+func formImageAlt(r *http.Request) string {
+	alt := r.FormValue("image_alt")
+	if alt == "" {
+		alt = r.FormValue("alt")
+	}
+	return normalizeImageAlt(alt)
+}
+
+// altText は<img>のalt属性に出力する文字列を返す。
+// 説明文が無い投稿（既存の投稿や自動生成に失敗した投稿）は本文の先頭で代用する。
+func altText(p Post) string {
+	if p.ImageAlt != "" {
+		return p.ImageAlt
+	}
+	body := strings.Join(strings.Fields(p.Body), " ")
+	if utf8.RuneCountInString(body) > imageAltFallbackLength {
+		body = string([]rune(body)[:imageAltFallbackLength]) + "…"
+	}
+	return body
+}
+
+// generateImageAlt は非同期で説明文を生成して保存する。
+// タイムアウトや失敗時は空altのままにする。手動で設定された説明文は上書きしない。
+func generateImageAlt(pid int, ext, mime, accountName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), altTimeout)
+	defer cancel()
+
+	filePath, err := localImageFile(pid, ext)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	alt, err := altGenerator.Generate(ctx, filePath, mime)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	alt = normalizeImageAlt(alt)
+	if alt == "" {
+		return
+	}
+
+	_, err = db.Exec("UPDATE `posts` SET `image_alt` = ? WHERE `id` = ? AND `image_alt_manual` = 0", alt, pid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	invalidateIndexPosts()
+	memcacheClient.Delete(fmt.Sprintf("account:%s", accountName))
+}
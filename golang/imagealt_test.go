@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// altGeneratorFunc は関数をそのまま説明文の生成エンジンとして使う
+type altGeneratorFunc func(ctx context.Context, filePath, mime string) (string, error)
+
+func (f altGeneratorFunc) Generate(ctx context.Context, filePath, mime string) (string, error) {
+	return f(ctx, filePath, mime)
+}
+
+func useAltGenerator(t *testing.T, g AltGenerator, timeout time.Duration) {
+	oldGenerator, oldTimeout := altGenerator, altTimeout
+	altGenerator, altTimeout = g, timeout
+	t.Cleanup(func() { altGenerator, altTimeout = oldGenerator, oldTimeout })
+}
+
+const updateGeneratedAlt = "UPDATE `posts` SET `image_alt` = ? WHERE `id` = ? AND `image_alt_manual` = 0"
+
+func TestGenerateImageAltFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator altGeneratorFunc
+	}{
+		{"タイムアウト", func(ctx context.Context, filePath, mime string) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}},
+		{"生成エンジンのエラー", func(ctx context.Context, filePath, mime string) (string, error) {
+			return "", errors.New("engine is down")
+		}},
+		{"空の説明文", func(ctx context.Context, filePath, mime string) (string, error) {
+			return "   ", nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := useFakeMemcache(t)
+			useMockDB(t) // 説明文を保存しようとすればモックのエラーになる
+			useAltGenerator(t, tt.generator, 50*time.Millisecond)
+			memcacheClient.Set(&memcache.Item{Key: "index_posts", Value: []byte("cached")})
+
+			start := time.Now()
+			useImageDir(t, 1, "jpg", []byte("jpeg"))
+			generateImageAlt(1, "jpg", "image/jpeg", "alice")
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("generateImageAlt took %s, want to give up after the timeout", elapsed)
+			}
+			// 何も保存しないので一覧のキャッシュも消さない（投稿は空altのまま表示される）
+			if !m.has("index_posts") {
+				t.Error("index cache was invalidated although no alt was saved")
+			}
+		})
+	}
+}
+
+func TestGenerateImageAltSaves(t *testing.T) {
+	m := useFakeMemcache(t)
+	mock := useMockDB(t)
+	useAltGenerator(t, altGeneratorFunc(func(ctx context.Context, filePath, mime string) (string, error) {
+		return "  公園で遊ぶ犬  ", nil
+	}), time.Second)
+	memcacheClient.Set(&memcache.Item{Key: "index_posts", Value: []byte("cached")})
+
+	// 手動で設定された説明文は image_alt_manual で除外され、上書きされない
+	mock.ExpectExec(regexp.QuoteMeta(updateGeneratedAlt)).
+		WithArgs("公園で遊ぶ犬", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	useImageDir(t, 7, "jpg", []byte("jpeg"))
+	generateImageAlt(7, "jpg", "image/jpeg", "alice")
+	if m.has("index_posts") {
+		t.Error("index cache should be invalidated after saving the alt")
+	}
+}
+
+// S3などの配信元を使っていてローカルに画像が無くても、配信元から取ってきて説明文を生成する
+func TestGenerateImageAltRemoteStore(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+	useRemoteImageStore(t, 8, "png", []byte("png image"))
+	useAltGenerator(t, altGeneratorFunc(func(ctx context.Context, filePath, mime string) (string, error) {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		if string(data) != "png image" {
+			return "", fmt.Errorf("read %q", data)
+		}
+		return "海辺の写真", nil
+	}), time.Second)
+
+	mock.ExpectExec(regexp.QuoteMeta(updateGeneratedAlt)).
+		WithArgs("海辺の写真", 8).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	generateImageAlt(8, "png", "image/png", "alice")
+}
+
+func TestPostPostsAltManualOverride(t *testing.T) {
+	tests := []struct {
+		name       string
+		alt        string
+		wantAlt    string
+		wantManual int
+	}{
+		{"手動の説明文は自動生成より優先する", " 夕焼けの海 ", "夕焼けの海", 1},
+		{"空にすると手動設定を解除する", "", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeMemcache(t)
+			mock := useMockDB(t)
+			cookies := loginCookies(t, User{ID: 3, AccountName: "alice"}, "token")
+
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE `posts` SET `image_alt` = ?, `image_alt_manual` = ? WHERE `id` = ? AND `user_id` = ?")).
+				WithArgs(tt.wantAlt, tt.wantManual, 7, 3).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			form := url.Values{"csrf_token": {"token"}, "image_alt": {tt.alt}}
+			r := withCookies(httptest.NewRequest(http.MethodPost, "/posts/7/alt", strings.NewReader(form.Encode())), cookies)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetPathValue("id", "7")
+			w := httptest.NewRecorder()
+			postPostsAlt(w, r)
+
+			if w.Code != http.StatusFound || w.Header().Get("Location") != "/posts/7" {
+				t.Errorf("status = %d, location = %q", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestAltTextFallsBackToBody(t *testing.T) {
+	if got := altText(Post{ImageAlt: "説明", Body: "本文"}); got != "説明" {
+		t.Errorf("altText = %q, want the alt", got)
+	}
+	// 生成に失敗した投稿は本文の先頭で代用する
+	if got := altText(Post{Body: "今日の\n  ランチ"}); got != "今日の ランチ" {
+		t.Errorf("altText = %q, want the body", got)
+	}
+}
+
+func TestNormalizeImageAlt(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"前後の空白を除く", "  犬の写真 \n", "犬の写真"},
+		{"上限ちょうどは切り詰めない", strings.Repeat("あ", imageAltMaxLength), strings.Repeat("あ", imageAltMaxLength)},
+		{"上限を超える分を文字単位で切り詰める", strings.Repeat("あ", imageAltMaxLength+10), strings.Repeat("あ", imageAltMaxLength)},
+		{"ASCIIも文字数で数える", strings.Repeat("a", imageAltMaxLength+1), strings.Repeat("a", imageAltMaxLength)},
+		{"空白だけなら空", " \t ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeImageAlt(tt.in)
+			if got != tt.want {
+				t.Errorf("normalizeImageAlt(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("normalizeImageAlt(%q) is not valid UTF-8", tt.in)
+			}
+		})
+	}
+}
+
+func TestFormImageAlt(t *testing.T) {
+	form := func(v url.Values) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	if got := formImageAlt(form(url.Values{"image_alt": {"A"}, "alt": {"B"}})); got != "A" {
+		t.Errorf("formImageAlt = %q, want image_alt to take precedence", got)
+	}
+	if got := formImageAlt(form(url.Values{"alt": {" B "}})); got != "B" {
+		t.Errorf("formImageAlt = %q, want alt as a fallback", got)
+	}
+}
+
+func TestImageAltXSS(t *testing.T) {
+	tmpl := template.Must(template.New("post.html").Funcs(fmap).ParseFiles(getTemplPath("post.html")))
+
+	for _, p := range []Post{
+		{ImageAlt: `"><script>alert(1)</script>`},
+		{ImageAlt: `" onerror="alert(1)`},
+		// 説明文が無ければ本文で代用するので、本文からの注入も防ぐ
+		{Body: `"><img src=x onerror=alert(1)>`},
+	} {
+		p.ID, p.Mime, p.User = 1, "image/png", User{AccountName: "alice"}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+		got := buf.String()
+		for _, f := range []string{"<script", `" onerror`, "<img src=x"} {
+			if strings.Contains(got, f) {
+				t.Errorf("alt %q / body %q rendered %q, must not contain %q", p.ImageAlt, p.Body, got, f)
+			}
+		}
+		if !strings.Contains(got, `alt="&#34;`) {
+			t.Errorf("alt attribute is not escaped: %s", got)
+		}
+	}
+}
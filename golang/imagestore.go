@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// 画像の保存先について
+//
+// ISUCONP_IMAGE_STORE で配信元を切り替える。
+//   - local（デフォルト）: ../public/image のファイルから配信する
+//   - s3: S3互換のオブジェクトストレージから配信する（ISUCONP_S3_PRESIGN_REDIRECT=1 なら署名付きURLへリダイレクトする）
+//   - tiered: ローカルをキャッシュ、S3をオリジンとして併用する
+//
+// どのモードでもアップロードされた画像はまずローカルに書き出す。向きの補正・説明文・プレースホルダの生成は
+// このファイルを加工・参照するので、加工が終わった後の画像をオリジン（s3・tiered）に保存する。
+//
+// tiered で読むときは ローカル → S3 の順に探し、S3から取得できた画像はローカルにも保存して次回からローカルで返す。
+// S3に障害があってもローカルにある画像は返せる。S3への保存に失敗した画像はログに残し、書き出したホストのローカルから配信する。
+
+// ImageStore は投稿画像の保存先。画像が無ければ Open は fs.ErrNotExist を返す
+type ImageStore interface {
+	Save(id int, ext string, r io.Reader) error
+	Open(id int, ext string) (io.ReadCloser, error)
+	Delete(id int, ext string) error
+}
+
+// imagePresigner は画像を直接取得できる期限付きのURLを発行できる保存先
+type imagePresigner interface {
+	PresignedURL(ctx context.Context, id int, ext string) (string, error)
+}
+
+var (
+	// 加工に使うローカルの画像
+	localImages = &localImageStore{dir: "../public/image"}
+	// 配信元
+	imageStore ImageStore = localImages
+	// 加工後の画像を保存するオリジン。local のときは nil
+	imageOrigin ImageStore
+	// 配信元が署名付きURLを発行できるとき、画像の取得をそのURLへリダイレクトする
+	imagePresignRedirect bool
+)
+
+// initImageStore は ISUCONP_IMAGE_STORE に従って画像の保存先を用意する
+func initImageStore() error {
+	mode := os.Getenv("ISUCONP_IMAGE_STORE")
+	if mode == "" || mode == "local" {
+		return nil
+	}
+
+	origin, err := newS3ImageStore()
+	if err != nil {
+		return err
+	}
+	imageOrigin = origin
+
+	switch mode {
+	case "s3":
+		imageStore = origin
+		imagePresignRedirect = os.Getenv("ISUCONP_S3_PRESIGN_REDIRECT") == "1"
+	case "tiered":
+		imageStore = &tieredImageStore{cache: localImages, origin: origin}
+	default:
+		return fmt.Errorf("unknown ISUCONP_IMAGE_STORE: %s", mode)
+	}
+	return nil
+}
+
+// imageTypes は投稿画像として扱う形式のMIMEタイプと保存時の拡張子。拡張子とMIMEタイプの対応はここにだけ書く
+var imageTypes = []struct {
+	Mime string
+	Ext  string
+}{
+	{"image/jpeg", "jpg"},
+	{"image/png", "png"},
+	{"image/gif", "gif"},
+}
+
+func imageMimeByExt(ext string) string {
+	for _, t := range imageTypes {
+		if t.Ext == ext {
+			return t.Mime
+		}
+	}
+	return "application/octet-stream"
+}
+
+// imageExtByMime は imageMimeByExt の逆。投稿画像として扱えない形式なら空文字を返す
+func imageExtByMime(mime string) string {
+	for _, t := range imageTypes {
+		if t.Mime == mime {
+			return t.Ext
+		}
+	}
+	return ""
+}
+
+var errImageTooLarge = fmt.Errorf("image exceeds %d bytes", UploadLimit)
+
+// readImage は画像を読み込む。UploadLimit を超えるものは途中で切らずにエラーにする
+func readImage(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, UploadLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > UploadLimit {
+		return nil, errImageTooLarge
+	}
+	return data, nil
+}
+
+// localImageStore はディレクトリにファイルとして保存する
+type localImageStore struct {
+	dir string
+}
+
+func (s *localImageStore) path(id int, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d.%s", id, ext))
+}
+
+func (s *localImageStore) Save(id int, ext string, r io.Reader) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	// 書きかけのファイルを配信しないよう一時ファイルに書いてから置き換える
+	filePath := s.path(id, ext)
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func (s *localImageStore) Open(id int, ext string) (io.ReadCloser, error) {
+	return os.Open(s.path(id, ext))
+}
+
+func (s *localImageStore) Delete(id int, ext string) error {
+	err := os.Remove(s.path(id, ext))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// s3ImageStore はS3互換のオブジェクトストレージに {prefix}{id}.{ext} として保存する
+type s3ImageStore struct {
+	client     *s3.Client
+	presigner  *s3.PresignClient
+	bucket     string
+	prefix     string
+	timeout    time.Duration
+	presignTTL time.Duration
+}
+
+// newS3ImageStore は環境変数から設定を読む。認証情報はAWS SDKの標準の方法（環境変数・共有設定・IAMロール）で取得する
+func newS3ImageStore() (*s3ImageStore, error) {
+	bucket := os.Getenv("ISUCONP_S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("ISUCONP_S3_BUCKET is required")
+	}
+
+	s := &s3ImageStore{
+		bucket:     bucket,
+		prefix:     "image/",
+		timeout:    10 * time.Second,
+		presignTTL: 15 * time.Minute,
+	}
+	if v, ok := os.LookupEnv("ISUCONP_S3_PREFIX"); ok {
+		s.prefix = v
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_S3_TIMEOUT")); err == nil && d > 0 {
+		s.timeout = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_S3_PRESIGN_TTL")); err == nil && d > 0 {
+		s.presignTTL = d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	opts := []func(*config.LoadOptions) error{}
+	if region := os.Getenv("ISUCONP_S3_REGION"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// MinIOなどS3互換のストレージを使うときに指定する
+		if endpoint := os.Getenv("ISUCONP_S3_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = os.Getenv("ISUCONP_S3_PATH_STYLE") == "1"
+	})
+	s.presigner = s3.NewPresignClient(s.client)
+	return s, nil
+}
+
+func (s *s3ImageStore) key(id int, ext string) string {
+	return fmt.Sprintf("%s%d.%s", s.prefix, id, ext)
+}
+
+func (s *s3ImageStore) Save(id int, ext string, r io.Reader) error {
+	// 署名と再送のためにボディを読み直せる必要がある
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := readImage(r)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key(id, ext)),
+		Body:        body,
+		ContentType: aws.String(imageMimeByExt(ext)),
+		// 投稿画像は同じIDで中身が変わらない
+		CacheControl: aws.String("public, max-age=31536000, immutable"),
+	})
+	return err
+}
+
+// s3Object は取得したオブジェクトの本文。読み終えて閉じるまでリクエストを打ち切らない
+type s3Object struct {
+	io.ReadCloser
+	size   int64
+	cancel context.CancelFunc
+}
+
+func (o *s3Object) Close() error {
+	defer o.cancel()
+	return o.ReadCloser.Close()
+}
+
+func (o *s3Object) Size() int64 {
+	return o.size
+}
+
+func (s *s3ImageStore) Open(id int, ext string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id, ext)),
+	})
+	if err != nil {
+		cancel()
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	return &s3Object{ReadCloser: out.Body, size: aws.ToInt64(out.ContentLength), cancel: cancel}, nil
+}
+
+func (s *s3ImageStore) Delete(id int, ext string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id, ext)),
+	})
+	return err
+}
+
+func (s *s3ImageStore) PresignedURL(ctx context.Context, id int, ext string) (string, error) {
+	req, err := s.presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id, ext)),
+	}, s3.WithPresignExpires(s.presignTTL))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// tieredImageStore はローカルをキャッシュ、オブジェクトストレージをオリジンとして併用する
+type tieredImageStore struct {
+	cache  *localImageStore
+	origin ImageStore
+}
+
+// Save はキャッシュとオリジンの両方に保存する。キャッシュへの保存の失敗は読むときにオリジンから取り直せるので無視する
+func (s *tieredImageStore) Save(id int, ext string, r io.Reader) error {
+	var buf bytes.Buffer
+	if err := s.origin.Save(id, ext, io.TeeReader(r, &buf)); err != nil {
+		return err
+	}
+	if err := s.cache.Save(id, ext, &buf); err != nil {
+		log.Print(err)
+	}
+	return nil
+}
+
+// Open はキャッシュ → オリジンの順に探す。オリジンにあった画像はキャッシュにも保存する
+func (s *tieredImageStore) Open(id int, ext string) (io.ReadCloser, error) {
+	f, err := s.cache.Open(id, ext)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		log.Print(err)
+	}
+
+	rc, err := s.origin.Open(id, ext)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	if err := s.cache.Save(id, ext, rc); err != nil {
+		return nil, err
+	}
+	return s.cache.Open(id, ext)
+}
+
+// Delete はオリジンとキャッシュの両方から消す
+func (s *tieredImageStore) Delete(id int, ext string) error {
+	if err := s.origin.Delete(id, ext); err != nil {
+		return err
+	}
+	return s.cache.Delete(id, ext)
+}
+
+// localImageFile は加工（説明文・プレースホルダの生成）に使うローカルの画像のパスを返す。
+// ローカルに無ければ（別のホストで投稿された画像など）配信元から取ってきて置く
+func localImageFile(id int, ext string) (string, error) {
+	filePath := localImages.path(id, ext)
+	_, err := os.Stat(filePath)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) || imageStore == ImageStore(localImages) {
+		return filePath, err
+	}
+
+	rc, err := imageStore.Open(id, ext)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if err := localImages.Save(id, ext, rc); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// publishImage は加工し終えたローカルの画像をオリジンに保存する
+func publishImage(id int, ext string) {
+	if imageOrigin == nil {
+		return
+	}
+
+	f, err := localImages.Open(id, ext)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer f.Close()
+
+	if err := imageOrigin.Save(id, ext, f); err != nil {
+		log.Printf("failed to save image %d.%s to origin: %s", id, ext, err)
+	}
+}
+
+// imageSize は画像の大きさが分かれば返す
+func imageSize(rc io.ReadCloser) (int64, bool) {
+	switch v := rc.(type) {
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil {
+			return 0, false
+		}
+		return fi.Size(), true
+	case interface{ Size() int64 }:
+		return v.Size(), v.Size() > 0
+	}
+	return 0, false
+}
+
+// imageExt は staticFilePath と同じく投稿の画像の拡張子を返す
+func imageExt(p Post) string {
+	return strings.TrimPrefix(filepath.Ext(staticFilePath(p)), ".")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageTypes(t *testing.T) {
+	for _, tt := range imageTypes {
+		if got := imageMimeByExt(tt.Ext); got != tt.Mime {
+			t.Errorf("imageMimeByExt(%q) = %q, want %q", tt.Ext, got, tt.Mime)
+		}
+		if got := imageExtByMime(tt.Mime); got != tt.Ext {
+			t.Errorf("imageExtByMime(%q) = %q, want %q", tt.Mime, got, tt.Ext)
+		}
+
+		// 配信するURL・書き出すファイル・保存先の拡張子が一致する
+		p := Post{ID: 3, Mime: tt.Mime}
+		if got, want := imageURL(p), "/image/3."+tt.Ext; got != want {
+			t.Errorf("imageURL(%q) = %q, want %q", tt.Mime, got, want)
+		}
+		if got := filepath.Base(staticFilePath(p)); got != "3."+tt.Ext {
+			t.Errorf("staticFilePath(%q) = %q, want 3.%s", tt.Mime, got, tt.Ext)
+		}
+	}
+
+	if got := imageExtByMime("image/webp"); got != "" {
+		t.Errorf("imageExtByMime(image/webp) = %q, want empty", got)
+	}
+	if got := imageMimeByExt("webp"); got != "application/octet-stream" {
+		t.Errorf("imageMimeByExt(webp) = %q, want application/octet-stream", got)
+	}
+}
+
+func TestReadImage(t *testing.T) {
+	data, err := readImage(bytes.NewReader(make([]byte, UploadLimit)))
+	if err != nil {
+		t.Fatalf("image at the limit: %v", err)
+	}
+	if len(data) != UploadLimit {
+		t.Errorf("read %d bytes, want %d", len(data), UploadLimit)
+	}
+
+	// 上限を超える画像は切り詰めて保存せずエラーにする
+	if _, err := readImage(bytes.NewReader(make([]byte, UploadLimit+1))); !errors.Is(err, errImageTooLarge) {
+		t.Errorf("image over the limit: err = %v, want errImageTooLarge", err)
+	}
+}
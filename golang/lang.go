@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"unicode"
+)
+
+const (
+	// これより文字（記号・空白を除く）が少ない本文は判定せずデフォルト言語にする
+	langMinLetters = 4
+)
+
+var defaultLang = "ja"
+
+func init() {
+	if l := os.Getenv("ISUCONP_DEFAULT_LANG"); l != "" {
+		defaultLang = l
+	}
+}
+
+// detectLang は本文に含まれる文字のUnicodeブロックから主要言語を簡易判定する。
+// 辞書や統計モデルは使わないのでレスポンスをほとんど遅延させない。
+func detectLang(text string) string {
+	var letters, kana, han, hangul, latin, cyrillic, arabic, thai int
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Arabic, r):
+			arabic++
+		case unicode.Is(unicode.Thai, r):
+			thai++
+		}
+	}
+
+	if letters < langMinLetters {
+		return defaultLang
+	}
+
+	// かなが含まれていれば漢字混じりでも日本語とみなす
+	if kana > 0 {
+		return "ja"
+	}
+
+	best, lang := 0, defaultLang
+	for _, c := range []struct {
+		n    int
+		lang string
+	}{
+		{han, "zh"},
+		{hangul, "ko"},
+		{latin, "en"},
+		{cyrillic, "ru"},
+		{arabic, "ar"},
+		{thai, "th"},
+	} {
+		if c.n > best {
+			best, lang = c.n, c.lang
+		}
+	}
+
+	// 判定できる文字が半分に満たなければデフォルトにする
+	if best*2 < letters {
+		return defaultLang
+	}
+
+	return lang
+}
+
+// langAttr はlang属性に出力する言語を返す（未判定の既存データはデフォルト言語）
+func langAttr(lang string) string {
+	if lang == "" {
+		return defaultLang
+	}
+	return lang
+}
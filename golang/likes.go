@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// postPostsLike は投稿へのいいねを切り替える
+func postPostsLike(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	counterKey := likeCountKey(getCacheGeneration(), pid)
+
+	result, err := db.Exec("DELETE FROM `likes` WHERE `user_id` = ? AND `post_id` = ?", me.ID, pid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		incrCounter(counterKey, -1)
+	} else {
+		result, err = db.Exec("INSERT IGNORE INTO `likes` (`user_id`, `post_id`) SELECT ?, `id` FROM `posts` WHERE `id` = ? AND `status` = 'published'", me.ID, pid)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			incrCounter(counterKey, 1)
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", pid), http.StatusFound)
+}
+
+// getAccountLikes はユーザーがいいねした投稿を新しくいいねした順に表示する。
+// いいねを非公開にしているユーザーの場合、本人以外には404を返す。
+func getAccountLikes(w http.ResponseWriter, r *http.Request) {
+	accountName := r.PathValue("accountName")
+
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		} else if redirectRenamedAccount(w, r, accountName) {
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	me := getSessionUser(r)
+	if user.LikesPublic == 0 && me.ID != user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 既存の一覧と同じく時刻のカーソルでページングする（ここではいいねした時刻）
+	var cursor *time.Time
+	if v := r.URL.Query().Get("max_created_at"); v != "" {
+		t, err := time.Parse(ISO8601Format, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		t = normalizeCursorTime(t)
+		cursor = &t
+	}
+
+	type likedPost struct {
+		Post
+		LikedAt time.Time `db:"liked_at"`
+	}
+
+	// バンされたユーザーの投稿は除外する
+	query := "SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, p.`image_alt`, p.`lang`, p.`blurhash`, p.`quoted_post_id`, p.`quote_count`, p.`view_count`, l.`created_at` AS `liked_at` " +
+		"FROM `likes` l JOIN `posts` p ON p.`id` = l.`post_id` JOIN `users` u ON u.`id` = p.`user_id` " +
+		"WHERE l.`user_id` = ? AND p.`status` = 'published' AND u.`del_flg` = 0"
+	args := []interface{}{user.ID}
+	if cursor != nil {
+		query += " AND l.`created_at` < ?"
+		args = append(args, *cursor)
+	}
+	query += " ORDER BY l.`created_at` DESC LIMIT ?"
+	args = append(args, postsPerPage)
+
+	liked := []likedPost{}
+	if err := db.Select(&liked, query, args...); err != nil {
+		log.Print(err)
+		return
+	}
+
+	results := make([]Post, len(liked))
+	for i, lp := range liked {
+		results[i] = lp.Post
+	}
+
+	posts, err := makePosts(results, getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	posts = markMyReactions(filterVisiblePosts(posts, me), me)
+
+	nextCursor := ""
+	if len(liked) == postsPerPage {
+		// いいねの時刻はマイクロ秒精度なので、同じ秒のいいねを取りこぼさないよう小数秒まで渡す
+		nextCursor = liked[len(liked)-1].LikedAt.Format("2006-01-02T15:04:05.000000-07:00")
+	}
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("user_likes.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	)).Execute(w, struct {
+		Posts      []Post
+		User       User
+		NextCursor string
+		Me         User
+		CSRFToken  string
+	}{posts, user, nextCursor, me, getCSRFToken(r)})
+}
+
+// postSettingsLikesPublic はいいねした投稿を公開するかを切り替える
+func postSettingsLikesPublic(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	likesPublic := 0
+	if r.FormValue("likes_public") == "1" {
+		likesPublic = 1
+	}
+
+	_, err := db.Exec("UPDATE `users` SET `likes_public` = ? WHERE `id` = ?", likesPublic, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	memcacheClient.Delete(fmt.Sprintf("user:%d", me.ID))
+
+	http.Redirect(w, r, "/@"+me.AccountName+"/likes", http.StatusFound)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var (
+	// 生HTMLはgoldmarkのデフォルト設定で出力されないが、念のためbluemondayでも落とす
+	// Linkify で本文中のURLを自動でリンクにする
+	markdown = goldmark.New(
+		goldmark.WithExtensions(extension.Table, extension.Linkify),
+	)
+	bodyPolicy = bluemonday.UGCPolicy()
+)
+
+// renderBody は投稿本文をMarkdownとしてレンダリングし、サニタイズ済みのHTMLを返す。
+// 列数が揃っていないテーブルもgoldmarkがベストエフォートで描画する。
+func renderBody(body string) template.HTML {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(body), &buf); err != nil {
+		log.Print(err)
+		return template.HTML(template.HTMLEscapeString(body))
+	}
+
+	html := bodyPolicy.Sanitize(buf.String())
+
+	// 横スクロールできるようテーブルをラッパーで囲む
+	// サニタイズ後の<table>は本文中の文字列ではなく実際のテーブル要素なので安全に置換できる
+	html = strings.ReplaceAll(html, "<table>", `<div class="isu-table-wrapper" style="overflow-x: auto;"><table>`)
+	html = strings.ReplaceAll(html, "</table>", "</table></div>")
+
+	return template.HTML(html)
+}
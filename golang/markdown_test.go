@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderBodyTable(t *testing.T) {
+	body := "| 名前 | 値 |\n| --- | --: |\n| a | 1 |\n| b | 2 |\n"
+	got := string(renderBody(body))
+
+	for _, want := range []string{
+		`<div class="isu-table-wrapper" style="overflow-x: auto;"><table>`,
+		"<th>名前</th>",
+		"<td>a</td>",
+		"</table></div>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("renderBody(%q) = %q, want to contain %q", body, got, want)
+		}
+	}
+}
+
+func TestRenderBodyMalformedTable(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"列が足りない行", "| a | b | c |\n| - | - | - |\n| 1 |\n"},
+		{"列が多い行", "| a | b |\n| - | - |\n| 1 | 2 | 3 | 4 |\n"},
+		{"区切り行が無い", "| a | b |\n| 1 | 2 |\n"},
+		{"閉じていないパイプ", "| a | b\n| - | -\n| 1 | 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(renderBody(tt.body))
+			if got == "" {
+				t.Fatalf("renderBody(%q) is empty", tt.body)
+			}
+			// ラッパーとテーブルの開始・終了が対になっていること
+			if strings.Count(got, "<table>") != strings.Count(got, "</table></div>") {
+				t.Errorf("unbalanced table wrapper: %q", got)
+			}
+		})
+	}
+}
+
+func TestRenderBodyXSS(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		forbidden []string
+	}{
+		{"scriptタグ", "<script>alert(1)</script>", []string{"<script"}},
+		{"テーブル内のscriptタグ", "| a |\n| - |\n| <script>alert(1)</script> |\n", []string{"<script"}},
+		{"イベントハンドラ", `<img src=x onerror="alert(1)">`, []string{"onerror", "<img"}},
+		{"javascriptスキームのリンク", "[click](javascript:alert(1))", []string{"javascript:"}},
+		{"テーブル内のjavascriptリンク", "| a |\n| - |\n| [x](javascript:alert(1)) |\n", []string{"javascript:"}},
+		{"markタグ", "<mark>強調</mark>", []string{"<mark>"}},
+		{"ラッパーの偽装", `<div class="isu-table-wrapper"><table>`, []string{"<div", "<table>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(renderBody(tt.body))
+			for _, f := range tt.forbidden {
+				if strings.Contains(strings.ToLower(got), f) {
+					t.Errorf("renderBody(%q) = %q, must not contain %q", tt.body, got, f)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderBodyMixedWithCode(t *testing.T) {
+	body := "数式 $a | b$ と表:\n\n| x | y |\n| - | - |\n| 1 | 2 |\n\n```\n| not | a | table |\n<script>alert(1)</script>\n```\n"
+	got := string(renderBody(body))
+
+	if strings.Count(got, "<table>") != 1 {
+		t.Errorf("want exactly one table: %q", got)
+	}
+	// コードブロックの中はテーブルにもタグにもならずに表示される
+	if !strings.Contains(got, "| not | a | table |") {
+		t.Errorf("code block was altered: %q", got)
+	}
+	if !strings.Contains(got, "&lt;script&gt;") || strings.Contains(got, "<script") {
+		t.Errorf("script in code block must be escaped: %q", got)
+	}
+	if !strings.Contains(got, "$a | b$") {
+		t.Errorf("inline math was altered: %q", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	muteTargetUser = "user"
+	muteTargetTag  = "tag"
+
+	// ミュートリストのキャッシュの秒数（変更時は削除する）
+	muteListTTL = 600
+)
+
+type Mute struct {
+	TargetType  string `db:"target_type" json:"target_type"`
+	TargetValue string `db:"target_value" json:"target_value"`
+}
+
+// ミュートの判定用に種別ごとにまとめたもの
+type muteSet struct {
+	users map[string]bool
+	tags  map[string]bool
+}
+
+func muteListKey(userID int) string {
+	return fmt.Sprintf("mutes:%d", userID)
+}
+
+// getMutes はユーザーのミュートリストを返す。毎回DBを引かないようキャッシュする
+func getMutes(userID int) ([]Mute, error) {
+	if item, err := memcacheClient.Get(muteListKey(userID)); err == nil {
+		mutes := []Mute{}
+		if err := json.Unmarshal(item.Value, &mutes); err == nil {
+			return mutes, nil
+		}
+	}
+
+	mutes := []Mute{}
+	err := db.Select(&mutes, "SELECT `target_type`, `target_value` FROM `mutes` WHERE `user_id` = ? ORDER BY `id`", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := json.Marshal(mutes); err == nil {
+		memcacheClient.Set(&memcache.Item{Key: muteListKey(userID), Value: data, Expiration: muteListTTL})
+	}
+	return mutes, nil
+}
+
+// filterMutedPosts はログインユーザーがミュートしている投稿者・タグの投稿を除く。
+// 一覧のキャッシュは全員で共有しているので、ミュートは表示する直前に適用する。
+func filterMutedPosts(posts []Post, me User) []Post {
+	if !isLogin(me) {
+		return posts
+	}
+
+	mutes, err := getMutes(me.ID)
+	if err != nil {
+		log.Print(err)
+		return posts
+	}
+	if len(mutes) == 0 {
+		return posts
+	}
+
+	set := muteSet{users: map[string]bool{}, tags: map[string]bool{}}
+	for _, m := range mutes {
+		switch m.TargetType {
+		case muteTargetUser:
+			set.users[m.TargetValue] = true
+		case muteTargetTag:
+			set.tags[m.TargetValue] = true
+		}
+	}
+
+	filtered := make([]Post, 0, len(posts))
+	for _, p := range posts {
+		if !set.mutes(p) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+func (s muteSet) mutes(p Post) bool {
+	if s.users[p.User.AccountName] {
+		return true
+	}
+	if len(s.tags) == 0 {
+		return false
+	}
+	for _, tag := range extractTags(p.Body) {
+		if s.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMute はフォームかクエリからミュート対象を取り出す
+func parseMute(r *http.Request) (Mute, bool) {
+	m := Mute{
+		TargetType:  r.FormValue("target_type"),
+		TargetValue: strings.TrimSpace(r.FormValue("target_value")),
+	}
+	switch m.TargetType {
+	case muteTargetUser:
+	case muteTargetTag:
+		// タグは post_tags と同じく # を除いた小文字で保存する
+		m.TargetValue = strings.ToLower(strings.TrimPrefix(m.TargetValue, "#"))
+	default:
+		return m, false
+	}
+	if m.TargetValue == "" || utf8.RuneCountInString(m.TargetValue) > tagMaxLength {
+		return m, false
+	}
+	return m, true
+}
+
+// getMutesList は自分のミュートリストをJSONで返す
+func getMutesList(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	mutes, err := getMutes(me.ID)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]Mute{"mutes": mutes})
+}
+
+// postMutes はユーザーかタグをミュートする
+func postMutes(w http.ResponseWriter, r *http.Request) {
+	changeMute(w, r, "INSERT IGNORE INTO `mutes` (`user_id`, `target_type`, `target_value`) VALUES (?,?,?)")
+}
+
+// deleteMutes はミュートを解除する。対象はクエリかフォームで指定する
+func deleteMutes(w http.ResponseWriter, r *http.Request) {
+	changeMute(w, r, "DELETE FROM `mutes` WHERE `user_id` = ? AND `target_type` = ? AND `target_value` = ?")
+}
+
+func changeMute(w http.ResponseWriter, r *http.Request, query string) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	m, ok := parseMute(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec(query, me.ID, m.TargetType, m.TargetValue); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	memcacheClient.Delete(muteListKey(me.ID))
+
+	if wantsJSON(r) || r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
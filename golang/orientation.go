@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"os"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const (
+	// 向き・色を補正して再エンコードするときのjpeg品質
+	orientationJPEGQuality = 90
+)
+
+// saveImageDimensions は保存した画像の向き（と有効ならカラープロファイル）を補正し、補正後の寸法を投稿に記録する
+func saveImageDimensions(pid int, filePath string, isJPEG bool) {
+	if isJPEG {
+		if err := normalizeJPEG(filePath); err != nil {
+			log.Print(err)
+		}
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	_, err = db.Exec("UPDATE `posts` SET `width` = ?, `height` = ? WHERE `id` = ?", cfg.Width, cfg.Height, pid)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// normalizeJPEG はjpegのEXIF Orientationに従ってピクセルを回転・反転し、
+// convertToSRGB が有効なら埋め込みのカラープロファイルからsRGBに変換して保存し直す。
+// 再エンコードするとEXIFは残らないのでOrientationは1（無指定）になる。プロファイルは変換しなければそのまま引き継ぐ。
+// どちらの補正も要らない画像は再エンコードしない。
+func normalizeJPEG(filePath string) error {
+	orientation, err := readOrientation(filePath)
+	if err != nil || orientation > 8 {
+		orientation = 1
+	}
+
+	icc, err := readICCProfile(filePath)
+	if err != nil {
+		log.Print(err)
+		icc = nil
+	}
+
+	// プロファイルの無い画像はsRGBとみなす。変換できないプロファイルは元の色のまま保存する
+	var profile *iccProfile
+	if convertToSRGB && icc != nil {
+		p, err := parseICCProfile(icc)
+		if err != nil {
+			log.Printf("keep color profile of %s: %s", filePath, err)
+		} else if !p.isSRGB() {
+			profile = p
+		}
+	}
+
+	if orientation <= 1 && profile == nil {
+		return nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	src, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", filePath, err)
+	}
+
+	dst := src
+	if profile != nil {
+		dst = profile.toSRGB(dst)
+		icc = srgbICCProfile()
+	}
+	if orientation > 1 {
+		dst = applyOrientation(dst, orientation)
+	}
+
+	// 書き込み途中のファイルを配信しないよう一時ファイルに書いてから置き換える
+	tmp := filePath + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := encodeJPEGWithICC(out, dst, orientationJPEGQuality, icc); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("encode %s: %w", filePath, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filePath)
+}
+
+func readOrientation(filePath string) (int, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 0, err
+	}
+	return tag.Int(0)
+}
+
+// applyOrientation はEXIF Orientation（2〜8）の変換を適用した画像を返す。
+// 5〜8は90度回転を含むので幅と高さが入れ替わる。
+func applyOrientation(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // 左右反転
+				dx, dy = w-1-x, y
+			case 3: // 180度回転
+				dx, dy = w-1-x, h-1-y
+			case 4: // 上下反転
+				dx, dy = x, h-1-y
+			case 5: // 左上と右下を結ぶ対角線で反転
+				dx, dy = y, x
+			case 6: // 時計回りに90度回転
+				dx, dy = h-1-y, x
+			case 7: // 右上と左下を結ぶ対角線で反転
+				dx, dy = h-1-y, w-1-x
+			case 8: // 反時計回りに90度回転
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
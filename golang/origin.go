@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	// 状態を変えるリクエストを受け付けるオリジン（scheme://host[:port]）。
+	// 空なら、リクエストの Host と同じオリジンだけを許可する。
+	allowedOrigins = map[string]bool{}
+	// Origin も Referer も無いリクエストを許可するか。
+	// 古いブラウザやプライバシー設定で Referer を送らないクライアントがあるのでデフォルトは許可（CSRFトークンで防ぐ）
+	allowMissingOrigin = true
+)
+
+func init() {
+	if v := os.Getenv("ISUCONP_BASE_URL"); v != "" {
+		if o, ok := originOf(v); ok {
+			allowedOrigins[o] = true
+		} else {
+			log.Printf("invalid ISUCONP_BASE_URL: %s", v)
+		}
+	}
+	for _, v := range strings.Split(os.Getenv("ISUCONP_ALLOWED_ORIGINS"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if o, ok := originOf(v); ok {
+			allowedOrigins[o] = true
+		} else {
+			log.Printf("invalid origin in ISUCONP_ALLOWED_ORIGINS: %s", v)
+		}
+	}
+	if os.Getenv("ISUCONP_MISSING_ORIGIN") == "deny" {
+		allowMissingOrigin = false
+	}
+}
+
+// originOf はURLからオリジンを取り出す。"null" やスキーム・ホストの無い値は不正
+func originOf(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
+
+// requestScheme はクライアントとの間のスキーム。TLSを終端するプロキシの後ろでは X-Forwarded-Proto を見る
+func requestScheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		// 多段のプロキシでは最初のものがクライアントとの間のスキーム
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	return strings.ToLower(scheme)
+}
+
+// requestOrigin はリクエストを受けたこのサイトのオリジン
+func requestOrigin(r *http.Request) string {
+	return strings.ToLower(requestScheme(r) + "://" + r.Host)
+}
+
+func isAllowedOrigin(r *http.Request, origin string) bool {
+	if len(allowedOrigins) > 0 {
+		return allowedOrigins[origin]
+	}
+	return origin == requestOrigin(r)
+}
+
+// validOrigin は Origin ヘッダ（無ければ Referer）が許可したオリジンかを確かめる
+func validOrigin(r *http.Request) bool {
+	if v := r.Header.Get("Origin"); v != "" {
+		o, ok := originOf(v)
+		return ok && isAllowedOrigin(r, o)
+	}
+	if v := r.Header.Get("Referer"); v != "" {
+		o, ok := originOf(v)
+		return ok && isAllowedOrigin(r, o)
+	}
+	return allowMissingOrigin
+}
+
+// checkOrigin は他のサイトのページから送られたフォームを403で拒否するミドルウェア。
+// CSRFトークンの検証はハンドラで引き続き行い、どちらかが破られても防げるようにする。
+func checkOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validOrigin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
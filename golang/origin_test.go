@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useOriginConfig はテストの間だけ許可するオリジンの設定を差し替える
+func useOriginConfig(t *testing.T, origins []string, allowMissing bool) {
+	t.Helper()
+
+	oldOrigins, oldMissing := allowedOrigins, allowMissingOrigin
+	allowedOrigins = map[string]bool{}
+	for _, o := range origins {
+		allowedOrigins[o] = true
+	}
+	allowMissingOrigin = allowMissing
+	t.Cleanup(func() {
+		allowedOrigins, allowMissingOrigin = oldOrigins, oldMissing
+	})
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string // 空なら Host と同じオリジンだけを許可する
+		path    string
+		header  map[string]string
+		want    int
+	}{
+		// 同じサイトの別のページから送られたフォーム
+		{"トップページから投稿", nil, "/", map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		{"投稿ページからコメント", nil, "/comment", map[string]string{"Referer": "http://example.com/posts/1?all_comments=1"}, http.StatusOK},
+		{"ログインページからログイン", nil, "/login", map[string]string{"Referer": "http://example.com/login"}, http.StatusOK},
+		{"ホスト名の大文字小文字", nil, "/comment", map[string]string{"Origin": "http://EXAMPLE.com"}, http.StatusOK},
+		{"TLSを終端するプロキシの後ろ", nil, "/comment", map[string]string{"Origin": "https://example.com", "X-Forwarded-Proto": "https"}, http.StatusOK},
+		{"OriginがあればRefererは見ない", nil, "/comment", map[string]string{"Origin": "http://example.com", "Referer": "http://other.example/"}, http.StatusOK},
+		{"許可したオリジンの別ホスト", []string{"https://www.example.com", "https://m.example.com"}, "/comment", map[string]string{"Referer": "https://m.example.com/posts/1"}, http.StatusOK},
+		{"Referer無し", nil, "/login", nil, http.StatusOK},
+
+		// 他のサイトから送られたフォーム
+		{"他のサイト", nil, "/comment", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"他のサイトのReferer", nil, "/comment", map[string]string{"Referer": "http://evil.example/posts/1"}, http.StatusForbidden},
+		{"前方一致する別ホスト", nil, "/comment", map[string]string{"Origin": "http://example.com.evil.example"}, http.StatusForbidden},
+		{"スキームが違う", nil, "/comment", map[string]string{"Origin": "https://example.com"}, http.StatusForbidden},
+		{"nullオリジン", nil, "/comment", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"許可していないオリジン", []string{"https://www.example.com"}, "/comment", map[string]string{"Origin": "http://example.com"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useOriginConfig(t, tt.origins, true)
+
+			r := httptest.NewRequest(http.MethodPost, "http://example.com"+tt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			checkOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOriginMissingDenied(t *testing.T) {
+	useOriginConfig(t, nil, false)
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/comment", nil)
+	if validOrigin(r) {
+		t.Error("request without Origin and Referer must be rejected when ISUCONP_MISSING_ORIGIN=deny")
+	}
+	r.Header.Set("Referer", "http://example.com/posts/1")
+	if !validOrigin(r) {
+		t.Error("form from another page of the same site must be accepted")
+	}
+}
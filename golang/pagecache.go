@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ページキャッシュ（HTMLレスポンス全体のキャッシュ）について
+//
+// 未ログインのGETだけを短いTTLでキャッシュし、ログインユーザーはCSRFトークンなど
+// ユーザーごとの値を含むので常にバイパスする。投稿・コメント時にページキャッシュは
+// 無効化せずTTL切れに任せるので、index_posts・account:* などのデータキャッシュは
+// そのまま残し、ログインユーザーの表示とページキャッシュのミス時に使う。
+// 二重に持つのはTTL（数秒）の間だけになる。
+
+var pageCacheTTL int32 = 2
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_PAGE_CACHE_TTL")); err == nil && n >= 0 {
+		pageCacheTTL = int32(n)
+	}
+}
+
+type cachedPage struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// pageCacheRecorder はクライアントに書き込みつつレスポンスを記録する
+type pageCacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *pageCacheRecorder) WriteHeader(status int) {
+	// 103 Early Hints などの1xxは最終レスポンスではないので記録しない
+	if status >= 200 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *pageCacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// pageCache はホワイトリストに登録したルートのレスポンスをキャッシュするミドルウェア
+func pageCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pageCacheTTL == 0 || r.Method != http.MethodGet || !isAnonymousRequest(r) ||
+			strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := pageCacheKey(r)
+		if item, err := memcacheClient.Get(key); err == nil {
+			var page cachedPage
+			if err := json.Unmarshal(item.Value, &page); err == nil {
+				for k, v := range page.Header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("X-Page-Cache", "HIT")
+				w.WriteHeader(page.Status)
+				w.Write(page.Body)
+				return
+			}
+		}
+
+		rec := &pageCacheRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if !isCacheablePage(rec) {
+			return
+		}
+
+		data, err := json.Marshal(cachedPage{Status: rec.status, Header: rec.Header().Clone(), Body: rec.body.Bytes()})
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		memcacheClient.Set(&memcache.Item{Key: key, Value: data, Expiration: pageCacheTTL})
+	})
+}
+
+// isAnonymousRequest は未ログインで、表示すると消えるフラッシュも持たないリクエストかを判定する
+func isAnonymousRequest(r *http.Request) bool {
+	if _, err := r.Cookie(sessionName); err != nil {
+		return true
+	}
+	session := getSession(r)
+	if _, ok := session.Values["user_id"]; ok {
+		return false
+	}
+	// getFlash は表示したフラッシュをセッションから消す副作用があるのでキャッシュしない
+	if _, ok := session.Values["notice"]; ok {
+		return false
+	}
+	return true
+}
+
+// pageCacheKey はメソッド・パス・クエリに加え、レスポンスを出し分けるAcceptをキーにする
+func pageCacheKey(r *http.Request) string {
+	sum := sha1.Sum([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + r.Header.Get("Accept")))
+	return "page:" + hex.EncodeToString(sum[:])
+}
+
+// isCacheablePage はレスポンスの Cache-Control・Vary・Set-Cookie からキャッシュしてよいかを判定する
+func isCacheablePage(rec *pageCacheRecorder) bool {
+	if rec.status != http.StatusOK {
+		return false
+	}
+	h := rec.Header()
+	if h.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := h.Get("Cache-Control")
+	if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") || strings.Contains(cc, "no-cache") {
+		return false
+	}
+	// キーに含めていないヘッダで出し分けるレスポンスはキャッシュしない
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+			case "Accept", "Accept-Encoding", "":
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 編集フォームのhidden fieldとETagに使う updated_at の表現（マイクロ秒まで）
+const updatedAtFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func postETag(p Post) string {
+	return fmt.Sprintf(`"%d"`, p.UpdatedAt.UnixMicro())
+}
+
+// getPostsEdit は自分の投稿の編集フォームを表示する
+func getPostsEdit(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	post, ok := findOwnPost(w, r, me)
+	if !ok {
+		return
+	}
+
+	renderPostEdit(w, r, me, post, http.StatusOK, "")
+}
+
+func renderPostEdit(w http.ResponseWriter, r *http.Request, me User, post Post, status int, notice string) {
+	w.Header().Set("ETag", postETag(post))
+	w.Header().Set("Last-Modified", post.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	if wantsJSON(r) {
+		res := map[string]interface{}{"post": newAPIPost(post), "updated_at": post.UpdatedAt.Format(updatedAtFormat)}
+		if notice != "" {
+			res["error"] = notice
+		}
+		writeJSON(w, status, res)
+		return
+	}
+
+	w.WriteHeader(status)
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("post_edit.html"),
+	)).Execute(w, struct {
+		Post      Post
+		UpdatedAt string
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{post, post.UpdatedAt.Format(updatedAtFormat), me, getCSRFToken(r), notice})
+}
+
+func findOwnPost(w http.ResponseWriter, r *http.Request, me User) (Post, bool) {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return Post{}, false
+	}
+
+	post := Post{}
+	err = db.Get(&post, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `updated_at` FROM `posts` WHERE `id` = ? AND `user_id` = ? AND `status` <> ?", pid, me.ID, postStatusPreparing)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return Post{}, false
+	}
+	return post, true
+}
+
+// postPostsEdit は投稿本文を更新する。
+// 編集を始めた時点の updated_at（フォームの updated_at、If-Match、If-Unmodified-Since のいずれか）と
+// 現在の値が一致するときだけ更新し、他の変更があれば409で最新版を返す。
+func postPostsEdit(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	post, ok := findOwnPost(w, r, me)
+	if !ok {
+		return
+	}
+
+	body := normalizeText(r.FormValue("body"))
+	query := "UPDATE `posts` SET `body` = ?, `lang` = ?, `updated_at` = NOW(6) WHERE `id` = ? AND `user_id` = ?"
+	args := []interface{}{body, detectLang(body), post.ID, me.ID}
+
+	switch {
+	case r.FormValue("updated_at") != "":
+		t, err := time.Parse(updatedAtFormat, r.FormValue("updated_at"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query += " AND `updated_at` = ?"
+		args = append(args, t)
+	case r.Header.Get("If-Match") != "":
+		us, err := strconv.ParseInt(strings.Trim(r.Header.Get("If-Match"), `"`), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		query += " AND `updated_at` = ?"
+		args = append(args, time.UnixMicro(us))
+	case r.Header.Get("If-Unmodified-Since") != "":
+		// HTTP日付は秒精度なので、その秒の終わりまでの更新は変更なしとみなす
+		t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query += " AND `updated_at` < ?"
+		args = append(args, t.Add(time.Second))
+	default:
+		// どの版を編集したか分からない更新は後勝ちで上書きしてしまうので受け付けない
+		w.WriteHeader(http.StatusPreconditionRequired)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 変更前の本文は更新と同じトランザクションで読み、同時に行われた他の編集と取り違えないようにする
+	before := ""
+	if err := tx.Get(&before, "SELECT `body` FROM `posts` WHERE `id` = ? FOR UPDATE", post.ID); err != nil {
+		log.Print(err)
+		return
+	}
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		latest, ok := findOwnPost(w, r, me)
+		if !ok {
+			return
+		}
+		renderPostEdit(w, r, me, latest, http.StatusConflict, "他の変更があります。最新の内容を確認してから編集し直してください")
+		return
+	}
+
+	if before != body {
+		if err := savePostRevision(tx, post.ID, before, me.ID); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM `post_tags` WHERE `post_id` = ?", post.ID); err != nil {
+		log.Print(err)
+	}
+	savePostTags(post.ID, body)
+	go indexPost(post.ID)
+
+	invalidateIndexPosts()
+	memcacheClient.Delete(fmt.Sprintf("account:%s", me.AccountName))
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", post.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectOwnPost(mock sqlmock.Sqlmock, body string, updatedAt time.Time) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM `posts` WHERE `id` = ? AND `user_id` = ? AND `status` <> ?")).
+		WithArgs(7, 3, postStatusPreparing).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "body", "mime", "created_at", "updated_at"}).
+			AddRow(7, 3, body, "image/png", updatedAt.Add(-time.Hour), updatedAt))
+}
+
+func TestPostPostsEditConflict(t *testing.T) {
+	editedAt := time.Date(2024, 1, 1, 12, 0, 0, 123456000, time.UTC)     // 編集を始めた時点
+	concurrentAt := time.Date(2024, 1, 1, 12, 0, 3, 654321000, time.UTC) // 他の編集で更新された時刻
+
+	tests := []struct {
+		name      string
+		form      url.Values
+		header    map[string]string
+		condition string
+		arg       time.Time
+	}{
+		{"フォームのupdated_at", url.Values{"updated_at": {editedAt.Format(updatedAtFormat)}}, nil, "`updated_at` = ?", editedAt},
+		{"If-Match", nil, map[string]string{"If-Match": `"` + strconv.FormatInt(editedAt.UnixMicro(), 10) + `"`}, "`updated_at` = ?", editedAt},
+		{"If-Unmodified-Since", nil, map[string]string{"If-Unmodified-Since": editedAt.Format(http.TimeFormat)}, "`updated_at` < ?", editedAt.Truncate(time.Second).Add(time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeMemcache(t)
+			mock := useMockDB(t)
+			cookies := loginCookies(t, User{ID: 3, AccountName: "alice"}, "token")
+
+			expectOwnPost(mock, "編集前", editedAt)
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT `body` FROM `posts` WHERE `id` = ? FOR UPDATE")).
+				WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"body"}).AddRow("他の人の編集"))
+			// 他の編集で updated_at が変わっているので1行も更新されない
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE `posts` SET `body` = ?, `lang` = ?, `updated_at` = NOW(6) WHERE `id` = ? AND `user_id` = ? AND "+tt.condition)).
+				WithArgs("私の編集", sqlmock.AnyArg(), 7, 3, sameTime(tt.arg)).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectRollback()
+			expectOwnPost(mock, "他の人の編集", concurrentAt)
+
+			form := url.Values{"csrf_token": {"token"}, "body": {"私の編集"}}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			r := withCookies(httptest.NewRequest(http.MethodPost, "/posts/7/edit", strings.NewReader(form.Encode())), cookies)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", "application/json")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			r.SetPathValue("id", "7")
+			w := httptest.NewRecorder()
+			postPostsEdit(w, r)
+
+			if w.Code != http.StatusConflict {
+				t.Fatalf("status = %d, want 409", w.Code)
+			}
+			// 最新版を返して編集し直せるようにする
+			res := struct {
+				Post struct {
+					Body string `json:"body"`
+				} `json:"post"`
+				UpdatedAt string `json:"updated_at"`
+				Error     string `json:"error"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Post.Body != "他の人の編集" || res.UpdatedAt != concurrentAt.Format(updatedAtFormat) || res.Error == "" {
+				t.Errorf("response = %+v, want the latest version", res)
+			}
+			if got := w.Header().Get("ETag"); got != postETag(Post{UpdatedAt: concurrentAt}) {
+				t.Errorf("ETag = %q, want the latest version", got)
+			}
+		})
+	}
+}
+
+func TestPostPostsEditRequiresVersion(t *testing.T) {
+	useFakeMemcache(t)
+	mock := useMockDB(t)
+	cookies := loginCookies(t, User{ID: 3, AccountName: "alice"}, "token")
+	expectOwnPost(mock, "編集前", time.Now())
+
+	// どの版を編集したか分からない更新は後勝ちの上書きになるので受け付けない
+	form := url.Values{"csrf_token": {"token"}, "body": {"私の編集"}}
+	r := withCookies(httptest.NewRequest(http.MethodPost, "/posts/7/edit", strings.NewReader(form.Encode())), cookies)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetPathValue("id", "7")
+	w := httptest.NewRecorder()
+	postPostsEdit(w, r)
+
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("status = %d, want 428", w.Code)
+	}
+}
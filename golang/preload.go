@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var (
+	// ページのレスポンスに Link: rel=preload を付けるか（既定では付けない）
+	preloadHints = os.Getenv("ISUCONP_PRELOAD_HINTS") == "1"
+	// プリロードのうちCSS・JSを 103 Early Hints で先に送るか。preloadHints が有効なときだけ使う
+	earlyHints = os.Getenv("ISUCONP_EARLY_HINTS") == "1"
+	// プリロードする画像の数。ファーストビューに出る数枚に限り、帯域を取り合わないようにする
+	preloadImageCount = 3
+)
+
+// ページ共通で読み込むアセット（layout.html と揃える）
+var preloadAssets = []struct {
+	path string
+	as   string
+}{
+	{"/css/style.css", "style"},
+	{"/js/timeago.min.js", "script"},
+	{"/js/main.js", "script"},
+}
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_PRELOAD_IMAGES")); err == nil && n >= 0 {
+		preloadImageCount = n
+	}
+}
+
+// sendEarlyHints はCSS・JSのプリロードヒントを付け、有効なら 103 Early Hints で先に送る。
+// DBアクセスより前に呼ぶと、その間にブラウザがアセットを取りに行ける。
+// 103 を解釈しないクライアントも無視するだけだが、HTTP/1.0 には1xxを送れないので送らない。
+func sendEarlyHints(w http.ResponseWriter, r *http.Request) {
+	if !preloadHints {
+		return
+	}
+	for _, a := range preloadAssets {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=%s", asset(a.path), a.as))
+	}
+	if earlyHints && r.ProtoAtLeast(1, 1) {
+		// 送ったヘッダは最終レスポンスにも残るので、103 を受け取れなかったクライアントにも届く
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+}
+
+// addImagePreloads は表示する投稿のうち先頭の数枚の画像にプリロードヒントを付ける
+func addImagePreloads(w http.ResponseWriter, posts []Post) {
+	if !preloadHints {
+		return
+	}
+	n := 0
+	for _, p := range posts {
+		if n >= preloadImageCount {
+			return
+		}
+		if p.Mime == "" {
+			continue
+		}
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=image", imageURL(p)))
+		n++
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 予約だけしてcommitされていない投稿を残しておく時間
+var preparedPostTTL = 10 * time.Minute
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_PREPARED_POST_TTL")); err == nil && d > 0 {
+		preparedPostTTL = d
+	}
+}
+
+// postAPIPostsPrepare は投稿のIDを先に予約して返す。
+// フロントは返されたURLで投稿を楽観的に表示し、後から /api/posts/{id}/commit で確定する。
+// 予約中の投稿は一覧・詳細のどこにも表示しない。
+func postAPIPostsPrepare(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	// 予約を連投の抜け道にしないよう、予約の時点で投稿の頻度制限を数える
+	if ok, retryAfter := allowPost(me); !ok {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `status`, `created_at`) VALUES (?,'',?,'',?,NOW(6))",
+		me.ID,
+		[]byte{},
+		postStatusPreparing,
+	)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pid, err := result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":         pid,
+		"url":        fmt.Sprintf("/posts/%d", pid),
+		"expires_at": time.Now().Add(preparedPostTTL).Format(ISO8601Format),
+	})
+}
+
+// postAPIPostsCommit は予約した投稿に本文・画像を入れて公開する。
+// 予約した本人だけが1回だけ確定できる。
+func postAPIPostsCommit(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		file, header = nil, nil
+	}
+
+	body := normalizeText(r.FormValue("body"))
+
+	mime, ext, err := validateUpload(file, header)
+	if err != nil {
+		var uerr *UploadError
+		if !errors.As(err, &uerr) {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if uerr.Kind != UploadErrorMissing || !allowTextPost || strings.TrimSpace(body) == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": uerr.Notice()})
+			return
+		}
+		mime, ext = "", ""
+	}
+
+	geo, err := parseGeo(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "位置情報は緯度-90〜90、経度-180〜180で指定してください"})
+		return
+	}
+	if mime != "" {
+		fillGeoFromExif(r, &geo, file, mime)
+	}
+
+	imageAlt := formImageAlt(r)
+	imageAltManual := 0
+	if imageAlt != "" {
+		imageAltManual = 1
+	}
+
+	// 予約中の状態から公開へは1回しか変えられないので、二重commitはここで弾かれる
+	result, err := db.Exec(
+		"UPDATE `posts` SET `mime` = ?, `body` = ?, `image_alt` = ?, `image_alt_manual` = ?, `lang` = ?, "+
+			"`lat` = ?, `lng` = ?, `geo_public` = ?, `status` = ?, `created_at` = NOW(6), `updated_at` = NOW(6) "+
+			"WHERE `id` = ? AND `user_id` = ? AND `status` = ?",
+		mime, body, imageAlt, imageAltManual, detectLang(body),
+		geo.Lat, geo.Lng, geo.Public, postStatusPublished,
+		pid, me.ID, postStatusPreparing,
+	)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		var owner int
+		err := db.Get(&owner, "SELECT `user_id` FROM `posts` WHERE `id` = ?", pid)
+		switch {
+		case err == nil && owner == me.ID:
+			// 確定済み
+			w.WriteHeader(http.StatusConflict)
+		case err == nil || errors.Is(err, sql.ErrNoRows):
+			// 他人の予約か、期限切れで削除された予約
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	savePostTags(pid, body)
+
+	if mime != "" {
+		saveStaticFile(pid, ext, file)
+
+		if imageAltManual == 0 {
+			go generateImageAlt(pid, ext, mime, me.AccountName)
+		}
+		enqueueBlurhash(pid, ext, me.AccountName)
+	}
+
+	go indexPost(pid)
+	notifyWebhooks(webhookEventPostCreated, pid)
+
+	// 予約したIDは最新の投稿IDより小さいことがあるので、一覧のキャッシュも直接消す
+	memcacheClient.Delete("latest_post_id")
+	invalidateIndexPosts()
+	memcacheClient.Delete(fmt.Sprintf("account:%s", me.AccountName))
+
+	p := Post{}
+	if err := db.Get(&p, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count` FROM `posts` WHERE `id` = ?", pid); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIPost(p))
+}
+
+// cleanupPreparedPosts は期限までにcommitされなかった予約を定期的に削除する
+func cleanupPreparedPosts() {
+	ticker := time.NewTicker(preparedPostTTL / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := db.Exec("DELETE FROM `posts` WHERE `status` = ? AND `created_at` < ?", postStatusPreparing, time.Now().Add(-preparedPostTTL))
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// プレビューできる本文の最大バイト数
+	previewMaxBytes = 64 * 1024
+)
+
+// 1ユーザーが1分間にプレビューできる回数
+var previewRateLimit uint64 = 30
+
+func init() {
+	if n, err := strconv.ParseUint(os.Getenv("ISUCONP_PREVIEW_RATE_LIMIT"), 10, 64); err == nil && n > 0 {
+		previewRateLimit = n
+	}
+}
+
+// allowPreview は1分ごとの回数を数え、上限以内なら true を返す
+func allowPreview(userID int) (bool, int) {
+	return checkRate(fmt.Sprintf("preview_rate:%d", userID), previewRateLimit, time.Minute)
+}
+
+// postAPIPreview は保存せずに本文をレンダリングした結果を返す。
+// target=comment のときはコメントの表示と同じテンプレートでレンダリングする。
+func postAPIPreview(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !validCSRFHeader(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if ok, retryAfter := allowPreview(me.ID); !ok {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, previewMaxBytes)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var html template.HTML
+	if r.FormValue("target") == "comment" {
+		var err error
+		html, err = renderCommentText(r.FormValue("body"))
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else {
+		html = renderBody(r.FormValue("body"))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"html": string(html)})
+}
+
+// renderCommentText は保存時と同じ正規化をしたコメントを、表示と同じ post.html の comment_text でレンダリングする
+func renderCommentText(body string) (template.HTML, error) {
+	comment := normalizeText(body)
+	tmpl, err := template.New("post.html").Funcs(fmap).ParseFiles(getTemplPath("post.html"))
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "comment_text", Comment{Comment: comment, Lang: detectLang(comment)}); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPostAPIPreviewComment(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+	cookies := loginCookies(t, User{ID: 1, AccountName: "alice"}, "token")
+
+	preview := func(target, body string) string {
+		t.Helper()
+		form := url.Values{"target": {target}, "body": {body}}
+		r := withCookies(httptest.NewRequest(http.MethodPost, "/api/preview", strings.NewReader(form.Encode())), cookies)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set(xsrfHeaderName, "token")
+		w := httptest.NewRecorder()
+		postAPIPreview(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+		res := map[string]string{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res["html"]
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		forbidden []string
+	}{
+		{"scriptタグ", "<script>alert(1)</script>", []string{"<script"}},
+		{"属性からの脱出", `"><img src=x onerror=alert(1)>`, []string{"<img"}},
+		{"javascriptスキームのリンク", "[click](javascript:alert(1))", []string{"<a", "href"}},
+		{"Markdownは解釈しない", "**太字** <b>太字</b>", []string{"<strong>", "<b>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := preview("comment", tt.body)
+			for _, f := range tt.forbidden {
+				if strings.Contains(got, f) {
+					t.Errorf("preview(%q) = %q, must not contain %q", tt.body, got, f)
+				}
+			}
+		})
+	}
+
+	// 保存後の表示と同じHTMLになる
+	body := "  <i>こんにちは</i> & \"quote\"  "
+	got := preview("comment", body)
+	comment := normalizeText(body)
+	var buf bytes.Buffer
+	tmpl := template.Must(template.New("post.html").Funcs(fmap).ParseFiles(getTemplPath("post.html")))
+	post := Post{ID: 1, User: User{AccountName: "alice"}, Comments: []Comment{{ID: 1, Comment: comment, Lang: detectLang(comment), User: User{AccountName: "bob"}}}}
+	if err := tmpl.Execute(&buf, post); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), got) {
+		t.Errorf("preview %q does not match the displayed comment:\n%s", got, buf.String())
+	}
+
+	// 投稿本文はMarkdownとしてレンダリングする
+	if got := preview("post", "**太字**"); !strings.Contains(got, "<strong>太字</strong>") {
+		t.Errorf("post preview = %q, want markdown", got)
+	}
+}
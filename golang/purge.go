@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 1回のDELETEで削除する最大件数（長時間のロックを避ける）
+	purgeBatchSize = 500
+	// バッチ間の待ち時間（他のリクエストの処理を妨げないため）
+	purgeBatchInterval = 10 * time.Millisecond
+)
+
+// purgeUserContent はユーザーの全投稿（付随するコメント・いいね・画像ファイル）と
+// 全コメントを物理削除し、関連するキャッシュを無効化する。
+// 件数が多くてもテーブルを長くロックしないようバッチに分けて削除する。
+func purgeUserContent(userID int) (purgedPosts, purgedComments int, err error) {
+	// 件数が変わるアカウントページのキャッシュを消すため、削除前に関係するユーザーを集める
+	accountNames := []string{}
+	err = db.Select(&accountNames, "SELECT `account_name` FROM `users` WHERE `id` = ? "+
+		"UNION SELECT u.`account_name` FROM `comments` c JOIN `posts` p ON p.`id` = c.`post_id` JOIN `users` u ON u.`id` = p.`user_id` WHERE c.`user_id` = ? "+
+		"UNION SELECT u.`account_name` FROM `posts` p JOIN `comments` c ON c.`post_id` = p.`id` JOIN `users` u ON u.`id` = c.`user_id` WHERE p.`user_id` = ?",
+		userID, userID, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	// 他のユーザーの投稿に付けたコメントも消すので、その投稿のコメント数も数え直させる
+	commentedPostIDs := []int{}
+	err = db.Select(&commentedPostIDs, "SELECT DISTINCT `post_id` FROM `comments` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		posts := []Post{}
+		err = db.Select(&posts, "SELECT `id`, `mime` FROM `posts` WHERE `user_id` = ? ORDER BY `id` LIMIT ?", userID, purgeBatchSize)
+		if err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		if len(posts) == 0 {
+			break
+		}
+
+		postIDs := make([]int, len(posts))
+		for i, p := range posts {
+			postIDs[i] = p.ID
+		}
+
+		// 他のユーザーが付けたコメントも投稿と一緒に消す
+		n, err := execIn("DELETE FROM `comments` WHERE `post_id` IN (?)", postIDs)
+		if err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		purgedComments += n
+
+		if _, err := execIn("DELETE FROM `likes` WHERE `post_id` IN (?)", postIDs); err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		if _, err := execIn("DELETE FROM `reactions` WHERE `post_id` IN (?)", postIDs); err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		if _, err := execIn("DELETE FROM `post_tags` WHERE `post_id` IN (?)", postIDs); err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		if _, err := execIn("DELETE FROM `post_revisions` WHERE `post_id` IN (?)", postIDs); err != nil {
+			return purgedPosts, purgedComments, err
+		}
+
+		n, err = execIn("DELETE FROM `posts` WHERE `id` IN (?)", postIDs)
+		if err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		purgedPosts += n
+
+		for _, p := range posts {
+			if p.Mime != "" {
+				removeStaticFile(p)
+			}
+			go deleteFromIndex(p.ID)
+		}
+
+		time.Sleep(purgeBatchInterval)
+	}
+
+	for {
+		result, err := db.Exec("DELETE FROM `comments` WHERE `user_id` = ? LIMIT ?", userID, purgeBatchSize)
+		if err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return purgedPosts, purgedComments, err
+		}
+		purgedComments += int(n)
+		if n < purgeBatchSize {
+			break
+		}
+
+		time.Sleep(purgeBatchInterval)
+	}
+
+	gen := getCacheGeneration()
+	for _, pid := range commentedPostIDs {
+		memcacheClient.Delete(commentCountKey(gen, pid))
+	}
+	invalidateIndexPosts()
+	for _, name := range accountNames {
+		memcacheClient.Delete(fmt.Sprintf("account:%s", name))
+	}
+
+	return purgedPosts, purgedComments, nil
+}
+
+// execIn は IN (?) を含むクエリを実行し、影響を受けた行数を返す
+func execIn(query string, ids []int) (int, error) {
+	q, args, err := sqlx.In(query, ids)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// removeStaticFile は投稿の静的画像ファイルを削除する（オリジンに保存していればオリジンからも消す）
+func removeStaticFile(p Post) {
+	err := os.Remove(staticFilePath(p))
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err)
+	}
+	if imageOrigin != nil {
+		if err := imageOrigin.Delete(p.ID, imageExt(p)); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// purgeBannedUserContent はバンしたユーザーのコンテンツを削除し、件数を ban_logs に記録する
+func purgeBannedUserContent(userID int, banLogID int64) {
+	posts, comments, err := purgeUserContent(userID)
+	if err != nil {
+		log.Printf("purge user %d: %s", userID, err)
+	}
+
+	// 途中で失敗しても削除できた分の件数は残す
+	_, err = db.Exec("UPDATE `ban_logs` SET `purged_posts` = ?, `purged_comments` = ? WHERE `id` = ?", posts, comments, banLogID)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 引用を埋め込んで表示する深さ。引用元の引用までは展開し、それより先はリンクにする
+	quoteEmbedDepth = 2
+)
+
+// fetchQuotedPosts は投稿が引用している投稿を、引用元の引用まで一括で取得する。
+// 公開されていない投稿は含めないので、見つからなければ表示できない引用として扱う。
+func fetchQuotedPosts(results []Post) (map[int]Post, error) {
+	quoted := map[int]Post{}
+
+	posts := results
+	for depth := 0; depth < quoteEmbedDepth; depth++ {
+		ids := []int{}
+		for _, p := range posts {
+			if !p.QuotedPostID.Valid {
+				continue
+			}
+			id := int(p.QuotedPostID.Int64)
+			if _, ok := quoted[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		query, args, err := sqlx.In("SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count` FROM `posts` WHERE `id` IN (?) AND `status` = 'published'", ids)
+		if err != nil {
+			return nil, err
+		}
+		fetched := []Post{}
+		if err := db.Select(&fetched, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, p := range fetched {
+			quoted[p.ID] = p
+		}
+		posts = fetched
+	}
+
+	return quoted, nil
+}
+
+// embedQuoted は引用元の投稿を p.Quoted に埋め込む。
+// 削除・非公開・バンされたユーザーの投稿は QuotedUnavailable にする。
+// depth を使い切った先の引用は埋め込まず、テンプレートでリンクだけ表示する。
+func embedQuoted(p *Post, quoted map[int]Post, users map[int]User, depth int) {
+	if !p.QuotedPostID.Valid || depth == 0 {
+		return
+	}
+
+	q, ok := quoted[int(p.QuotedPostID.Int64)]
+	if !ok {
+		p.QuotedUnavailable = true
+		return
+	}
+	q.User = users[q.UserID]
+	if q.User.DelFlg != 0 {
+		p.QuotedUnavailable = true
+		return
+	}
+
+	embedQuoted(&q, quoted, users, depth-1)
+	p.Quoted = &q
+}
+
+// hideInvisibleQuote は viewer に見せられない引用元をプレースホルダにする。
+// 埋め込まれた投稿はキャッシュと共有しているので、書き換えるときはコピーする。
+func hideInvisibleQuote(p *Post, viewer User) {
+	if p.Quoted == nil {
+		return
+	}
+	if !canView(viewer, p.Quoted.User) {
+		p.Quoted = nil
+		p.QuotedUnavailable = true
+		return
+	}
+	q := *p.Quoted
+	hideInvisibleQuote(&q, viewer)
+	p.Quoted = &q
+}
+
+// postPostsQuote は投稿を引用してコメント付きで再投稿する
+func postPostsQuote(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	qid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if isBotSubmission(r) {
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d", qid), http.StatusSeeOther)
+		return
+	}
+
+	// 見ることのできない投稿は引用できない
+	var author User
+	err = db.Get(&author, "SELECT u.* FROM `posts` p JOIN `users` u ON u.`id` = p.`user_id` WHERE p.`id` = ? AND p.`status` = 'published'", qid)
+	if err != nil || !canView(me, author) {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 頻度制限は引用できる投稿への投稿だけ数える
+	if ok, retryAfter := allowPost(me); !ok {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	body := normalizeText(r.FormValue("body"))
+
+	// 引用投稿は画像を持たないテキストの投稿として作る
+	result, err := db.Exec(
+		"INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `lang`, `status`, `quoted_post_id`, `created_at`) VALUES (?,'',?,?,?,?,?,NOW(6))",
+		me.ID,
+		[]byte{},
+		body,
+		detectLang(body),
+		postStatusPublished,
+		qid,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pid, err := result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE `posts` SET `quote_count` = `quote_count` + 1 WHERE `id` = ?", qid); err != nil {
+		log.Print(err)
+	}
+
+	savePostTags(int(pid), body)
+	go indexPost(int(pid))
+	notifyWebhooks(webhookEventPostCreated, int(pid))
+
+	memcacheClient.Delete("latest_post_id")
+	memcacheClient.Delete(fmt.Sprintf("account:%s", me.AccountName))
+	// 引用数は引用元の投稿者のページにも出る
+	memcacheClient.Delete(fmt.Sprintf("account:%s", author.AccountName))
+
+	respondCreated(w, r, "/posts/"+strconv.FormatInt(pid, 10), func() interface{} {
+		p := Post{}
+		if err := db.Get(&p, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count` FROM `posts` WHERE `id` = ?", pid); err != nil {
+			log.Print(err)
+			return nil
+		}
+		return newAPIPost(p)
+	})
+}
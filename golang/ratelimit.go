@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var (
+	// 1ユーザーがpostRateWindowの間に投稿できる件数
+	postRateLimit  uint64 = 5
+	postRateWindow        = time.Minute
+)
+
+func init() {
+	if n, err := strconv.ParseUint(os.Getenv("ISUCONP_POST_RATE_LIMIT"), 10, 64); err == nil && n > 0 {
+		postRateLimit = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_POST_RATE_WINDOW")); err == nil && d >= time.Second {
+		postRateWindow = d
+	}
+}
+
+// checkRate はwindowごとの固定ウィンドウでkeyの回数をmemcacheで数え、limit以内なら ok を返す。
+// 超えた場合はウィンドウが切り替わるまでの秒数を retryAfter に返す。
+// memcacheに障害があるときはサービスを止めないよう許可する。
+func checkRate(key string, limit uint64, window time.Duration) (ok bool, retryAfter int) {
+	sec := int64(window / time.Second)
+	now := time.Now().Unix()
+	bucket := now / sec
+	retryAfter = int((bucket+1)*sec - now)
+
+	k := fmt.Sprintf("%s:%d", key, bucket)
+	n, err := memcacheClient.Increment(k, 1)
+	if err == memcache.ErrCacheMiss {
+		err = memcacheClient.Add(&memcache.Item{Key: k, Value: []byte("1"), Expiration: int32(sec)})
+		if err == memcache.ErrNotStored {
+			n, err = memcacheClient.Increment(k, 1)
+		} else {
+			n = 1
+		}
+	}
+	if err != nil {
+		return true, 0
+	}
+	if n > limit {
+		return false, retryAfter
+	}
+	return true, 0
+}
+
+// tooManyRequests は Retry-After を付けて429を返す
+func tooManyRequests(w http.ResponseWriter, retryAfter int) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// allowPost は連投を防ぐため投稿の頻度を制限する。管理者は制限しない。
+func allowPost(me User) (bool, int) {
+	if me.Authority != 0 {
+		return true, 0
+	}
+	return checkRate(fmt.Sprintf("post_rate:%d", me.ID), postRateLimit, postRateWindow)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// 入力の検証で弾かれた投稿は頻度制限に数えない
+func TestCreatePostRateLimitCountsCreatedOnly(t *testing.T) {
+	useFakeMemcache(t)
+	useMockDB(t)
+	old := postRateLimit
+	postRateLimit = 1
+	t.Cleanup(func() { postRateLimit = old })
+
+	me := User{ID: 3, AccountName: "alice"}
+	cookies := loginCookies(t, me, "token")
+
+	invalid := []url.Values{
+		// 画像も本文も無い
+		{"csrf_token": {"token"}, "body": {""}},
+		// 先行アップロードのトークンが無効
+		{"csrf_token": {"token"}, "body": {"本文"}, "upload_tokens[]": {"unknown"}},
+		// 位置情報が範囲外
+		{"csrf_token": {"token"}, "body": {"本文"}, "lat": {"91"}, "lng": {"0"}},
+	}
+	for i := 0; i < 2; i++ {
+		for _, form := range invalid {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			postIndex(w, withCookies(r, cookies))
+			if w.Code != http.StatusFound {
+				t.Errorf("%v: status = %d, want 302", form, w.Code)
+			}
+		}
+	}
+
+	// 弾かれた投稿の後でも制限の1件目は投稿できる
+	if ok, _ := allowPost(me); !ok {
+		t.Error("rejected posts were counted toward the rate limit")
+	}
+	if ok, _ := allowPost(me); ok {
+		t.Error("second post in the window is allowed")
+	}
+}
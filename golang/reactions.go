@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 付けられる絵文字。ISUCONP_REACTION_EMOJIS（カンマ区切り）で差し替えられる
+var reactionEmojis = []string{"👍", "❤️", "😂", "😮", "😢", "🎉"}
+
+func init() {
+	if v := os.Getenv("ISUCONP_REACTION_EMOJIS"); v != "" {
+		emojis := []string{}
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				emojis = append(emojis, e)
+			}
+		}
+		if len(emojis) > 0 {
+			reactionEmojis = emojis
+		}
+	}
+}
+
+func listReactionEmojis() []string {
+	return reactionEmojis
+}
+
+func allowedReaction(emoji string) bool {
+	for _, e := range reactionEmojis {
+		if e == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// reactionRow は reactions の1行または集計行。comment_id が0なら投稿そのものへのリアクション
+type reactionRow struct {
+	PostID    int    `db:"post_id"`
+	CommentID int    `db:"comment_id"`
+	Emoji     string `db:"emoji"`
+	Count     int    `db:"count"`
+}
+
+// reactionTarget はリアクションを付ける対象。CommentID が0なら投稿そのもの
+type reactionTarget struct {
+	PostID    int
+	CommentID int
+}
+
+// fetchReactionCounts は対象ごとの絵文字別のリアクション数をカウンタから一括で取得する。
+// カウンタが無い対象は、その投稿と投稿のコメントへのリアクションをまとめてDBで数える。
+func fetchReactionCounts(gen uint64, targets []reactionTarget) (map[reactionTarget]map[string]int, error) {
+	type counterRef struct {
+		target reactionTarget
+		emoji  string
+	}
+	keys := make([]string, 0, len(targets)*len(reactionEmojis))
+	refs := make(map[string]counterRef, cap(keys))
+	for _, t := range targets {
+		for _, e := range reactionEmojis {
+			k := reactionCountKey(gen, t.PostID, t.CommentID, e)
+			keys = append(keys, k)
+			refs[k] = counterRef{t, e}
+		}
+	}
+
+	counts, err := getCounters(keys, func(missing []string) (map[string]int, error) {
+		pidSet := make(map[int]struct{})
+		for _, k := range missing {
+			pidSet[refs[k].target.PostID] = struct{}{}
+		}
+		pids := make([]int, 0, len(pidSet))
+		for pid := range pidSet {
+			pids = append(pids, pid)
+		}
+
+		q, args, err := sqlx.In("SELECT `post_id`, `comment_id`, `emoji`, COUNT(*) AS `count` FROM `reactions` WHERE `post_id` IN (?) GROUP BY `post_id`, `comment_id`, `emoji`", pids)
+		if err != nil {
+			return nil, err
+		}
+		rows := []reactionRow{}
+		if err := db.Select(&rows, q, args...); err != nil {
+			return nil, err
+		}
+		loaded := make(map[string]int, len(rows))
+		for _, row := range rows {
+			loaded[reactionCountKey(gen, row.PostID, row.CommentID, row.Emoji)] = row.Count
+		}
+		return loaded, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[reactionTarget]map[string]int)
+	for k, n := range counts {
+		if n <= 0 {
+			continue
+		}
+		ref := refs[k]
+		if res[ref.target] == nil {
+			res[ref.target] = make(map[string]int)
+		}
+		res[ref.target][ref.emoji] = n
+	}
+	return res, nil
+}
+
+// markMyReactions は閲覧者自身が付けたリアクションを投稿・コメントに設定する。
+// 一覧のキャッシュは閲覧者によらず共有しているので、キャッシュから取り出した後に呼ぶ。
+func markMyReactions(posts []Post, me User) []Post {
+	if !isLogin(me) || len(posts) == 0 {
+		return posts
+	}
+
+	postIDs := make([]int, len(posts))
+	for i, p := range posts {
+		postIDs[i] = p.ID
+	}
+	q, args, err := sqlx.In("SELECT `post_id`, `comment_id`, `emoji` FROM `reactions` WHERE `user_id` = ? AND `post_id` IN (?)", me.ID, postIDs)
+	if err != nil {
+		log.Print(err)
+		return posts
+	}
+	rows := []reactionRow{}
+	if err := db.Select(&rows, q, args...); err != nil {
+		log.Print(err)
+		return posts
+	}
+	if len(rows) == 0 {
+		return posts
+	}
+
+	mine := make(map[[2]int]map[string]bool)
+	for _, row := range rows {
+		k := [2]int{row.PostID, row.CommentID}
+		if mine[k] == nil {
+			mine[k] = make(map[string]bool)
+		}
+		mine[k][row.Emoji] = true
+	}
+
+	res := make([]Post, len(posts))
+	for i, p := range posts {
+		p.MyReactions = mine[[2]int{p.ID, 0}]
+		p.Comments = markMyCommentReactions(p.Comments, mine)
+		res[i] = p
+	}
+	return res
+}
+
+func markMyCommentReactions(comments []Comment, mine map[[2]int]map[string]bool) []Comment {
+	if len(comments) == 0 {
+		return comments
+	}
+	res := make([]Comment, len(comments))
+	for i, c := range comments {
+		c.MyReactions = mine[[2]int{c.PostID, c.ID}]
+		c.Replies = markMyCommentReactions(c.Replies, mine)
+		res[i] = c
+	}
+	return res
+}
+
+// postPostsReact は投稿へのリアクションを切り替える
+func postPostsReact(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	toggleReaction(w, r, pid, 0)
+}
+
+// postCommentsReact はコメントへのリアクションを切り替える
+func postCommentsReact(w http.ResponseWriter, r *http.Request) {
+	cid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var pid int
+	if err := db.Get(&pid, "SELECT `post_id` FROM `comments` WHERE `id` = ?", cid); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	toggleReaction(w, r, pid, cid)
+}
+
+func toggleReaction(w http.ResponseWriter, r *http.Request, pid, cid int) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	emoji := r.FormValue("emoji")
+	if !allowedReaction(emoji) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// 公開済みの投稿にだけ付けられる
+	var author User
+	err := db.Get(&author, "SELECT u.`id`, u.`account_name` FROM `posts` p JOIN `users` u ON u.`id` = p.`user_id` WHERE p.`id` = ? AND p.`status` = 'published'", pid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	gen := getCacheGeneration()
+	counterKey := reactionCountKey(gen, pid, cid, emoji)
+
+	reacted := false
+	result, err := db.Exec("DELETE FROM `reactions` WHERE `post_id` = ? AND `comment_id` = ? AND `user_id` = ? AND `emoji` = ?", pid, cid, me.ID, emoji)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		incrCounter(counterKey, -1)
+	} else {
+		result, err = db.Exec("INSERT IGNORE INTO `reactions` (`post_id`, `comment_id`, `user_id`, `emoji`) VALUES (?, ?, ?, ?)", pid, cid, me.ID, emoji)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			incrCounter(counterKey, 1)
+		}
+		reacted = true
+	}
+
+	// 一覧のキャッシュはリアクションの数を含むので作り直させる
+	invalidateIndexPosts()
+	memcacheClient.Delete(fmt.Sprintf("account:%s", author.AccountName))
+
+	if wantsJSON(r) {
+		target := reactionTarget{PostID: pid, CommentID: cid}
+		reactions, err := fetchReactionCounts(gen, []reactionTarget{target})
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		counts := reactions[target]
+		if counts == nil {
+			counts = map[string]int{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"post_id":    pid,
+			"comment_id": cid,
+			"emoji":      emoji,
+			"reacted":    reacted,
+			"reactions":  counts,
+		})
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", pid), http.StatusFound)
+}
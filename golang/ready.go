@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 依存の準備状態。すべて揃うまで /readyz は503を返す
+var (
+	dbReady         atomic.Bool
+	migrationsReady atomic.Bool
+	cacheWarmed     atomic.Bool
+	shuttingDown    atomic.Bool
+)
+
+var (
+	// シャットダウン開始から新規リクエストの受付を止めるまでの猶予（LBが503を検知する時間）
+	shutdownDrainDelay time.Duration
+	// 処理中のリクエストの完了を待つ上限
+	shutdownTimeout = 10 * time.Second
+)
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_SHUTDOWN_DRAIN_DELAY")); err == nil && d >= 0 {
+		shutdownDrainDelay = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_SHUTDOWN_TIMEOUT")); err == nil && d > 0 {
+		shutdownTimeout = d
+	}
+}
+
+// setReadiness はフラグを切り替え、変化したときだけログに出す
+func setReadiness(flag *atomic.Bool, name string, v bool) {
+	if flag.Swap(v) != v {
+		log.Printf("readiness: %s = %t", name, v)
+	}
+}
+
+func isReady() bool {
+	return dbReady.Load() && migrationsReady.Load() && cacheWarmed.Load() && !shuttingDown.Load()
+}
+
+// prepareReadiness は起動時にDB接続・マイグレーション・キャッシュウォーミングを順に行う
+func prepareReadiness() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		log.Printf("readiness: waiting for db: %s", err)
+		time.Sleep(time.Second)
+	}
+	setReadiness(&dbReady, "db", true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := runMigrations(ctx); err != nil {
+		// 失敗したままでは503を返し続けるので、/initialize で再実行されるのを待つ
+		log.Printf("readiness: migrations failed: %s", err)
+	}
+
+	if _, err := loadIndexPosts(postsPerPage, "index_posts", cacheTTL("index_posts", indexPostsTTL)); err != nil {
+		log.Printf("readiness: cache warming failed: %s", err)
+	}
+	// ウォーミングの失敗はリクエスト時に再取得できるので準備完了とする
+	setReadiness(&cacheWarmed, "cache_warmed", true)
+}
+
+// getHealthz はプロセスが生きていれば常に200を返す
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// getReadyz は依存の準備がすべて完了していれば200、それ以外は503を返す
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	if !isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	// これより大きくなったバッファはプールに戻さず捨てる（巨大なページでメモリを抱え続けないため）
+	renderBufferMaxPooled = 1 << 20
+)
+
+var renderBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// renderTemplate はテンプレートを一度バッファにレンダリングしてから書き出す。
+// レンダリングの途中で失敗したときは、途中までのHTMLを送らずに500を返す。
+func renderTemplate(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
+	buf := renderBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= renderBufferMaxPooled {
+			renderBufferPool.Put(buf)
+		}
+	}()
+
+	if err := tmpl.Execute(buf, data); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.Write(buf.Bytes())
+}
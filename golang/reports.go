@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	reportTargetPost    = "post"
+	reportTargetComment = "comment"
+
+	reportStatusOpen      = "open"
+	reportStatusResolved  = "resolved"
+	reportStatusDismissed = "dismissed"
+)
+
+type Report struct {
+	ID         int       `db:"id"`
+	TargetType string    `db:"target_type"`
+	TargetID   int       `db:"target_id"`
+	ReporterID int       `db:"reporter_id"`
+	Reason     string    `db:"reason"`
+	Status     string    `db:"status"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// postPostsReport は投稿を通報する
+func postPostsReport(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	createReport(w, r, reportTargetPost, pid, fmt.Sprintf("/posts/%d", pid))
+}
+
+// postCommentsReport はコメントを通報する
+func postCommentsReport(w http.ResponseWriter, r *http.Request) {
+	cid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	postID := 0
+	err = db.Get(&postID, "SELECT `post_id` FROM `comments` WHERE `id` = ?", cid)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	createReport(w, r, reportTargetComment, cid, fmt.Sprintf("/posts/%d#cid_%d", postID, cid))
+}
+
+func createReport(w http.ResponseWriter, r *http.Request, targetType string, targetID int, back string) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	// 同じユーザーが同じ対象を何度通報しても1件にまとめる（ユニークキーで重複を無視する）
+	_, err := db.Exec(
+		"INSERT IGNORE INTO `reports` (`target_type`, `target_id`, `reporter_id`, `reason`) VALUES (?,?,?,?)",
+		targetType, targetID, me.ID, r.FormValue("reason"),
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// getAdminReports は未処理の通報を新しい順に一覧する
+func getAdminReports(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if me.Authority == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	type reportRow struct {
+		Report
+		ReporterName string `db:"reporter_name"`
+		TargetText   string `db:"target_text"`
+		PostID       int    `db:"post_id"`
+	}
+	reports := []reportRow{}
+	err := db.Select(&reports, "SELECT r.*, u.`account_name` AS `reporter_name`, "+
+		"COALESCE(p.`body`, c.`comment`, '') AS `target_text`, "+
+		"COALESCE(p.`id`, c.`post_id`, 0) AS `post_id` "+
+		"FROM `reports` r JOIN `users` u ON u.`id` = r.`reporter_id` "+
+		"LEFT JOIN `posts` p ON r.`target_type` = 'post' AND p.`id` = r.`target_id` "+
+		"LEFT JOIN `comments` c ON r.`target_type` = 'comment' AND c.`id` = r.`target_id` "+
+		"WHERE r.`status` = 'open' ORDER BY r.`created_at` DESC, r.`id` DESC")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("admin_reports.html"),
+	)).Execute(w, struct {
+		Reports   []reportRow
+		Me        User
+		CSRFToken string
+	}{reports, me, getCSRFToken(r)})
+}
+
+// postAdminReportsResolve は通報に対して対象の削除か却下を行う
+func postAdminReportsResolve(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if me.Authority == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	report := Report{}
+	err = db.Get(&report, "SELECT * FROM `reports` WHERE `id` = ? AND `status` = 'open'", id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "delete":
+		if err := deleteReportTarget(report); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// 対象が無くなったので、同じ対象への他の通報もまとめて処理済みにする
+		_, err = db.Exec("UPDATE `reports` SET `status` = ? WHERE `target_type` = ? AND `target_id` = ? AND `status` = 'open'",
+			reportStatusResolved, report.TargetType, report.TargetID)
+	case "dismiss":
+		_, err = db.Exec("UPDATE `reports` SET `status` = ? WHERE `id` = ?", reportStatusDismissed, report.ID)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// deleteReportTarget は通報された投稿かコメントを削除し、関連するキャッシュを無効化する
+func deleteReportTarget(report Report) error {
+	switch report.TargetType {
+	case reportTargetPost:
+		post := Post{}
+		err := db.Get(&post, "SELECT `id`, `user_id`, `mime` FROM `posts` WHERE `id` = ?", report.TargetID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ids := []int{post.ID}
+		for _, q := range []string{
+			"DELETE FROM `comments` WHERE `post_id` IN (?)",
+			"DELETE FROM `likes` WHERE `post_id` IN (?)",
+			"DELETE FROM `reactions` WHERE `post_id` IN (?)",
+			"DELETE FROM `post_tags` WHERE `post_id` IN (?)",
+			"DELETE FROM `post_revisions` WHERE `post_id` IN (?)",
+			"DELETE FROM `posts` WHERE `id` IN (?)",
+		} {
+			if _, err := execIn(q, ids); err != nil {
+				return err
+			}
+		}
+		if post.Mime != "" {
+			removeStaticFile(post)
+		}
+		go deleteFromIndex(post.ID)
+
+		invalidateIndexPosts()
+		memcacheClient.Delete("latest_post_id")
+		invalidateAccountCache(post.UserID)
+	case reportTargetComment:
+		comment := Comment{}
+		err := db.Get(&comment, "SELECT `id`, `post_id`, `user_id` FROM `comments` WHERE `id` = ?", report.TargetID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		result, err := db.Exec("DELETE FROM `comments` WHERE `id` = ?", comment.ID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			// シャドウバンされたユーザーのコメントは数えていないので、減らさずに数え直させる
+			memcacheClient.Delete(commentCountKey(getCacheGeneration(), comment.PostID))
+		}
+		go indexPost(comment.PostID)
+
+		invalidateIndexPosts()
+		invalidateAccountCache(comment.UserID)
+		postUserID := 0
+		if err := db.Get(&postUserID, "SELECT `user_id` FROM `posts` WHERE `id` = ?", comment.PostID); err == nil {
+			invalidateAccountCache(postUserID)
+		}
+	}
+	return nil
+}
+
+// invalidateAccountCache はユーザーのアカウントページのキャッシュを消す
+func invalidateAccountCache(userID int) {
+	accountName := ""
+	if err := db.Get(&accountName, "SELECT `account_name` FROM `users` WHERE `id` = ?", userID); err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateCache(fmt.Sprintf("account:%s", accountName))
+}
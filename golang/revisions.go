@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+var (
+	// 投稿ごとに残す編集履歴の数。超えた分は古いものから消す
+	postRevisionLimit = 20
+	// 1なら編集履歴を誰でも見られるようにする（既定では投稿者本人と管理者のみ）
+	postHistoryPublic = os.Getenv("ISUCONP_POST_HISTORY_PUBLIC") == "1"
+)
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_POST_REVISION_LIMIT")); err == nil && n > 0 {
+		postRevisionLimit = n
+	}
+}
+
+// PostRevision は編集で置き換えられる前の本文。created_at はその編集の時刻
+type PostRevision struct {
+	ID         int       `db:"id"`
+	PostID     int       `db:"post_id"`
+	Body       string    `db:"body"`
+	EditorID   int       `db:"editor_id"`
+	EditorName string    `db:"editor_name"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// diffLine は行単位の差分の1行。Op は insert・delete・equal のいずれか
+type diffLine struct {
+	Op   string
+	Text string
+}
+
+// savePostRevision は編集前の本文を履歴に残し、上限を超えた古い履歴を消す
+func savePostRevision(tx *sqlx.Tx, postID int, body string, editorID int) error {
+	_, err := tx.Exec("INSERT INTO `post_revisions` (`post_id`, `body`, `editor_id`, `created_at`) VALUES (?,?,?,NOW(6))", postID, body, editorID)
+	if err != nil {
+		return err
+	}
+
+	ids := []int{}
+	if err := tx.Select(&ids, "SELECT `id` FROM `post_revisions` WHERE `post_id` = ? ORDER BY `id` DESC", postID); err != nil {
+		return err
+	}
+	if len(ids) <= postRevisionLimit {
+		return nil
+	}
+	_, err = tx.Exec("DELETE FROM `post_revisions` WHERE `post_id` = ? AND `id` <= ?", postID, ids[postRevisionLimit])
+	return err
+}
+
+// canViewPostHistory は閲覧者が投稿の編集履歴を見られるかを判定する
+func canViewPostHistory(p Post, me User) bool {
+	if isLogin(me) && (me.ID == p.UserID || me.Authority != 0) {
+		return true
+	}
+	return postHistoryPublic && p.Status == postStatusPublished
+}
+
+// lineDiff は2つの本文の行単位の差分を返す
+func lineDiff(before, after string) []diffLine {
+	dmp := diffmatchpatch.New()
+	a, b, lines := dmp.DiffLinesToChars(before, after)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lines)
+
+	result := []diffLine{}
+	for _, d := range diffs {
+		op := "equal"
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = "insert"
+		case diffmatchpatch.DiffDelete:
+			op = "delete"
+		}
+		for _, line := range strings.SplitAfter(d.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			result = append(result, diffLine{Op: op, Text: strings.TrimSuffix(line, "\n")})
+		}
+	}
+	return result
+}
+
+// getPostsHistory は投稿の編集履歴を、各編集で変わった行を強調して新しい順に表示する
+func getPostsHistory(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	post := Post{}
+	err = db.Get(&post, "SELECT `id`, `user_id`, `body`, `created_at`, `updated_at`, `status` FROM `posts` WHERE `id` = ?", pid)
+	if errors.Is(err, sql.ErrNoRows) {
+		archived, ok := getArchivedPost(pid)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		post, err = archived, nil
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	me := getSessionUser(r)
+	// 下書き・公開予約中の投稿は本人にしか見せない。予約中の投稿はまだ中身が無いので誰にも見せない
+	if post.Status == postStatusPreparing || isOwnerOnlyStatus(post.Status) && post.UserID != me.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !canViewPostHistory(post, me) {
+		if !isLogin(me) {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	revisions := []PostRevision{}
+	err = db.Select(&revisions, "SELECT r.`id`, r.`post_id`, r.`body`, r.`editor_id`, COALESCE(u.`account_name`, '') AS `editor_name`, r.`created_at` "+
+		"FROM `post_revisions` r LEFT JOIN `users` u ON u.`id` = r.`editor_id` "+
+		"WHERE r.`post_id` = ? ORDER BY r.`id`", pid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	type historyEntry struct {
+		EditedAt time.Time
+		Editor   string
+		Diff     []diffLine
+	}
+	// 各履歴とその次の版（最後は現在の本文）との差分が、その編集での変更になる
+	entries := make([]historyEntry, 0, len(revisions))
+	for i := len(revisions) - 1; i >= 0; i-- {
+		next := post.Body
+		if i+1 < len(revisions) {
+			next = revisions[i+1].Body
+		}
+		entries = append(entries, historyEntry{
+			EditedAt: revisions[i].CreatedAt,
+			Editor:   revisions[i].EditorName,
+			Diff:     lineDiff(revisions[i].Body, next),
+		})
+	}
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("post_history.html"),
+	)).Execute(w, struct {
+		Post    Post
+		Entries []historyEntry
+		Me      User
+	}{post, entries, me})
+}
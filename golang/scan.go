@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// clamdに1回で送るチャンクの大きさ
+	clamdChunkSize = 64 * 1024
+)
+
+// ScanResult はウイルススキャンの結果
+type ScanResult struct {
+	Infected  bool
+	Signature string // 検出されたシグネチャ名
+}
+
+// Scanner はアップロードされたファイルをスキャンする
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+var (
+	uploadScanner Scanner = noopScanner{}
+	scanTimeout           = 5 * time.Second
+	// trueならスキャンに失敗（clamdの停止・タイムアウト）してもアップロードを受け付ける
+	scanFailOpen = true
+)
+
+func init() {
+	if addr := os.Getenv("ISUCONP_CLAMD_ADDRESS"); addr != "" {
+		network := "tcp"
+		if strings.HasPrefix(addr, "unix:") {
+			network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		}
+		uploadScanner = &clamdScanner{network: network, address: addr}
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_CLAMD_TIMEOUT")); err == nil && d > 0 {
+		scanTimeout = d
+	}
+	if os.Getenv("ISUCONP_CLAMD_FAIL_MODE") == "closed" {
+		scanFailOpen = false
+	}
+}
+
+// noopScanner は何もスキャンしない
+type noopScanner struct{}
+
+func (noopScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	return ScanResult{}, nil
+}
+
+// clamdScanner はclamdのINSTREAMコマンドでファイルをスキャンする
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func (s *clamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+
+	// 4バイトのビッグエンディアンの長さに続けてデータを送り、長さ0で終わる
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return ScanResult{}, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+
+	// 応答は "stream: OK" か "stream: <シグネチャ> FOUND"
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		sig := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return ScanResult{Infected: true, Signature: sig}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanUpload はアップロードされたファイルをスキャンし、感染していればエラーを返す。
+// 非同期にすると公開後に取り下げることになり、その間に配信されてしまうので、保存前に同期でスキャンする。
+// 画像は最大10MBでclamdのスキャンは通常数十ミリ秒なので、遅延はタイムアウトで上限を決めて許容する。
+// clamdが落ちていたりタイムアウトしたときに受け付けるかは ISUCONP_CLAMD_FAIL_MODE で選ぶ。
+func scanUpload(r io.ReadSeeker, name string) error {
+	if _, ok := uploadScanner.(noopScanner); ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+
+	result, err := uploadScanner.Scan(ctx, r)
+	if _, serr := r.Seek(0, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	if err != nil {
+		log.Printf("scan %s: %v", name, err)
+		if scanFailOpen {
+			return nil
+		}
+		return newUploadError(UploadErrorScanFailed, "scan: %w", err)
+	}
+	if result.Infected {
+		log.Printf("infected upload rejected: %s (%s)", name, result.Signature)
+		return newUploadError(UploadErrorInfected, "infected: %s", result.Signature)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// 公開予約のフォームの datetime-local の形式（サーバーのタイムゾーンで解釈する）
+	publishAtFormLayout = "2006-01-02T15:04"
+	// 1回の公開処理で扱う公開予約の投稿の数
+	schedulerBatchSize = 100
+)
+
+// 公開予約の投稿を公開する間隔
+var schedulerInterval = 30 * time.Second
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_SCHEDULER_INTERVAL")); err == nil && d > 0 {
+		schedulerInterval = d
+	}
+}
+
+// parsePublishAt は公開予約の時刻を datetime-local か ISO8601 で読む
+func parsePublishAt(v string) (time.Time, error) {
+	if t, err := time.ParseInLocation(publishAtFormLayout, v, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(ISO8601Format, v)
+}
+
+// postPostsSchedule は下書き（または公開予約中の投稿）を指定した時刻に公開するよう予約する
+func postPostsSchedule(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	publishAt, err := parsePublishAt(r.FormValue("publish_at"))
+	if err != nil || !publishAt.After(time.Now()) {
+		session := getSession(r)
+		session.Values["notice"] = "公開日時には未来の日時を指定してください"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/drafts", http.StatusFound)
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE `posts` SET `status` = ?, `publish_at` = ? WHERE `id` = ? AND `user_id` = ? AND `status` IN (?, ?)",
+		postStatusScheduled, publishAt, pid, me.ID, postStatusDraft, postStatusScheduled,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 予約しなおしで時刻が変わらなかった場合も0件になるので、存在を確かめる
+		var status string
+		err := db.Get(&status, "SELECT `status` FROM `posts` WHERE `id` = ? AND `user_id` = ?", pid, me.ID)
+		if err != nil || status != postStatusScheduled {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/settings/drafts", http.StatusSeeOther)
+}
+
+// postPostsUnschedule は予約を取り消して下書きに戻す
+func postPostsUnschedule(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 公開処理と競合しても、先に状態を変えた方だけが成功する
+	result, err := db.Exec(
+		"UPDATE `posts` SET `status` = ?, `publish_at` = NULL WHERE `id` = ? AND `user_id` = ? AND `status` = ?",
+		postStatusDraft, pid, me.ID, postStatusScheduled,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 既に公開された（または予約されていない）投稿は取り消せない
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/drafts", http.StatusSeeOther)
+}
+
+// publishDuePosts は公開時刻を過ぎた公開予約の投稿を公開し、公開した数を返す。
+// 複数のインスタンスで同時に実行しても、status を条件にした UPDATE で1つのインスタンスだけが公開する。
+func publishDuePosts() (int, error) {
+	published := 0
+	for {
+		due := []Post{}
+		err := db.Select(&due, "SELECT `id`, `user_id` FROM `posts` WHERE `status` = ? AND `publish_at` <= NOW(6) ORDER BY `publish_at` LIMIT ?", postStatusScheduled, schedulerBatchSize)
+		if err != nil {
+			return published, err
+		}
+		if len(due) == 0 {
+			return published, nil
+		}
+
+		n := 0
+		for _, p := range due {
+			// 投稿日時は予約した時刻にする（停止中に過ぎた予約も本来の時刻の位置に並ぶ）
+			result, err := db.Exec(
+				"UPDATE `posts` SET `status` = ?, `created_at` = `publish_at`, `publish_at` = NULL WHERE `id` = ? AND `status` = ?",
+				postStatusPublished, p.ID, postStatusScheduled,
+			)
+			if err != nil {
+				return published, err
+			}
+			// 他のインスタンスが先に公開したか、直前に取り消された
+			if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+				continue
+			}
+			n++
+
+			go indexPost(p.ID)
+			notifyWebhooks(webhookEventPostCreated, p.ID)
+			invalidateAccountCache(p.UserID)
+		}
+
+		published += n
+
+		// 公開予約した投稿のIDは最新とは限らないので、最新投稿IDでの失効に頼らず一覧のキャッシュも消す
+		if n > 0 {
+			memcacheClient.Delete("latest_post_id")
+			invalidateIndexPosts()
+		}
+
+		if len(due) < schedulerBatchSize {
+			return published, nil
+		}
+	}
+}
+
+// runScheduler は起動時に公開漏れの公開予約をまとめて公開し、その後は一定間隔で公開する
+func runScheduler() {
+	catchUp := func() {
+		n, err := publishDuePosts()
+		if err != nil {
+			log.Print(err)
+		}
+		if n > 0 {
+			log.Printf("scheduler: published %d posts", n)
+		}
+	}
+
+	catchUp()
+
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		catchUp()
+	}
+}
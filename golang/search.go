@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 検索結果1ページの件数
+	searchPerPage = 20
+	// インデックス再構築で1回に読み込む投稿数
+	reindexBatchSize = 100
+)
+
+// SearchIndexer は投稿（本文とコメント）の全文検索を行う。
+// Search の cursor は前ページ最後の投稿ID（0なら先頭から）で、次のカーソルも返す。
+type SearchIndexer interface {
+	Index(ctx context.Context, post Post) error
+	Delete(ctx context.Context, id int) error
+	Search(ctx context.Context, query string, cursor int) ([]int, int, error)
+}
+
+var (
+	searchIndexer  SearchIndexer = mysqlSearchIndexer{}
+	searchFallback SearchIndexer = mysqlSearchIndexer{}
+	searchTimeout                = 3 * time.Second
+)
+
+func init() {
+	switch os.Getenv("ISUCONP_SEARCH_BACKEND") {
+	case "meilisearch":
+		searchIndexer = &meilisearchIndexer{
+			endpoint: strings.TrimRight(os.Getenv("ISUCONP_MEILISEARCH_URL"), "/"),
+			apiKey:   os.Getenv("ISUCONP_MEILISEARCH_KEY"),
+			client:   &http.Client{},
+		}
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_SEARCH_TIMEOUT")); err == nil && d > 0 {
+		searchTimeout = d
+	}
+}
+
+// mysqlSearchIndexer は posts・comments をそのまま LIKE で検索する。
+// インデックスを持たないので Index・Delete は何もしない。
+type mysqlSearchIndexer struct{}
+
+func (mysqlSearchIndexer) Index(ctx context.Context, post Post) error { return nil }
+
+func (mysqlSearchIndexer) Delete(ctx context.Context, id int) error { return nil }
+
+func (mysqlSearchIndexer) Search(ctx context.Context, query string, cursor int) ([]int, int, error) {
+	pattern := "%" + escapeLike(query) + "%"
+
+	q := "SELECT p.`id` FROM `posts` p WHERE p.`status` = 'published' AND " +
+		"(p.`body` LIKE ? OR EXISTS (SELECT 1 FROM `comments` c WHERE c.`post_id` = p.`id` AND c.`comment` LIKE ?))"
+	args := []interface{}{pattern, pattern}
+	if cursor > 0 {
+		q += " AND p.`id` < ?"
+		args = append(args, cursor)
+	}
+	q += " ORDER BY p.`id` DESC LIMIT ?"
+	args = append(args, searchPerPage)
+
+	ids := []int{}
+	if err := db.SelectContext(ctx, &ids, q, args...); err != nil {
+		return nil, 0, err
+	}
+	return ids, nextSearchCursor(ids), nil
+}
+
+// escapeLike は LIKE のワイルドカードをエスケープする
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func nextSearchCursor(ids []int) int {
+	if len(ids) < searchPerPage {
+		return 0
+	}
+	return ids[len(ids)-1]
+}
+
+// meilisearchIndexer は Meilisearch の posts インデックスを使う
+type meilisearchIndexer struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+
+	// id での絞り込み・並び替えに必要な設定は初回に一度だけ行う
+	settingsOnce sync.Once
+}
+
+type searchDocument struct {
+	ID        int      `json:"id"`
+	UserID    int      `json:"user_id"`
+	Body      string   `json:"body"`
+	Comments  []string `json:"comments"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+func (m *meilisearchIndexer) Index(ctx context.Context, post Post) error {
+	m.ensureSettings(ctx)
+
+	doc := searchDocument{
+		ID:        post.ID,
+		UserID:    post.UserID,
+		Body:      post.Body,
+		Comments:  make([]string, 0, len(post.Comments)),
+		CreatedAt: post.CreatedAt.Unix(),
+	}
+	for _, c := range post.Comments {
+		doc.Comments = append(doc.Comments, c.Comment)
+	}
+	return m.do(ctx, http.MethodPost, "/indexes/posts/documents", []searchDocument{doc}, nil)
+}
+
+func (m *meilisearchIndexer) Delete(ctx context.Context, id int) error {
+	return m.do(ctx, http.MethodDelete, "/indexes/posts/documents/"+strconv.Itoa(id), nil, nil)
+}
+
+func (m *meilisearchIndexer) Search(ctx context.Context, query string, cursor int) ([]int, int, error) {
+	m.ensureSettings(ctx)
+
+	req := map[string]interface{}{
+		"q":                    query,
+		"limit":                searchPerPage,
+		"sort":                 []string{"id:desc"},
+		"attributesToRetrieve": []string{"id"},
+	}
+	if cursor > 0 {
+		req["filter"] = fmt.Sprintf("id < %d", cursor)
+	}
+
+	var res struct {
+		Hits []struct {
+			ID int `json:"id"`
+		} `json:"hits"`
+	}
+	if err := m.do(ctx, http.MethodPost, "/indexes/posts/search", req, &res); err != nil {
+		return nil, 0, err
+	}
+
+	ids := make([]int, 0, len(res.Hits))
+	for _, h := range res.Hits {
+		ids = append(ids, h.ID)
+	}
+	return ids, nextSearchCursor(ids), nil
+}
+
+func (m *meilisearchIndexer) ensureSettings(ctx context.Context) {
+	m.settingsOnce.Do(func() {
+		settings := map[string]interface{}{
+			"searchableAttributes": []string{"body", "comments"},
+			"filterableAttributes": []string{"id", "user_id"},
+			"sortableAttributes":   []string{"id"},
+		}
+		if err := m.do(ctx, http.MethodPatch, "/indexes/posts/settings", settings, nil); err != nil {
+			log.Print(err)
+		}
+	})
+}
+
+func (m *meilisearchIndexer) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, m.endpoint+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("meilisearch %s %s returned %d", method, path, res.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+// indexPost は投稿を本文と全コメント付きで非同期にインデックスする
+func indexPost(pid int) {
+	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+	defer cancel()
+
+	post := Post{}
+	err := db.GetContext(ctx, &post, "SELECT `id`, `user_id`, `body`, `created_at`, `status` FROM `posts` WHERE `id` = ?", pid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	// 下書きは検索に出さない
+	if post.Status != postStatusPublished {
+		return
+	}
+	if err := db.SelectContext(ctx, &post.Comments, "SELECT `id`, `post_id`, `user_id`, `comment`, `created_at` FROM `comments` WHERE `post_id` = ?", pid); err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := searchIndexer.Index(ctx, post); err != nil {
+		log.Printf("index post %d: %s", pid, err)
+	}
+}
+
+// deleteFromIndex は削除した投稿を非同期にインデックスから取り除く
+func deleteFromIndex(pid int) {
+	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+	defer cancel()
+
+	if err := searchIndexer.Delete(ctx, pid); err != nil {
+		log.Printf("delete post %d from index: %s", pid, err)
+	}
+}
+
+// searchPosts は検索エンジンで検索し、障害時はMySQLでの検索にフォールバックする
+func searchPosts(ctx context.Context, query string, cursor int) ([]int, int, error) {
+	sctx, cancel := context.WithTimeout(ctx, searchTimeout)
+	defer cancel()
+
+	ids, next, err := searchIndexer.Search(sctx, query, cursor)
+	if err == nil || searchIndexer == searchFallback {
+		return ids, next, err
+	}
+	log.Printf("search backend failed, fall back to mysql: %s", err)
+
+	fctx, fcancel := context.WithTimeout(ctx, searchTimeout)
+	defer fcancel()
+	return searchFallback.Search(fctx, query, cursor)
+}
+
+func getSearch(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	// 本文と同じく正規化して、合成済み文字と結合文字の違いで一致しなくならないようにする
+	query := strings.TrimSpace(normalizeText(r.URL.Query().Get("q")))
+
+	cursor := 0
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		c, err := strconv.Atoi(v)
+		if err != nil || c < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cursor = c
+	}
+
+	posts := []Post{}
+	next := 0
+	if query != "" {
+		ids, n, err := searchPosts(r.Context(), query, cursor)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next = n
+
+		results, err := postsByIDs(ids)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		posts, err = makePosts(results, getCSRFToken(r), false)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		posts = filterVisiblePosts(posts, me)
+	}
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("search.html"),
+	)).Execute(w, struct {
+		Query      string
+		Posts      []Post
+		NextCursor int
+		Me         User
+	}{query, posts, next, me})
+}
+
+// postsByIDs は公開済みの投稿を ids の順に取得する（インデックスに残った削除済みの投稿は除く）
+func postsByIDs(ids []int) ([]Post, error) {
+	if len(ids) == 0 {
+		return []Post{}, nil
+	}
+
+	q, args, err := sqlx.In("SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang`, `blurhash`, `quoted_post_id`, `quote_count`, `view_count` FROM `posts` WHERE `id` IN (?) AND `status` = 'published'", ids)
+	if err != nil {
+		return nil, err
+	}
+	found := []Post{}
+	if err := db.Select(&found, q, args...); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]Post, len(found))
+	for _, p := range found {
+		byID[p.ID] = p
+	}
+	results := make([]Post, 0, len(found))
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			results = append(results, p)
+		}
+	}
+	return results, nil
+}
+
+// reindexAll は公開済みの全投稿をインデックスし直す
+func reindexAll() error {
+	lastID := 0
+	for {
+		ids := []int{}
+		err := db.Select(&ids, "SELECT `id` FROM `posts` WHERE `id` > ? AND `status` = 'published' ORDER BY `id` LIMIT ?", lastID, reindexBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		for _, id := range ids {
+			indexPost(id)
+		}
+		lastID = ids[len(ids)-1]
+		log.Printf("reindex: done up to post %d", lastID)
+	}
+}
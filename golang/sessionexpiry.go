@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var (
+	// ログインからの絶対的な有効期限。使い続けていてもこれを過ぎたらログインし直させる
+	sessionMaxAge = 30 * 24 * time.Hour
+	// 最後のアクセスからこれだけ経ったセッションは無効にする
+	sessionIdleTimeout = 14 * 24 * time.Hour
+	// last_seen を更新する間隔。毎リクエストでセッションを保存しないよう間引く
+	sessionTouchInterval = 5 * time.Minute
+)
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_SESSION_MAX_AGE")); err == nil && d > 0 {
+		sessionMaxAge = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_SESSION_IDLE_TIMEOUT")); err == nil && d > 0 {
+		sessionIdleTimeout = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_SESSION_TOUCH_INTERVAL")); err == nil && d >= 0 {
+		sessionTouchInterval = d
+	}
+}
+
+// startSessionLifetime はログイン・登録したセッションに作成時刻と最終アクセス時刻を記録する
+func startSessionLifetime(session *sessions.Session) {
+	now := time.Now().Unix()
+	session.Values["created_at"] = now
+	session.Values["last_seen"] = now
+}
+
+// sessionExpired はログイン中のセッションが絶対期限かアイドル時間を過ぎているかを判定する。
+// 時刻を持たないセッション（この仕組みより前にログインしたもの）は sessionLifetime で記録するまで有効とする。
+func sessionExpired(session *sessions.Session, now time.Time) bool {
+	if _, ok := session.Values["user_id"]; !ok {
+		return false
+	}
+	if createdAt, ok := session.Values["created_at"].(int64); ok && now.Sub(time.Unix(createdAt, 0)) > sessionMaxAge {
+		return true
+	}
+	if lastSeen, ok := session.Values["last_seen"].(int64); ok && now.Sub(time.Unix(lastSeen, 0)) > sessionIdleTimeout {
+		return true
+	}
+	return false
+}
+
+// sessionLifetime は期限切れのセッションを破棄し、有効なセッションの last_seen を一定間隔で更新するミドルウェア。
+// セッションはリクエスト内で共有されるので、破棄した後のハンドラからは未ログインに見える。
+func sessionLifetime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// セッションCookieの無いリクエストではmemcacheを引かない
+		if _, err := r.Cookie(sessionName); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session := getSession(r)
+		if _, ok := session.Values["user_id"]; !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		switch {
+		case sessionExpired(session, now):
+			destroySession(w, r, session)
+		case session.Values["created_at"] == nil:
+			// 期限の無い古いセッションは、ここから期限を数え始める
+			startSessionLifetime(session)
+			if err := session.Save(r, w); err != nil {
+				log.Print(err)
+			}
+		default:
+			lastSeen, _ := session.Values["last_seen"].(int64)
+			if now.Sub(time.Unix(lastSeen, 0)) >= sessionTouchInterval {
+				session.Values["last_seen"] = now.Unix()
+				if err := session.Save(r, w); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// destroySession はセッションの中身を消してCookieも削除する。
+// 同じリクエストでログインし直したときに別のIDで保存されるよう、IDとオプションは作り直しておく。
+func destroySession(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	expired := *store.Options
+	expired.MaxAge = -1
+	session.Options = &expired
+	if err := session.Save(r, w); err != nil {
+		log.Print(err)
+	}
+	deleteXSRFCookie(w)
+
+	opts := *store.Options
+	session.Options = &opts
+	session.ID = ""
+	session.IsNew = true
+}
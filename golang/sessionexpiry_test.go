@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+
+	tests := []struct {
+		name   string
+		values map[interface{}]interface{}
+		want   bool
+	}{
+		{"未ログイン", map[interface{}]interface{}{"created_at": ago(365 * 24 * time.Hour)}, false},
+		{"ログイン直後", map[interface{}]interface{}{"user_id": 1, "created_at": ago(0), "last_seen": ago(0)}, false},
+		{"期限の直前", map[interface{}]interface{}{"user_id": 1, "created_at": ago(sessionMaxAge - time.Minute), "last_seen": ago(0)}, false},
+		{"絶対期限切れ", map[interface{}]interface{}{"user_id": 1, "created_at": ago(sessionMaxAge + time.Minute), "last_seen": ago(0)}, true},
+		{"アイドルの直前", map[interface{}]interface{}{"user_id": 1, "created_at": ago(time.Hour), "last_seen": ago(sessionIdleTimeout - time.Minute)}, false},
+		{"アイドル切れ", map[interface{}]interface{}{"user_id": 1, "created_at": ago(sessionIdleTimeout + time.Hour), "last_seen": ago(sessionIdleTimeout + time.Minute)}, true},
+		{"時刻を持たない古いセッション", map[interface{}]interface{}{"user_id": 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &sessions.Session{Values: tt.values}
+			if got := sessionExpired(session, now); got != tt.want {
+				t.Errorf("sessionExpired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// sessionCookiesWith はログインしたセッションの created_at・last_seen を書き換えたCookieを返す。
+// 0 の時刻は記録しない（この仕組みより前のセッション）
+func sessionCookiesWith(t *testing.T, u User, createdAt, lastSeen time.Time) []*http.Cookie {
+	t.Helper()
+
+	cookies := loginCookies(t, u, "token")
+	r := withCookies(httptest.NewRequest(http.MethodGet, "/", nil), cookies)
+	w := httptest.NewRecorder()
+	session := getSession(r)
+	delete(session.Values, "created_at")
+	delete(session.Values, "last_seen")
+	if !createdAt.IsZero() {
+		session.Values["created_at"] = createdAt.Unix()
+	}
+	if !lastSeen.IsZero() {
+		session.Values["last_seen"] = lastSeen.Unix()
+	}
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()
+}
+
+// requestWithSessionLifetime は sessionLifetime を通したハンドラで見えるログインユーザーと、保存されたセッションを返す
+func requestWithSessionLifetime(t *testing.T, cookies []*http.Cookie) (User, *httptest.ResponseRecorder, *sessions.Session) {
+	t.Helper()
+
+	var me User
+	w := httptest.NewRecorder()
+	r := withCookies(httptest.NewRequest(http.MethodGet, "/", nil), cookies)
+	sessionLifetime(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		me = getSessionUser(r)
+	})).ServeHTTP(w, r)
+
+	// 保存された内容を別のリクエストとして読み直す
+	if set := w.Result().Cookies(); len(set) > 0 {
+		cookies = set
+	}
+	saved := getSession(withCookies(httptest.NewRequest(http.MethodGet, "/", nil), cookies))
+	return me, w, saved
+}
+
+func TestSessionLifetime(t *testing.T) {
+	useFakeMemcache(t)
+	u := User{ID: 1, AccountName: "alice"}
+	now := time.Now()
+
+	t.Run("有効なセッション", func(t *testing.T) {
+		cookies := sessionCookiesWith(t, u, now.Add(-time.Hour), now.Add(-time.Second))
+		me, _, saved := requestWithSessionLifetime(t, cookies)
+		if me.ID != u.ID {
+			t.Errorf("user = %d, want %d", me.ID, u.ID)
+		}
+		// 間引いている間は last_seen を更新しない
+		if got, _ := saved.Values["last_seen"].(int64); got != now.Add(-time.Second).Unix() {
+			t.Errorf("last_seen = %d, want unchanged", got)
+		}
+	})
+
+	t.Run("last_seenの更新", func(t *testing.T) {
+		lastSeen := now.Add(-sessionTouchInterval - time.Minute)
+		cookies := sessionCookiesWith(t, u, now.Add(-time.Hour), lastSeen)
+		me, _, saved := requestWithSessionLifetime(t, cookies)
+		if me.ID != u.ID {
+			t.Errorf("user = %d, want %d", me.ID, u.ID)
+		}
+		if got, _ := saved.Values["last_seen"].(int64); got <= lastSeen.Unix() {
+			t.Errorf("last_seen = %d, want updated from %d", got, lastSeen.Unix())
+		}
+	})
+
+	t.Run("古いセッションは期限を数え始める", func(t *testing.T) {
+		cookies := sessionCookiesWith(t, u, time.Time{}, time.Time{})
+		me, _, saved := requestWithSessionLifetime(t, cookies)
+		if me.ID != u.ID {
+			t.Errorf("user = %d, want %d", me.ID, u.ID)
+		}
+		if _, ok := saved.Values["created_at"].(int64); !ok {
+			t.Error("created_at is not recorded")
+		}
+	})
+
+	expired := []struct {
+		name                string
+		createdAt, lastSeen time.Time
+	}{
+		{"絶対期限切れ", now.Add(-sessionMaxAge - time.Minute), now.Add(-time.Minute)},
+		{"アイドル切れ", now.Add(-sessionIdleTimeout - time.Hour), now.Add(-sessionIdleTimeout - time.Minute)},
+	}
+	for _, tt := range expired {
+		t.Run(tt.name, func(t *testing.T) {
+			cookies := sessionCookiesWith(t, u, tt.createdAt, tt.lastSeen)
+			me, w, saved := requestWithSessionLifetime(t, cookies)
+			if me.ID != 0 {
+				t.Errorf("expired session is still logged in as %d", me.ID)
+			}
+			if _, ok := saved.Values["user_id"]; ok {
+				t.Error("expired session was not destroyed")
+			}
+
+			deleted := false
+			for _, c := range w.Result().Cookies() {
+				if c.Name == sessionName && c.MaxAge < 0 {
+					deleted = true
+				}
+			}
+			if !deleted {
+				t.Error("session cookie was not deleted")
+			}
+		})
+	}
+}
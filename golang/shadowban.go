@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	auditActionShadowBan   = "shadow_ban"
+	auditActionShadowUnban = "shadow_unban"
+)
+
+// canView は viewer に author の投稿・コメントを見せてよいかを返す。
+// シャドウバンされたユーザーの投稿・コメントは本人にだけ見せる。
+func canView(viewer, author User) bool {
+	if author.DelFlg != 0 {
+		return false
+	}
+	return author.ShadowBanned == 0 || viewer.ID == author.ID
+}
+
+// visibleAuthorSQL は投稿者 u が viewer に見せられるユーザーかを表すSQLの条件と引数を返す（canView と同じ規則）
+func visibleAuthorSQL(viewer User) (string, []interface{}) {
+	if viewer.ShadowBanned != 0 {
+		return "u.`del_flg` = 0 AND (u.`shadow_banned` = 0 OR u.`id` = ?)", []interface{}{viewer.ID}
+	}
+	return "u.`del_flg` = 0 AND u.`shadow_banned` = 0", nil
+}
+
+// filterVisiblePosts は viewer に見せられない投稿とコメントを除く。
+// 一覧のキャッシュは閲覧者によらず共通なので、表示する直前に適用する。
+// キャッシュのスライスを書き換えないよう、コメントは新しいスライスに詰め直す。
+//
+// コメント数は誰にでも見えるコメントだけを数えているので、シャドウバンされた閲覧者には自分のコメントの分を足す
+func filterVisiblePosts(posts []Post, viewer User) []Post {
+	own := ownHiddenCommentCounts(posts, viewer)
+	filtered := make([]Post, 0, len(posts))
+	for _, p := range posts {
+		if !canView(viewer, p.User) {
+			continue
+		}
+		p.Comments = filterVisibleComments(p.Comments, viewer)
+		p.CommentCount += own[p.ID]
+		hideInvisibleQuote(&p, viewer)
+		filtered = append(filtered, p)
+	}
+	return filtered
+}
+
+func filterVisibleComments(comments []Comment, viewer User) []Comment {
+	filtered := make([]Comment, 0, len(comments))
+	for _, c := range comments {
+		if !canView(viewer, c.User) {
+			continue
+		}
+		if len(c.Replies) > 0 {
+			c.Replies = filterVisibleComments(c.Replies, viewer)
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// ownHiddenCommentCounts はシャドウバンされた viewer が各投稿に付けた（本人にしか見えない）コメントの数を返す
+func ownHiddenCommentCounts(posts []Post, viewer User) map[int]int {
+	if viewer.ShadowBanned == 0 || len(posts) == 0 {
+		return nil
+	}
+	postIDs := make([]int, len(posts))
+	for i, p := range posts {
+		postIDs[i] = p.ID
+	}
+	q, args, err := sqlx.In("SELECT post_id, COUNT(*) AS count FROM comments WHERE post_id IN (?) AND user_id = ? GROUP BY post_id", postIDs, viewer.ID)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	rows := []struct {
+		PostID int `db:"post_id"`
+		Count  int `db:"count"`
+	}{}
+	if err := db.Select(&rows, db.Rebind(q), args...); err != nil {
+		log.Print(err)
+		return nil
+	}
+	counts := make(map[int]int, len(rows))
+	for _, row := range rows {
+		counts[row.PostID] = row.Count
+	}
+	return counts
+}
+
+// postAdminShadowBan はユーザーのシャドウバンを設定・解除し、監査ログに記録する
+func postAdminShadowBan(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if me.Authority == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	uid, err := strconv.Atoi(r.FormValue("uid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	shadowBanned, action := 0, auditActionShadowUnban
+	if r.FormValue("shadow_banned") == "1" {
+		shadowBanned, action = 1, auditActionShadowBan
+	}
+
+	// 管理者はシャドウバンの対象にしない
+	result, err := db.Exec("UPDATE `users` SET `shadow_banned` = ? WHERE `id` = ? AND `authority` = 0", shadowBanned, uid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 変更が無い（既に同じ状態か、対象外のユーザー）ときは記録しない
+		http.Redirect(w, r, "/admin/banned", http.StatusFound)
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO `audit_logs` (`admin_id`, `action`, `target_user_id`) VALUES (?,?,?)", me.ID, action, uid)
+	if err != nil {
+		log.Print(err)
+	}
+
+	// 投稿一覧のキャッシュには投稿者のユーザー情報が、コメント数のカウンタにはそのユーザーのコメントの有無が
+	// 含まれるので、世代を進めてまとめて作り直させる
+	memcacheClient.Delete(fmt.Sprintf("user:%d", uid))
+	bumpCacheGeneration()
+
+	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+}
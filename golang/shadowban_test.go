@@ -0,0 +1,55 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// コメント数のカウンタは誰にでも見えるコメントだけを数えている。
+// 読み込んだ分だけ差し引くのではなく、シャドウバンされた本人には自分のコメントの分だけ足す
+func TestFilterVisiblePostsCommentCount(t *testing.T) {
+	alice := User{ID: 1, AccountName: "alice"}
+	bob := User{ID: 2, AccountName: "bob", ShadowBanned: 1}
+	posts := func() []Post {
+		return []Post{{
+			ID:           10,
+			User:         alice,
+			CommentCount: 5,
+			Comments: []Comment{
+				{ID: 1, User: alice},
+				{ID: 2, User: bob, Replies: []Comment{{ID: 3, User: alice}}},
+			},
+		}}
+	}
+
+	t.Run("他のユーザー", func(t *testing.T) {
+		useMockDB(t)
+		got := filterVisiblePosts(posts(), User{ID: 3, AccountName: "carol"})
+		if len(got) != 1 || got[0].CommentCount != 5 {
+			t.Fatalf("posts = %+v, want comment count 5", got)
+		}
+		if ids := commentIDs(got[0].Comments); !equalInts(ids, []int{1}) {
+			t.Errorf("comments = %v, want [1]", ids)
+		}
+	})
+
+	t.Run("シャドウバンされた本人", func(t *testing.T) {
+		mock := useMockDB(t)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT post_id, COUNT(*) AS count FROM comments WHERE post_id IN (?) AND user_id = ? GROUP BY post_id")).
+			WithArgs(10, bob.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"post_id", "count"}).AddRow(10, 2))
+
+		got := filterVisiblePosts(posts(), bob)
+		if len(got) != 1 || got[0].CommentCount != 7 {
+			t.Fatalf("posts = %+v, want comment count 7", got)
+		}
+		if ids := commentIDs(got[0].Comments); !equalInts(ids, []int{1, 2}) {
+			t.Errorf("comments = %v, want [1 2]", ids)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
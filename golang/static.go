@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// staticHandler は公開ディレクトリ配下のファイルだけを配信する。
+// ドットファイル・ディレクトリと、専用ハンドラで配信する画像ディレクトリは配信しない。
+type staticHandler struct {
+	root string
+}
+
+func newStaticHandler(dir string) (*staticHandler, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &staticHandler{root: root}, nil
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + r.URL.Path)
+
+	for _, seg := range strings.Split(p, "/") {
+		if strings.HasPrefix(seg, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if p == "/image" || strings.HasPrefix(p, "/image/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := filepath.Join(h.root, filepath.FromSlash(p))
+	if !strings.HasPrefix(name, h.root+string(filepath.Separator)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// ディレクトリの一覧は出さない
+	fi, err := os.Stat(name)
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, name)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"secret.txt":         "outside",
+		"public/favicon.ico": "icon",
+		"public/css/app.css": "body {}",
+		"public/.env":        "ISUCONP_DB_PASSWORD=secret",
+		"public/.git/config": "[core]",
+		"public/css/.hidden": "hidden",
+		"public/image/1.jpg": "jpeg",
+	}
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := newStaticHandler(filepath.Join(dir, "public"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/favicon.ico", http.StatusOK},
+		{"/css/app.css", http.StatusOK},
+
+		{"/.env", http.StatusNotFound},
+		{"/.git/config", http.StatusNotFound},
+		{"/css/.hidden", http.StatusNotFound},
+		{"/%2eenv", http.StatusNotFound},
+		{"/../secret.txt", http.StatusNotFound},
+		{"/css/../../secret.txt", http.StatusNotFound},
+		{"/%2e%2e/secret.txt", http.StatusNotFound},
+		{"/image/1.jpg", http.StatusNotFound},
+		{"/css/../image/1.jpg", http.StatusNotFound},
+		{"/css/", http.StatusNotFound},
+		{"/", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.want {
+				t.Errorf("GET %s: status = %d, want %d (body %q)", tt.path, w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// タグの最大文字数（post_tags.tag のカラム長）
+	tagMaxLength = 64
+	// サジェストで返す件数
+	tagSuggestLimit = 10
+	// サジェスト結果のキャッシュの秒数
+	tagSuggestTTL = 10
+)
+
+var hashtagPattern = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+
+// extractTags は本文から #タグ を重複なく取り出す。大文字小文字は区別しない
+func extractTags(body string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, m := range hashtagPattern.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(m[1])
+		if utf8.RuneCountInString(tag) > tagMaxLength || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// savePostTags は投稿本文のタグを post_tags に保存する
+func savePostTags(pid int, body string) {
+	for _, tag := range extractTags(body) {
+		_, err := db.Exec("INSERT IGNORE INTO `post_tags` (`post_id`, `tag`) VALUES (?,?)", pid, tag)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+}
+
+type tagCount struct {
+	Tag   string `json:"tag" db:"tag"`
+	Count int    `json:"count" db:"count"`
+}
+
+// getAPITagsSuggest は q で始まるタグを使用回数の多い順に返す。q が空なら人気のタグを返す
+func getAPITagsSuggest(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(normalizeText(r.URL.Query().Get("q"))), "#"))
+	if utf8.RuneCountInString(q) > tagMaxLength {
+		writeJSON(w, http.StatusOK, map[string][]tagCount{"tags": {}})
+		return
+	}
+
+	// 任意の文字列をmemcacheのキーに使えるようハッシュにする
+	sum := sha1.Sum([]byte(q))
+	cacheKey := "tag_suggest:" + hex.EncodeToString(sum[:])
+	if item, err := memcacheClient.Get(cacheKey); err == nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(item.Value)
+		return
+	}
+
+	tags := []tagCount{}
+	// 前方一致なら tag のインデックスが使える
+	err := db.Select(&tags, "SELECT t.`tag`, COUNT(*) AS `count` FROM `post_tags` t JOIN `posts` p ON p.`id` = t.`post_id` "+
+		"WHERE t.`tag` LIKE ? AND p.`status` = 'published' GROUP BY t.`tag` ORDER BY `count` DESC, t.`tag` LIMIT ?",
+		escapeLike(q)+"%", tagSuggestLimit)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(map[string][]tagCount{"tags": tags})
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	memcacheClient.Set(&memcache.Item{Key: cacheKey, Value: data, Expiration: tagSuggestTTL})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeText はユーザー入力のテキストを保存前に正規化する。
+// 不正なUTF-8のバイトを取り除き、NFCにそろえる。
+// 同じ見た目の文字が合成済み・結合文字で別々に保存されると、検索や重複判定、文字数の数え方がぶれるため。
+func normalizeText(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "")
+	}
+	return norm.NFC.String(s)
+}
+
+// 一覧に表示する本文の最大の文字数（書記素クラスタ数）。0なら切り詰めない
+var bodyPreviewLength = 280
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_BODY_PREVIEW_LENGTH")); err == nil && n >= 0 {
+		bodyPreviewLength = n
+	}
+}
+
+// truncateBody は本文が limit 文字（書記素クラスタ数）を超えていれば切り詰めて末尾に「…」を付ける。
+// 文の区切りか、それが無ければ改行できる位置（英単語の途中ではない位置）で切る。
+// どちらも前半にしか無いときは、短くなりすぎないよう limit 文字ちょうどで切る。
+func truncateBody(body string, limit int) (string, bool) {
+	if limit <= 0 || utf8.RuneCountInString(body) <= limit {
+		return body, false
+	}
+
+	count, pos := 0, 0
+	limitPos, sentencePos, linePos := -1, 0, 0
+	state := -1
+	rest := body
+	for len(rest) > 0 {
+		var cluster string
+		var boundaries int
+		cluster, rest, boundaries, state = uniseg.StepString(rest, state)
+		count++
+		pos += len(cluster)
+		if count > limit {
+			break
+		}
+		limitPos = pos
+		if boundaries&uniseg.MaskSentence != 0 {
+			sentencePos = pos
+		}
+		if boundaries&uniseg.MaskLine != uniseg.LineDontBreak {
+			linePos = pos
+		}
+	}
+	// 書記素クラスタにすると limit 以内に収まる（結合文字を含む）本文は切り詰めない
+	if limitPos == len(body) {
+		return body, false
+	}
+
+	cut := limitPos
+	switch {
+	case sentencePos >= limitPos/2:
+		cut = sentencePos
+	case linePos >= limitPos/2:
+		cut = linePos
+	}
+	return strings.TrimRightFunc(body[:cut], unicode.IsSpace) + "…", true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"結合文字の濁点を合成する", "か\u3099き\u3099", "がぎ"},
+		{"結合文字のアクセントを合成する", "cafe\u0301", "café"},
+		{"合成済みはそのまま", "がぎ café", "がぎ café"},
+		{"互換文字は変えない", "ｶﾞ ＡＢＣ ①", "ｶﾞ ＡＢＣ ①"},
+		{"不正なUTF-8のバイトを取り除く", "abc\xff\xfeあ", "abcあ"},
+		{"改行と空白は変えない", " a\r\nb\t", " a\r\nb\t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeText(tt.in)
+			if got != tt.want {
+				t.Errorf("normalizeText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("normalizeText(%q) is not valid UTF-8", tt.in)
+			}
+			// 保存済みの値を再度正規化しても変わらない
+			if again := normalizeText(got); again != got {
+				t.Errorf("normalizeText is not idempotent: %q -> %q", got, again)
+			}
+		})
+	}
+}
+
+// 合成済みと結合文字の入力が、保存・検索・タグ・文字数で同じに扱われる
+func TestNormalizeTextConsistency(t *testing.T) {
+	composed, decomposed := "#ガイド の説明", "#カ\u3099イト\u3099 の説明"
+
+	a, b := normalizeText(composed), normalizeText(decomposed)
+	if a != b {
+		t.Fatalf("normalizeText(%q) = %q, normalizeText(%q) = %q, want the same", composed, a, decomposed, b)
+	}
+	if utf8.RuneCountInString(a) != utf8.RuneCountInString(b) {
+		t.Errorf("rune counts differ: %d, %d", utf8.RuneCountInString(a), utf8.RuneCountInString(b))
+	}
+
+	tagsA, tagsB := extractTags(a), extractTags(b)
+	if len(tagsA) != 1 || len(tagsB) != 1 || tagsA[0] != "ガイド" || tagsB[0] != "ガイド" {
+		t.Errorf("tags = %v, %v, want [ガイド] for both", tagsA, tagsB)
+	}
+
+	alt := normalizeImageAlt("カ\u3099イト\u3099")
+	if alt != "ガイド" {
+		t.Errorf("normalizeImageAlt = %q, want the composed form", alt)
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		limit     int
+		want      string
+		truncated bool
+	}{
+		{"上限ちょうど", "あいうえお", 5, "あいうえお", false},
+		{"上限ちょうどの英文", "Hello", 5, "Hello", false},
+		{"上限を1文字超える", "あいうえおか", 5, "あいうえお…", true},
+		{"上限なし", "あいうえおか", 0, "あいうえおか", false},
+		{"日本語の文の区切り", "今日は晴れ。明日は雨が降るでしょう。", 10, "今日は晴れ。…", true},
+		{"英文の文の区切り", "Hello world. This is a long sentence.", 20, "Hello world.…", true},
+		{"改行できる位置", "The quick brown fox jumps over", 12, "The quick…", true},
+		{"改行の位置", "一行目です\n二行目の長い文章です", 8, "一行目です…", true},
+		{"区切りが前半にしか無い", "Hi. abcdefghijklmnopqrstuvwxyz", 20, "Hi. abcdefghijklmnop…", true},
+		{"結合文字は1文字", "か\u3099き\u3099く\u3099け\u3099こ\u3099", 5, "か\u3099き\u3099く\u3099け\u3099こ\u3099", false},
+		{"結合文字の途中で切らない", strings.Repeat("e\u0301", 6), 5, strings.Repeat("e\u0301", 5) + "…", true},
+		{"絵文字の途中で切らない", strings.Repeat("\U0001F468\u200d\U0001F469\u200d\U0001F467", 3), 2, strings.Repeat("\U0001F468\u200d\U0001F469\u200d\U0001F467", 2) + "…", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := truncateBody(tt.body, tt.limit)
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("truncateBody(%q, %d) = %q, %v, want %q, %v", tt.body, tt.limit, got, truncated, tt.want, tt.truncated)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateBody(%q, %d) = %q is not valid UTF-8", tt.body, tt.limit, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sort"
+)
+
+// buildCommentThreads はコメントを親子関係でまとめ、親コメントの Replies に返信を入れる。
+// ネストは1段だけにする（返信への返信は保存時に同じ親への返信にそろえている）。
+// 親コメントが削除された返信は消さずに、親の無いコメントとして元の位置に表示する。
+// 親コメントの並びは引数の順のまま、返信はスレッド内で古い順に並べる。
+func buildCommentThreads(comments []Comment) []Comment {
+	parents := make(map[int]int64, len(comments))
+	for _, c := range comments {
+		parents[c.ID] = c.ParentID.Int64 // 親が無ければ0
+	}
+
+	// 親が一覧にあり、その親自体が返信でなければ返信として扱う
+	isReply := func(c Comment) bool {
+		if !c.ParentID.Valid {
+			return false
+		}
+		grand, ok := parents[int(c.ParentID.Int64)]
+		return ok && grand == 0
+	}
+
+	roots := make([]Comment, 0, len(comments))
+	index := make(map[int]int, len(comments))
+	for _, c := range comments {
+		if isReply(c) {
+			continue
+		}
+		index[c.ID] = len(roots)
+		roots = append(roots, c)
+	}
+
+	for _, c := range comments {
+		if !isReply(c) {
+			continue
+		}
+		i := index[int(c.ParentID.Int64)]
+		roots[i].Replies = append(roots[i].Replies, c)
+	}
+
+	for i := range roots {
+		rs := roots[i].Replies
+		sort.SliceStable(rs, func(a, b int) bool {
+			if rs[a].CreatedAt.Equal(rs[b].CreatedAt) {
+				return rs[a].ID < rs[b].ID
+			}
+			return rs[a].CreatedAt.Before(rs[b].CreatedAt)
+		})
+	}
+
+	return roots
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// threadIDs はスレッドを「親ID: [返信ID...]」の並びにする
+func threadIDs(comments []Comment) [][]int {
+	res := [][]int{}
+	for _, c := range comments {
+		ids := []int{c.ID}
+		for _, r := range c.Replies {
+			ids = append(ids, r.ID)
+		}
+		res = append(res, ids)
+	}
+	return res
+}
+
+func TestBuildCommentThreads(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := func(id, parent, sec int) Comment {
+		cm := Comment{ID: id, CreatedAt: base.Add(time.Duration(sec) * time.Second)}
+		if parent != 0 {
+			cm.ParentID = sql.NullInt64{Int64: int64(parent), Valid: true}
+		}
+		return cm
+	}
+
+	tests := []struct {
+		name     string
+		comments []Comment
+		want     [][]int
+	}{
+		{"返信を親の下にまとめる", []Comment{c(1, 0, 1), c(2, 1, 2), c(3, 0, 3), c(4, 3, 4), c(5, 1, 5)}, [][]int{{1, 2, 5}, {3, 4}}},
+		{"親の並びは入力の順のまま", []Comment{c(3, 0, 3), c(5, 1, 5), c(1, 0, 1), c(2, 1, 2)}, [][]int{{3}, {1, 2, 5}}},
+		{"返信はスレッド内で古い順", []Comment{c(1, 0, 1), c(4, 1, 9), c(2, 1, 5), c(3, 1, 7)}, [][]int{{1, 2, 3, 4}}},
+		{"同時刻の返信はID順", []Comment{c(1, 0, 1), c(3, 1, 5), c(2, 1, 5)}, [][]int{{1, 2, 3}}},
+		{"親が削除された返信は元の位置に残す", []Comment{c(2, 99, 2), c(3, 0, 3), c(4, 3, 4)}, [][]int{{2}, {3, 4}}},
+		// 保存時に同じ親へそろえるので通常は無いが、ネストさせずに元の位置に表示する
+		{"返信への返信は1段目に出す", []Comment{c(1, 0, 1), c(2, 1, 2), c(3, 2, 3)}, [][]int{{1, 2}, {3}}},
+		{"空", []Comment{}, [][]int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := threadIDs(buildCommentThreads(tt.comments))
+			if len(got) != len(tt.want) {
+				t.Fatalf("threads = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !equalInts(got[i], tt.want[i]) {
+					t.Errorf("threads = %v, want %v", got, tt.want)
+					break
+				}
+			}
+
+			// 取りこぼし・重複が無いこと
+			n := 0
+			for _, th := range got {
+				n += len(th)
+			}
+			if n != len(tt.comments) {
+				t.Errorf("got %d comments in threads, want %d", n, len(tt.comments))
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// トレンド一覧に表示する件数
+	trendingLimit = 40
+	trendingKey   = "trending_post_ids"
+)
+
+var (
+	// 経過時間による減衰の強さ（大きいほど新しい投稿が有利）
+	trendingGravity = 1.8
+	// スコアを計算する対象期間（24〜72時間）
+	trendingWindow = 48 * time.Hour
+	// スコアを再計算する間隔
+	trendingInterval = 3 * time.Minute
+)
+
+func init() {
+	if g, err := strconv.ParseFloat(os.Getenv("ISUCONP_TRENDING_GRAVITY"), 64); err == nil && g > 0 {
+		trendingGravity = g
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_TRENDING_WINDOW")); err == nil {
+		trendingWindow = min(max(d, 24*time.Hour), 72*time.Hour)
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_TRENDING_INTERVAL")); err == nil && d > 0 {
+		trendingInterval = d
+	}
+}
+
+// trendingScore はHacker News風に反応数を経過時間で減衰させたスコアを返す
+func trendingScore(reactions int, age time.Duration) float64 {
+	hours := math.Max(age.Hours(), 0)
+	return float64(reactions) / math.Pow(hours+2, trendingGravity)
+}
+
+// computeTrending は対象期間の投稿のスコアを計算し、上位の投稿IDをキャッシュする
+func computeTrending() ([]int, error) {
+	type candidate struct {
+		ID           int       `db:"id"`
+		CreatedAt    time.Time `db:"created_at"`
+		CommentCount int       `db:"comment_count"`
+		LikeCount    int       `db:"like_count"`
+	}
+
+	now := time.Now()
+	candidates := []candidate{}
+	err := db.Select(&candidates, "SELECT p.`id`, p.`created_at`, "+
+		"(SELECT COUNT(*) FROM `comments` c WHERE c.`post_id` = p.`id`) AS `comment_count`, "+
+		"(SELECT COUNT(*) FROM `likes` l WHERE l.`post_id` = p.`id`) AS `like_count` "+
+		"FROM `posts` p JOIN `users` u ON u.`id` = p.`user_id` "+
+		"WHERE p.`created_at` >= ? AND p.`status` = 'published' AND u.`del_flg` = 0", now.Add(-trendingWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[int]float64, len(candidates))
+	for _, c := range candidates {
+		scores[c.ID] = trendingScore(c.CommentCount+c.LikeCount, now.Sub(c.CreatedAt))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		si, sj := scores[candidates[i].ID], scores[candidates[j].ID]
+		if si != sj {
+			return si > sj
+		}
+		return candidates[i].ID > candidates[j].ID
+	})
+
+	ids := make([]int, 0, trendingLimit)
+	for _, c := range candidates {
+		if len(ids) >= trendingLimit {
+			break
+		}
+		ids = append(ids, c.ID)
+	}
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	// 再計算が遅れても一覧が消えないよう間隔より長く保持する
+	memcacheClient.Set(&memcache.Item{
+		Key:        trendingKey,
+		Value:      data,
+		Expiration: int32(2 * trendingInterval / time.Second),
+	})
+
+	return ids, nil
+}
+
+// runTrendingTicker は定期的にトレンドを再計算する
+func runTrendingTicker() {
+	if _, err := computeTrending(); err != nil {
+		log.Print(err)
+	}
+
+	ticker := time.NewTicker(trendingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		start := time.Now()
+		if _, err := computeTrending(); err != nil {
+			log.Print(err)
+			continue
+		}
+		log.Printf("trending: recomputed (%s)", time.Since(start))
+	}
+}
+
+func getTrending(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	ids := []int{}
+	item, err := memcacheClient.Get(trendingKey)
+	if err == nil {
+		err = json.Unmarshal(item.Value, &ids)
+	}
+	if err != nil {
+		// 起動直後などでキャッシュが無いときだけリクエスト内で計算する
+		ids, err = computeTrending()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	results, err := postsByIDs(ids)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	posts, err := makePosts(results, getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	posts = markMyReactions(filterVisiblePosts(posts, me), me)
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("trending.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	)).Execute(w, struct {
+		Posts []Post
+		Me    User
+	}{posts, me})
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// 縦横どちらかがこれを超える画像は受け付けない
+	maxImageDimension = 10000
+)
+
+// UploadErrorKind はアップロード画像が不正な理由の種別
+type UploadErrorKind int
+
+const (
+	UploadErrorMissing    UploadErrorKind = iota + 1 // ファイルが無い
+	UploadErrorFormat                                // 許可されていない形式・宣言と中身の不一致
+	UploadErrorTooLarge                              // ファイルサイズ超過
+	UploadErrorCorrupted                             // 画像として読めない
+	UploadErrorDimension                             // 寸法が大きすぎる
+	UploadErrorInfected                              // ウイルスが検出された
+	UploadErrorScanFailed                            // ウイルススキャンができなかった
+)
+
+type UploadError struct {
+	Kind UploadErrorKind
+	Err  error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("invalid upload (kind=%d): %v", e.Kind, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// Notice はユーザーに表示するメッセージを返す
+func (e *UploadError) Notice() string {
+	switch e.Kind {
+	case UploadErrorMissing:
+		return "画像が必須です"
+	case UploadErrorFormat:
+		return "投稿できる画像形式はjpgとpngとgifだけです"
+	case UploadErrorTooLarge:
+		return "ファイルサイズが大きすぎます"
+	case UploadErrorDimension:
+		return "画像の縦横サイズが大きすぎます"
+	case UploadErrorInfected:
+		return "ウイルスが検出されたため投稿できません"
+	case UploadErrorScanFailed:
+		return "画像を検査できませんでした。時間をおいて再度お試しください"
+	default:
+		return "画像が壊れているか読み込めません"
+	}
+}
+
+func newUploadError(kind UploadErrorKind, format string, args ...interface{}) error {
+	return &UploadError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// validateUpload はアップロードされた画像の形式・サイズ・中身・寸法を検証し、
+// 保存に使うMIMEタイプと拡張子を返す。検証後は file を先頭に戻す。
+func validateUpload(file multipart.File, header *multipart.FileHeader) (mime, ext string, err error) {
+	if file == nil || header == nil {
+		return "", "", newUploadError(UploadErrorMissing, "no file")
+	}
+
+	// 投稿のContent-Typeからファイルのタイプを決定する
+	contentType := header.Header.Get("Content-Type")
+	if strings.Contains(contentType, "jpeg") {
+		mime = "image/jpeg"
+		ext = "jpg"
+	} else if strings.Contains(contentType, "png") {
+		mime = "image/png"
+		ext = "png"
+	} else if strings.Contains(contentType, "gif") {
+		mime = "image/gif"
+		ext = "gif"
+	} else {
+		return "", "", newUploadError(UploadErrorFormat, "unsupported content type %q", contentType)
+	}
+
+	if header.Size > UploadLimit {
+		return "", "", newUploadError(UploadErrorTooLarge, "size %d exceeds limit", header.Size)
+	}
+
+	// 宣言されたContent-Typeと実データが一致するかを確認する
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", "", newUploadError(UploadErrorCorrupted, "read header: %w", err)
+	}
+	if detected := http.DetectContentType(head[:n]); detected != mime {
+		return "", "", newUploadError(UploadErrorFormat, "content type %q does not match data %q", mime, detected)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", newUploadError(UploadErrorCorrupted, "seek: %w", err)
+	}
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", "", newUploadError(UploadErrorCorrupted, "decode config: %w", err)
+	}
+	if cfg.Width > maxImageDimension || cfg.Height > maxImageDimension {
+		return "", "", newUploadError(UploadErrorDimension, "dimension %dx%d exceeds limit", cfg.Width, cfg.Height)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", newUploadError(UploadErrorCorrupted, "seek: %w", err)
+	}
+
+	// 通常の投稿・先行アップロード・分割アップロードのどの経路もここを通るので、保存前にスキャンする
+	if err := scanUpload(file, header.Filename); err != nil {
+		return "", "", err
+	}
+
+	return mime, ext, nil
+}
+
+// 先行アップロード（D&D複数アップロード）された一時画像
+type pendingUpload struct {
+	UserID int    `json:"user_id"`
+	Mime   string `json:"mime"`
+	Ext    string `json:"ext"`
+}
+
+var (
+	uploadTmpDir     = filepath.Join(os.TempDir(), "isuconp-upload")
+	uploadTTL        = time.Hour
+	uploadMaxPerPost = 4
+	uploadTokenBytes = 16 // 推測されないよう十分な長さの乱数にする
+)
+
+func init() {
+	if dir := os.Getenv("ISUCONP_UPLOAD_TMP_DIR"); dir != "" {
+		uploadTmpDir = dir
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_UPLOAD_TTL")); err == nil && d > 0 {
+		uploadTTL = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_UPLOAD_MAX_PER_POST")); err == nil && n > 0 {
+		uploadMaxPerPost = n
+	}
+}
+
+func pendingUploadKey(token string) string {
+	return "upload:" + token
+}
+
+func pendingUploadPath(token, ext string) string {
+	return filepath.Join(uploadTmpDir, token+"."+ext)
+}
+
+// postAPIUpload は画像を1枚だけ先行アップロードして一時保存し、投稿確定時に使うトークンを返す
+func postAPIUpload(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		file, header = nil, nil
+	}
+
+	mime, ext, err := validateUpload(file, header)
+	if err != nil {
+		var uerr *UploadError
+		if !errors.As(err, &uerr) {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": uerr.Notice()})
+		return
+	}
+
+	if err := os.MkdirAll(uploadTmpDir, 0700); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token := secureRandomStr(uploadTokenBytes)
+	dst, err := os.OpenFile(pendingUploadPath(token, ext), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(dst, file); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	dst.Close()
+
+	// トークンはアップロードしたユーザーに紐付け、他人が流用できないようにする
+	meta, _ := json.Marshal(pendingUpload{UserID: me.ID, Mime: mime, Ext: ext})
+	err = memcacheClient.Set(&memcache.Item{
+		Key:        pendingUploadKey(token),
+		Value:      meta,
+		Expiration: int32(uploadTTL / time.Second),
+	})
+	if err != nil {
+		os.Remove(pendingUploadPath(token, ext))
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// findPendingUploads はトークンに対応する本人の一時画像を探す。
+// トークンは投稿を作成すると決まった時点で呼び出し側が無効化する
+func findPendingUploads(userID int, tokens []string) ([]pendingUpload, []string, error) {
+	if len(tokens) > uploadMaxPerPost {
+		return nil, nil, fmt.Errorf("too many uploads: %d", len(tokens))
+	}
+
+	uploads := make([]pendingUpload, 0, len(tokens))
+	paths := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		item, err := memcacheClient.Get(pendingUploadKey(token))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unknown upload token: %w", err)
+		}
+		var u pendingUpload
+		if err := json.Unmarshal(item.Value, &u); err != nil {
+			return nil, nil, err
+		}
+		if u.UserID != userID {
+			return nil, nil, errors.New("upload token belongs to another user")
+		}
+		uploads = append(uploads, u)
+		paths = append(paths, pendingUploadPath(token, u.Ext))
+	}
+	return uploads, paths, nil
+}
+
+// postIndexWithUploads は先行アップロード済みの画像で投稿を確定する。
+// 投稿は1枚の画像を持つので、画像ごとに同じ本文の投稿を作成する。
+func postIndexWithUploads(w http.ResponseWriter, r *http.Request, me User, tokens []string, status string) {
+	uploads, paths, err := findPendingUploads(me.ID, tokens)
+	if err != nil {
+		log.Print(err)
+		session := getSession(r)
+		session.Values["notice"] = "アップロードした画像が見つからないか、枚数が多すぎます"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	geo, err := parseGeo(r)
+	if err != nil {
+		session := getSession(r)
+		session.Values["notice"] = "位置情報は緯度-90〜90、経度-180〜180で指定してください"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	// 頻度制限は入力の検証を通って実際に作成する投稿だけ数える。
+	// 制限されたときは後で投稿し直せるよう一時画像を残しておく
+	if ok, retryAfter := allowPost(me); !ok {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+	// 取り出したトークンは再利用できないよう無効化する
+	for _, token := range tokens {
+		memcacheClient.Delete(pendingUploadKey(token))
+	}
+
+	body := normalizeText(r.FormValue("body"))
+	lang := detectLang(body)
+	imageAlt := formImageAlt(r)
+	imageAltManual := 0
+	if imageAlt != "" {
+		imageAltManual = 1
+	}
+
+	var lastPID int64
+	for i, u := range uploads {
+		f, err := os.Open(paths[i])
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		// 画像ごとにEXIFの撮影場所が異なりうるので、入力が無ければ画像ごとに補う
+		g := geo
+		fillGeoFromExif(r, &g, f, u.Mime)
+
+		result, err := db.Exec(
+			"INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `image_alt`, `image_alt_manual`, `lang`, `status`, `lat`, `lng`, `geo_public`, `created_at`) VALUES (?,?,?,?,?,?,?,?,?,?,?,NOW(6))",
+			me.ID,
+			u.Mime,
+			[]byte{},
+			body,
+			imageAlt,
+			imageAltManual,
+			lang,
+			status,
+			g.Lat,
+			g.Lng,
+			g.Public,
+		)
+		if err != nil {
+			f.Close()
+			log.Print(err)
+			return
+		}
+
+		lastPID, err = result.LastInsertId()
+		if err != nil {
+			f.Close()
+			log.Print(err)
+			return
+		}
+		savePostTags(int(lastPID), body)
+
+		saveStaticFile(int(lastPID), u.Ext, f)
+		f.Close()
+		os.Remove(paths[i])
+
+		go generateImageAlt(int(lastPID), u.Ext, u.Mime, me.AccountName)
+		enqueueBlurhash(int(lastPID), u.Ext, me.AccountName)
+		if status == postStatusPublished {
+			go indexPost(int(lastPID))
+			notifyWebhooks(webhookEventPostCreated, int(lastPID))
+		}
+	}
+
+	clearAutosave(me.ID)
+
+	if status == postStatusPublished {
+		memcacheClient.Delete("latest_post_id")
+		memcacheClient.Delete(fmt.Sprintf("account:%s", me.AccountName))
+	} else {
+		http.Redirect(w, r, "/settings/drafts", http.StatusSeeOther)
+		return
+	}
+
+	if len(uploads) == 1 {
+		http.Redirect(w, r, "/posts/"+strconv.FormatInt(lastPID, 10), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// cleanupPendingUploads は確定されずにTTLを過ぎた一時画像を定期的に削除する
+func cleanupPendingUploads() {
+	ticker := time.NewTicker(uploadTTL / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		entries, err := os.ReadDir(uploadTmpDir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || info.IsDir() {
+				continue
+			}
+			if time.Since(info.ModTime()) > uploadTTL {
+				if err := os.Remove(filepath.Join(uploadTmpDir, e.Name())); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+}
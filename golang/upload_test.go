@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+)
+
+// uploadFile はメモリ上のデータを multipart.File として扱う
+type uploadFile struct {
+	*bytes.Reader
+}
+
+func (uploadFile) Close() error { return nil }
+
+func encodeImage(t *testing.T, format string, w, h int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateUpload(t *testing.T) {
+	pngData := encodeImage(t, "png", 4, 3)
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		size        int64 // 0ならデータの長さ
+		wantKind    UploadErrorKind
+		wantExt     string
+	}{
+		{"png", "image/png", pngData, 0, 0, "png"},
+		{"jpeg", "image/jpeg", encodeImage(t, "jpeg", 4, 3), 0, 0, "jpg"},
+		{"gif", "image/gif", encodeImage(t, "gif", 4, 3), 0, 0, "gif"},
+		{"上限ちょうどの寸法", "image/png", encodeImage(t, "png", maxImageDimension, 1), 0, 0, "png"},
+
+		{"サイズ超過", "image/png", pngData, UploadLimit + 1, UploadErrorTooLarge, ""},
+		{"許可していない形式", "image/webp", pngData, 0, UploadErrorFormat, ""},
+		{"Content-Typeと中身の不一致", "image/jpeg", pngData, 0, UploadErrorFormat, ""},
+		{"画像ではないデータ", "image/png", []byte("<html><script>alert(1)</script></html>"), 0, UploadErrorFormat, ""},
+		{"デコードできない画像", "image/png", append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...), 0, UploadErrorCorrupted, ""},
+		{"空のファイル", "image/png", []byte{}, 0, UploadErrorCorrupted, ""},
+		{"横幅が大きすぎる", "image/png", encodeImage(t, "png", maxImageDimension+1, 1), 0, UploadErrorDimension, ""},
+		{"高さが大きすぎる", "image/gif", encodeImage(t, "gif", 1, maxImageDimension+1), 0, UploadErrorDimension, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = int64(len(tt.data))
+			}
+			header := &multipart.FileHeader{
+				Filename: "upload",
+				Header:   textproto.MIMEHeader{"Content-Type": {tt.contentType}},
+				Size:     size,
+			}
+			file := uploadFile{bytes.NewReader(tt.data)}
+
+			_, ext, err := validateUpload(file, header)
+			if tt.wantKind == 0 {
+				if err != nil {
+					t.Fatalf("validateUpload: %v", err)
+				}
+				if ext != tt.wantExt {
+					t.Errorf("ext = %q, want %q", ext, tt.wantExt)
+				}
+				// 保存のために先頭に戻っていること
+				if pos, _ := file.Seek(0, io.SeekCurrent); pos != 0 {
+					t.Errorf("file offset = %d, want 0", pos)
+				}
+				return
+			}
+
+			var uerr *UploadError
+			if !errors.As(err, &uerr) {
+				t.Fatalf("err = %v, want *UploadError", err)
+			}
+			if uerr.Kind != tt.wantKind {
+				t.Errorf("kind = %d, want %d (%v)", uerr.Kind, tt.wantKind, err)
+			}
+		})
+	}
+}
+
+func TestValidateUploadMissing(t *testing.T) {
+	_, _, err := validateUpload(nil, nil)
+	var uerr *UploadError
+	if !errors.As(err, &uerr) || uerr.Kind != UploadErrorMissing {
+		t.Errorf("err = %v, want UploadErrorMissing", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// 閲覧数について
+//
+// 閲覧のたびに posts を更新すると重いので、memcacheの views:{id} に加算しておき、
+// 定期的にまとめて posts.view_count に書き戻す。書き戻す投稿はこのプロセスで加算したものを覚えておく
+// （複数台で動かしても、加算した台がそれぞれ書き戻す）。
+
+var (
+	// 閲覧数を書き戻す間隔
+	viewFlushInterval = 10 * time.Second
+	// 同じ閲覧者が同じ投稿をこの間に何度見ても1回と数える
+	viewDedupTTL int32 = 30 * 60
+
+	pendingViewsMu sync.Mutex
+	pendingViews   = map[int]struct{}{}
+)
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_VIEW_FLUSH_INTERVAL")); err == nil && d > 0 {
+		viewFlushInterval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_VIEW_DEDUP_TTL")); err == nil && d > 0 {
+		viewDedupTTL = int32(d.Seconds())
+	}
+}
+
+func viewsKey(pid int) string {
+	return fmt.Sprintf("views:%d", pid)
+}
+
+// viewerKey は閲覧者を区別するキー。ログインしていなければセッション、
+// セッションも無ければIPアドレスとUser-Agentで区別する
+func viewerKey(r *http.Request, me User) string {
+	if isLogin(me) {
+		return "u" + strconv.Itoa(me.ID)
+	}
+	if id := getSession(r).ID; id != "" {
+		return "s" + id
+	}
+	sum := sha1.Sum([]byte(r.RemoteAddr + "\n" + r.UserAgent()))
+	return "a" + hex.EncodeToString(sum[:])
+}
+
+// recordView は投稿の閲覧を1回数える。同じ閲覧者の短時間の重複とクローラは数えない
+func recordView(r *http.Request, p Post, me User) {
+	if p.Status != postStatusPublished || botUAPattern.MatchString(r.UserAgent()) {
+		return
+	}
+
+	// Add は既にあれば失敗するので、存在確認と記録を1回で行える
+	viewed := &memcache.Item{Key: fmt.Sprintf("viewed:%d:%s", p.ID, viewerKey(r, me)), Value: []byte("1"), Expiration: viewDedupTTL}
+	if err := memcacheClient.Add(viewed); err != nil {
+		if err != memcache.ErrNotStored {
+			log.Print(err)
+		}
+		return
+	}
+
+	key := viewsKey(p.ID)
+	_, err := memcacheClient.Increment(key, 1)
+	if err == memcache.ErrCacheMiss {
+		err = memcacheClient.Add(&memcache.Item{Key: key, Value: []byte("1")})
+		if err == memcache.ErrNotStored {
+			_, err = memcacheClient.Increment(key, 1)
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	pendingViewsMu.Lock()
+	pendingViews[p.ID] = struct{}{}
+	pendingViewsMu.Unlock()
+}
+
+// flushViewCounts はmemcacheに溜めた閲覧数を posts.view_count に加算する。
+// 読んだ分だけ減らすので、書き戻している間に増えた分は次回に回る。
+func flushViewCounts() {
+	pendingViewsMu.Lock()
+	pids := make([]int, 0, len(pendingViews))
+	for pid := range pendingViews {
+		pids = append(pids, pid)
+	}
+	pendingViews = map[int]struct{}{}
+	pendingViewsMu.Unlock()
+
+	for _, pid := range pids {
+		key := viewsKey(pid)
+		item, err := memcacheClient.Get(key)
+		if err == memcache.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			log.Print(err)
+			markViewsPending(pid)
+			continue
+		}
+		n, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil || n == 0 {
+			continue
+		}
+		if _, err := memcacheClient.Decrement(key, n); err != nil {
+			log.Print(err)
+			markViewsPending(pid)
+			continue
+		}
+
+		if err := addViewCount(pid, n); err != nil {
+			log.Print(err)
+			// 書き戻せなかった分はmemcacheに戻して次回に回す
+			if _, err := memcacheClient.Increment(key, n); err != nil {
+				log.Printf("lost %d views of post %d: %s", n, pid, err)
+			}
+			markViewsPending(pid)
+		}
+	}
+}
+
+func markViewsPending(pid int) {
+	pendingViewsMu.Lock()
+	pendingViews[pid] = struct{}{}
+	pendingViewsMu.Unlock()
+}
+
+// addViewCount は閲覧数を加算する。アーカイブ済みの投稿ならアーカイブの方に加算する
+func addViewCount(pid int, n uint64) error {
+	result, err := db.Exec("UPDATE `posts` SET `view_count` = `view_count` + ? WHERE `id` = ?", n, pid)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+		return nil
+	}
+	_, err = db.Exec("UPDATE `posts_archive` SET `view_count` = `view_count` + ? WHERE `id` = ?", n, pid)
+	return err
+}
+
+// runViewFlusher は閲覧数を定期的に書き戻す
+func runViewFlusher() {
+	ticker := time.NewTicker(viewFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		flushViewCounts()
+	}
+}
+
+// fetchViewCounts は投稿の閲覧数を、まだ書き戻していない分も含めて一括で取得する。
+// 書き戻し済みの分は results に読み込んだ view_count を使うので、投稿を取得するクエリには view_count を含めること。
+func fetchViewCounts(results []Post) map[int]int {
+	counts := make(map[int]int, len(results))
+	postIDs := make([]int, len(results))
+	keys := make([]string, len(results))
+	for i, p := range results {
+		counts[p.ID] = p.ViewCount
+		postIDs[i] = p.ID
+		keys[i] = viewsKey(p.ID)
+	}
+
+	items, err := memcacheClient.GetMulti(keys)
+	if err != nil {
+		log.Print(err)
+		return counts
+	}
+	for _, pid := range postIDs {
+		if item, ok := items[viewsKey(pid)]; ok {
+			if n, err := strconv.Atoi(string(item.Value)); err == nil {
+				counts[pid] += n
+			}
+		}
+	}
+	return counts
+}
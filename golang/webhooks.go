@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhookEventPostCreated    = "post.created"
+	webhookEventCommentCreated = "comment.created"
+
+	// 通知待ちのイベントのキューの長さ（溢れた分は通知しない）
+	webhookQueueSize = 1024
+	// 管理画面に表示する配信ログの件数
+	webhookDeliveryLogLimit = 100
+	// 配信ログに残すレスポンス本文・エラーの長さ
+	webhookLogBodyLimit = 1024
+)
+
+// 登録できるイベントの種類
+var webhookEventTypes = []string{webhookEventPostCreated, webhookEventCommentCreated}
+
+var (
+	webhookWorkers     = 4
+	webhookMaxAttempts = 5
+	webhookRetryBase   = 2 * time.Second
+	webhookTimeout     = 5 * time.Second
+
+	webhookEvents  = make(chan webhookEvent, webhookQueueSize)
+	webhookRetries = make(chan webhookDelivery, webhookQueueSize)
+	webhookClient  = &http.Client{}
+)
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_WEBHOOK_WORKERS")); err == nil && n > 0 {
+		webhookWorkers = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("ISUCONP_WEBHOOK_MAX_ATTEMPTS")); err == nil && n > 0 {
+		webhookMaxAttempts = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_WEBHOOK_RETRY_BASE")); err == nil && d > 0 {
+		webhookRetryBase = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ISUCONP_WEBHOOK_TIMEOUT")); err == nil && d > 0 {
+		webhookTimeout = d
+	}
+	webhookClient.Timeout = webhookTimeout
+}
+
+type Webhook struct {
+	ID         int       `db:"id"`
+	URL        string    `db:"url"`
+	Secret     string    `db:"secret"`
+	EventTypes string    `db:"event_types"` // カンマ区切りのイベントの種類
+	Active     int       `db:"active"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// Subscribes はWebhookがイベントの通知先かを判定する
+func (h Webhook) Subscribes(event string) bool {
+	for _, t := range strings.Split(h.EventTypes, ",") {
+		if t == event {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDeliveryLog struct {
+	ID         int       `db:"id"`
+	WebhookID  int       `db:"webhook_id"`
+	EventType  string    `db:"event_type"`
+	Attempt    int       `db:"attempt"`
+	StatusCode int       `db:"status_code"` // 接続できなかったときは0
+	Error      string    `db:"error"`
+	Succeeded  int       `db:"succeeded"`
+	DurationMS int       `db:"duration_ms"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// 投稿・コメントの作成イベント。内容は通知時に読み込むのでIDだけ持つ
+type webhookEvent struct {
+	Type       string
+	ID         int
+	OccurredAt time.Time
+}
+
+// 1つのWebhookへの1回の配信。失敗したら attempt を増やしてリトライのキューに戻す
+type webhookDelivery struct {
+	Hook    Webhook
+	Event   string
+	Payload []byte
+	Attempt int
+}
+
+// notifyWebhooks はイベントの通知を依頼する。リクエストをブロックしないよう
+// キューが一杯のときは諦める。
+func notifyWebhooks(eventType string, id int) {
+	select {
+	case webhookEvents <- webhookEvent{Type: eventType, ID: id, OccurredAt: time.Now()}:
+	default:
+		log.Printf("webhook queue is full, skip %s %d", eventType, id)
+	}
+}
+
+// runWebhookWorkers は通知のワーカーを起動する。
+// 配信先が遅くても他の配信が止まらないよう複数のワーカーで処理する。
+func runWebhookWorkers() {
+	for i := 0; i < webhookWorkers; i++ {
+		go runWebhookWorker()
+	}
+}
+
+func runWebhookWorker() {
+	for {
+		select {
+		case ev := <-webhookEvents:
+			dispatchWebhookEvent(ev)
+		case d := <-webhookRetries:
+			deliverWebhook(d)
+		}
+	}
+}
+
+// dispatchWebhookEvent はイベントを購読している有効なWebhookそれぞれに配信する
+func dispatchWebhookEvent(ev webhookEvent) {
+	hooks := []Webhook{}
+	if err := db.Select(&hooks, "SELECT * FROM `webhooks` WHERE `active` = 1"); err != nil {
+		log.Print(err)
+		return
+	}
+
+	var payload []byte
+	for _, h := range hooks {
+		if !h.Subscribes(ev.Type) {
+			continue
+		}
+		if payload == nil {
+			p, err := webhookPayload(ev)
+			if err != nil {
+				log.Printf("webhook %s %d: %s", ev.Type, ev.ID, err)
+				return
+			}
+			payload = p
+		}
+		deliverWebhook(webhookDelivery{Hook: h, Event: ev.Type, Payload: payload, Attempt: 1})
+	}
+}
+
+// webhookPayload は通知するJSONを作る。内容はAPIのレスポンスと同じ形にする
+func webhookPayload(ev webhookEvent) ([]byte, error) {
+	var data interface{}
+	switch ev.Type {
+	case webhookEventPostCreated:
+		p := Post{}
+		if err := db.Get(&p, "SELECT `id`, `user_id`, `body`, `mime`, `created_at`, `image_alt`, `lang` FROM `posts` WHERE `id` = ?", ev.ID); err != nil {
+			return nil, err
+		}
+		data = newAPIPost(p)
+	case webhookEventCommentCreated:
+		c := Comment{}
+		if err := db.Get(&c, "SELECT * FROM `comments` WHERE `id` = ?", ev.ID); err != nil {
+			return nil, err
+		}
+		data = newAPIComment(c)
+	default:
+		return nil, fmt.Errorf("unknown webhook event %q", ev.Type)
+	}
+
+	return json.Marshal(struct {
+		Event      string      `json:"event"`
+		OccurredAt time.Time   `json:"occurred_at"`
+		Data       interface{} `json:"data"`
+	}{ev.Type, ev.OccurredAt, data})
+}
+
+// webhookSignature は secret をキーにしたペイロードのHMAC-SHA256を返す
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook は1回配信して結果を記録し、失敗したら指数バックオフでリトライを予約する
+func deliverWebhook(d webhookDelivery) {
+	start := time.Now()
+	status, err := postWebhook(d)
+
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+		if len(errText) > webhookLogBodyLimit {
+			errText = errText[:webhookLogBodyLimit]
+		}
+	}
+	succeeded := err == nil
+	_, lerr := db.Exec(
+		"INSERT INTO `webhook_deliveries` (`webhook_id`, `event_type`, `attempt`, `status_code`, `error`, `succeeded`, `duration_ms`) VALUES (?,?,?,?,?,?,?)",
+		d.Hook.ID, d.Event, d.Attempt, status, errText, succeeded, time.Since(start).Milliseconds(),
+	)
+	if lerr != nil {
+		log.Print(lerr)
+	}
+
+	// 4xx（429を除く）は送り直しても結果が変わらないのでリトライしない
+	retryable := status == 0 || status == http.StatusTooManyRequests || status >= 500
+	if succeeded || !retryable || d.Attempt >= webhookMaxAttempts {
+		if !succeeded {
+			log.Printf("webhook %d %s gave up after %d attempts: %s", d.Hook.ID, d.Event, d.Attempt, errText)
+		}
+		return
+	}
+
+	backoff := webhookRetryBase << (d.Attempt - 1)
+	d.Attempt++
+	time.AfterFunc(backoff, func() {
+		select {
+		case webhookRetries <- d:
+		default:
+			log.Printf("webhook retry queue is full, drop delivery to webhook %d", d.Hook.ID)
+		}
+	})
+}
+
+// postWebhook はペイロードをPOSTし、ステータスコードを返す。2xx以外はエラーにする
+func postWebhook(d webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.Hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Signature", webhookSignature(d.Hook.Secret, d.Payload))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, webhookLogBodyLimit))
+		return res.StatusCode, fmt.Errorf("status %d: %s", res.StatusCode, body)
+	}
+	// コネクションを使い回せるよう本文を読み切る
+	io.Copy(io.Discard, io.LimitReader(res.Body, webhookLogBodyLimit))
+	return res.StatusCode, nil
+}
+
+// getAdminWebhooks は登録済みのWebhookと最近の配信ログを表示する
+func getAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	me, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	hooks := []Webhook{}
+	if err := db.Select(&hooks, "SELECT * FROM `webhooks` ORDER BY `id`"); err != nil {
+		log.Print(err)
+		return
+	}
+	deliveries := []WebhookDeliveryLog{}
+	if err := db.Select(&deliveries, "SELECT * FROM `webhook_deliveries` ORDER BY `id` DESC LIMIT ?", webhookDeliveryLogLimit); err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("admin_webhooks.html"),
+	)).Execute(w, struct {
+		Webhooks   []Webhook
+		Deliveries []WebhookDeliveryLog
+		EventTypes []string
+		Me         User
+		CSRFToken  string
+		Flash      string
+	}{hooks, deliveries, webhookEventTypes, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postAdminWebhooks はWebhookを登録する。secret が空なら生成する
+func postAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	notice := ""
+	u, err := url.Parse(strings.TrimSpace(r.FormValue("url")))
+	events := []string{}
+	for _, e := range r.Form["event_types[]"] {
+		for _, t := range webhookEventTypes {
+			if e == t {
+				events = append(events, e)
+			}
+		}
+	}
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		notice = "URLはhttp://かhttps://で始まる絶対URLで指定してください"
+	case len(events) == 0:
+		notice = "通知するイベントを1つ以上選んでください"
+	}
+	if notice != "" {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+		return
+	}
+
+	secret := r.FormValue("secret")
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Print(err)
+			return
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	_, err = db.Exec("INSERT INTO `webhooks` (`url`, `secret`, `event_types`) VALUES (?,?,?)", u.String(), secret, strings.Join(events, ","))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// postAdminWebhooksUpdate はWebhookの有効・無効の切り替えか削除を行う
+func postAdminWebhooksUpdate(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "activate":
+		_, err = db.Exec("UPDATE `webhooks` SET `active` = 1 WHERE `id` = ?", id)
+	case "deactivate":
+		_, err = db.Exec("UPDATE `webhooks` SET `active` = 0 WHERE `id` = ?", id)
+	case "delete":
+		if _, err = db.Exec("DELETE FROM `webhooks` WHERE `id` = ?", id); err == nil {
+			_, err = db.Exec("DELETE FROM `webhook_deliveries` WHERE `webhook_id` = ?", id)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}